@@ -0,0 +1,437 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/plesk/docker-fs/lib/dockerfs"
+	"github.com/plesk/docker-fs/lib/manager"
+)
+
+// Subcommands, run as `docker-fs [flags] <command> [command flags]`.
+var commands = map[string]func(mng *manager.Manager, args []string) error{
+	"cat":         catFile,
+	"diff":        diffContainer,
+	"doctor":      doctor,
+	"dump-tar":    dumpTar,
+	"list-mounts": listMounts,
+	"ls":          listContainers,
+	"stop":        stop,
+	"tree":        treeContainer,
+	"unmount":     unmount,
+}
+
+func runCommand(mng *manager.Manager, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+	return cmd(mng, args)
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command [command flags]]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", name)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+type tarEntry struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	Mode     string `json:"mode"`
+	Linkname string `json:"linkname,omitempty"`
+}
+
+var tarTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeRegA:    "file",
+	tar.TypeLink:    "hardlink",
+	tar.TypeSymlink: "symlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeDir:     "dir",
+	tar.TypeFifo:    "fifo",
+}
+
+// List raw entries of container export, as the tar reader sees them.
+func dumpTar(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("dump-tar", flag.ExitOnError)
+	id := flags.String("id", "", "Docker containter ID (or name)")
+	format := flags.String("format", "text", "Output format: text or json")
+	_ = flags.Parse(args)
+	if *id == "" || (*format != "text" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var entries []tarEntry
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	err := mng.DumpArchive(*id, func(hdr *tar.Header) error {
+		typ, ok := tarTypes[hdr.Typeflag]
+		if !ok {
+			typ = fmt.Sprintf("%q", hdr.Typeflag)
+		}
+		entry := tarEntry{
+			Name:     hdr.Name,
+			Type:     typ,
+			Size:     hdr.Size,
+			Mode:     fmt.Sprintf("%04o", hdr.Mode),
+			Linkname: hdr.Linkname,
+		}
+		if *format == "json" {
+			entries = append(entries, entry)
+			return nil
+		}
+		link := ""
+		if entry.Linkname != "" {
+			link = " -> " + entry.Linkname
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\t%d\t%s%s\n", entry.Type, entry.Mode, entry.Size, entry.Name, link)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+	return w.Flush()
+}
+
+// stripPrefix trims prefix off path, shown as "/" if it's the prefix itself.
+// False means path is out of prefix.
+func stripPrefix(path, prefix string) (string, bool) {
+	switch {
+	case prefix == "/":
+		return path, true
+	case path == prefix:
+		return "/", true
+	case strings.HasPrefix(path, prefix+"/"):
+		return path[len(prefix):], true
+	}
+	return "", false
+}
+
+type treeEntry struct {
+	Path     string `json:"path"`
+	Mode     string `json:"mode"`
+	Linkname string `json:"linkname,omitempty"`
+}
+
+// List files of container export, directories aside.
+func treeContainer(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("tree", flag.ExitOnError)
+	id := flags.String("id", "", "Docker containter ID (or name)")
+	prefix := flags.String("strip-prefix", "/", "List files under this directory only, with paths relative to it")
+	format := flags.String("format", "text", "Output format: text or json")
+	_ = flags.Parse(args)
+	if *id == "" || (*format != "text" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	files, err := mng.ExportedFiles(*id)
+	if err != nil {
+		return err
+	}
+	entries := []treeEntry{}
+	for _, f := range files {
+		path, ok := stripPrefix(f.Path, filepath.Join("/", *prefix))
+		if !ok {
+			continue
+		}
+		entries = append(entries, treeEntry{Path: path, Mode: f.Mode.String(), Linkname: f.Linkname})
+	}
+	if *format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	for _, e := range entries {
+		link := ""
+		if e.Linkname != "" {
+			link = " -> " + e.Linkname
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s%s\n", e.Mode, e.Path, link); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+type changeEntry struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// Kinds of FS changes, as docker diff prints them.
+var changeKinds = map[uint8]string{
+	dockerfs.FileModified: "C",
+	dockerfs.FileAdded:    "A",
+	dockerfs.FileRemoved:  "D",
+}
+
+// List changes of container FS, like docker diff.
+func diffContainer(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	id := flags.String("id", "", "Docker containter ID (or name)")
+	prefix := flags.String("strip-prefix", "/", "List changes under this directory only, with paths relative to it")
+	format := flags.String("format", "text", "Output format: text or json")
+	_ = flags.Parse(args)
+	if *id == "" || (*format != "text" && *format != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	changes, err := mng.FsChanges(*id)
+	if err != nil {
+		return err
+	}
+	entries := []changeEntry{}
+	for _, ch := range changes {
+		path, ok := stripPrefix(ch.Path, filepath.Join("/", *prefix))
+		if !ok {
+			continue
+		}
+		entries = append(entries, changeEntry{Path: path, Kind: changeKinds[ch.Kind]})
+	}
+	if *format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+	for _, e := range entries {
+		if _, err := fmt.Printf("%s %s\n", e.Kind, e.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Functions available in -format templates, as in docker CLI.
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// List containers, optionally rendering each one with a Go template.
+func listContainers(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	format := flags.String("format", "", "Go template for each container, e.g. '{{.ID}} {{.Names}}'")
+	_ = flags.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	render := func(c types.Container) error {
+		_, err := fmt.Fprintf(w, "%.12s\t%s\t%s\t%s\n", c.ID, strings.Join(c.Names, ","), c.Image, c.State)
+		return err
+	}
+	if *format != "" {
+		tmpl, err := template.New("format").Funcs(templateFuncs).Parse(*format)
+		if err != nil {
+			return fmt.Errorf("invalid -format template: %w", err)
+		}
+		// catch references to unknown fields before listing anything
+		sample := types.Container{Names: []string{""}}
+		if err := tmpl.Execute(ioutil.Discard, sample); err != nil {
+			return fmt.Errorf("invalid -format template: %w", err)
+		}
+		render = func(c types.Container) error {
+			if err := tmpl.Execute(w, c); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintln(w)
+			return err
+		}
+	} else {
+		fmt.Fprintf(w, "CONTAINER ID\tNAMES\tIMAGE\tSTATE\n")
+	}
+
+	cts, err := mng.ListContainers()
+	if err != nil {
+		return err
+	}
+	for _, c := range cts {
+		if err := render(c); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// List mounts recorded in status file, removing stale ones.
+func listMounts(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("list-mounts", flag.ExitOnError)
+	keep := flags.Bool("keep", false, "Keep stale mounts in status file")
+	_ = flags.Parse(args)
+
+	mounts, err := mng.ListMounts(!*keep)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "CONTAINER ID\tNAME\tMOUNT POINT\tSTATUS\n")
+	for _, m := range mounts {
+		status := "mounted"
+		switch {
+		case !m.Mounted && *keep:
+			status = "stale"
+		case !m.Mounted:
+			status = "stale, removed"
+		case m.ReadOnly:
+			status = "mounted, read-only"
+		}
+		name := m.ContainerName
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%.12s\t%s\t%s\t%s\n", m.ContainerId, name, m.MountPoint, status)
+	}
+	return w.Flush()
+}
+
+// Stop the process serving mount of a container.
+func stop(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	id := flags.String("id", "", "Docker containter ID (or name)")
+	_ = flags.Parse(args)
+	if *id == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	key, _, err := mountedContainer(mng, *id)
+	if err != nil {
+		return err
+	}
+	return mng.StopContainer(key)
+}
+
+// mountedContainer finds mount of container id in status file. Mounts are
+// recorded by full container ID, so id is resolved unless it's recorded as is.
+func mountedContainer(mng *manager.Manager, id string) (string, manager.MountStatus, error) {
+	status, err := mng.ReadStatus()
+	if err != nil {
+		return "", manager.MountStatus{}, err
+	}
+	if mount, ok := status[id]; ok {
+		return id, mount, nil
+	}
+	if resolved, err := mng.ResolveContainer(id); err == nil {
+		if mount, ok := status[resolved]; ok {
+			return resolved, mount, nil
+		}
+	}
+	return "", manager.MountStatus{}, fmt.Errorf("container %v is not mounted", id)
+}
+
+// Unmount a container or all mounted containers.
+func unmount(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("unmount", flag.ExitOnError)
+	id := flags.String("id", "", "Docker containter ID (or name)")
+	all := flags.Bool("all", false, "Unmount all mounted containers")
+	_ = flags.Parse(args)
+	if (*id == "") == !*all {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *id != "" {
+		key, mount, err := mountedContainer(mng, *id)
+		if err != nil {
+			return err
+		}
+		return mng.UnmountContainer(key, mount.MountPoint)
+	}
+
+	results, err := mng.UnmountAll()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("%.12s %s: FAILED: %v\n", r.Id, r.MountPoint, r.Err)
+			continue
+		}
+		fmt.Printf("%.12s %s: unmounted\n", r.Id, r.MountPoint)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d unmounts failed", failed, len(results))
+	}
+	return nil
+}
+
+// Check what mounting needs, printing the result of each check.
+func doctor(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	id := flags.String("id", "", "Docker containter ID (or name) to check export of")
+	_ = flags.Parse(args)
+
+	checks := mng.Doctor(*id)
+	failed := 0
+	for _, c := range checks {
+		if c.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", c.Name, c.Err)
+			if hint := manager.Hint(c.Err); hint != "" {
+				fmt.Printf("     Try: %s\n", hint)
+			}
+			continue
+		}
+		if c.Detail != "" {
+			fmt.Printf("PASS %s (%s)\n", c.Name, c.Detail)
+			continue
+		}
+		fmt.Printf("PASS %s\n", c.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// Print a container file, unless it's binary.
+func catFile(mng *manager.Manager, args []string) error {
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	id := flags.String("id", "", "Docker containter ID (or name)")
+	force := flags.Bool("force", false, "Print binary content too")
+	_ = flags.Parse(args)
+	if *id == "" || flags.NArg() != 1 {
+		fmt.Fprintf(flags.Output(), "Usage: %s cat -id <container> <path>\n", os.Args[0])
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	data, err := mng.ReadFile(*id, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if mimeType, binary := dockerfs.DetectContentType(data); binary && !*force {
+		fmt.Printf("%s: binary file, %d bytes, %s\n", flags.Arg(0), len(data), mimeType)
+		return nil
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
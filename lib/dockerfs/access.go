@@ -0,0 +1,94 @@
+package dockerfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/plesk/docker-fs/lib/log"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var _ = (fs.NodeAccesser)((*File)(nil))
+var _ = (fs.NodeAccesser)((*Dir)(nil))
+
+// Bits of access(2) mask.
+const (
+	accessExec  = 1
+	accessWrite = 2
+	accessRead  = 4
+)
+
+func (f *File) Access(ctx context.Context, mask uint32) (errno syscall.Errno) {
+	defer log.Printf("[debug] File (%s) Access(%o): %v", f.fullpath, mask, errno)
+	var out fuse.AttrOut
+	if errno := f.Getattr(ctx, nil, &out); errno != 0 {
+		return errno
+	}
+	return f.mng.access(ctx, out.Mode, mask)
+}
+
+func (d *Dir) Access(ctx context.Context, mask uint32) (errno syscall.Errno) {
+	defer log.Printf("[debug] Dir (%s) Access(%o): %v", d.fullpath, mask, errno)
+	var out fuse.AttrOut
+	if errno := d.Getattr(ctx, nil, &out); errno != 0 {
+		return errno
+	}
+	return d.mng.access(ctx, out.Mode, mask)
+}
+
+// access checks mask against mode of a file, as the kernel does for the
+// owner files are reported to have (see Options.Uid).
+func (m *Mng) access(ctx context.Context, mode uint32, mask uint32) syscall.Errno {
+	if mask&accessWrite != 0 && m.readOnly {
+		return syscall.EROFS
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return 0
+	}
+	if caller.Uid == 0 {
+		// root may do anything, but run files nobody may run
+		if mask&accessExec != 0 && mode&syscall.S_IFMT != syscall.S_IFDIR && mode&0111 == 0 {
+			return syscall.EACCES
+		}
+		return 0
+	}
+	var granted uint32
+	switch {
+	case caller.Uid == m.uid:
+		granted = mode >> 6 & 7
+	case caller.Gid == m.gid || inGroup(caller.Pid, m.gid):
+		granted = mode >> 3 & 7
+	default:
+		granted = mode & 7
+	}
+	if mask&^granted&7 != 0 {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// inGroup tells if process pid is in group gid by its supplementary groups.
+func inGroup(pid uint32, gid uint32) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			if g, err := strconv.ParseUint(field, 10, 32); err == nil && uint32(g) == gid {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package dockerfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestAccess(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/app/run.sh", "#!/bin/sh\n").
+		addFile("/app/app.conf", "x").
+		addFile("/app/others", "x")
+	fake.entries["/app/run.sh"].mode = 0750
+	fake.entries["/app/app.conf"].mode = 0640
+	// owner bits apply to the owner, even if others may read
+	fake.entries["/app/others"].mode = 0004
+	uid, gid := uint32(1000), uint32(1000)
+	_, root := newTestMng(t, fake, Options{Uid: &uid, Gid: &gid})
+	dir := lookupDir(t, root, "app")
+	callers := map[string]*fuse.Caller{
+		"owner": {Owner: fuse.Owner{Uid: 1000, Gid: 1000}},
+		"group": {Owner: fuse.Owner{Uid: 2000, Gid: 1000}},
+		"other": {Owner: fuse.Owner{Uid: 3000, Gid: 3000}},
+		"root":  {Owner: fuse.Owner{Uid: 0, Gid: 0}},
+	}
+
+	for _, tc := range []struct {
+		file   string
+		caller string
+		mask   uint32
+		errno  syscall.Errno
+	}{
+		{"run.sh", "owner", accessExec | accessWrite, 0},
+		{"run.sh", "group", accessExec | accessRead, 0},
+		{"run.sh", "group", accessWrite, syscall.EACCES},
+		{"run.sh", "other", accessExec, syscall.EACCES},
+		{"run.sh", "root", accessExec, 0},
+		{"app.conf", "owner", accessWrite, 0},
+		{"app.conf", "owner", accessExec, syscall.EACCES},
+		{"app.conf", "group", accessRead, 0},
+		{"app.conf", "other", accessRead, syscall.EACCES},
+		{"app.conf", "root", accessWrite, 0},
+		{"app.conf", "root", accessExec, syscall.EACCES},
+		{"others", "owner", accessRead, syscall.EACCES},
+		{"others", "other", accessRead, 0},
+		{"others", "other", 0, 0},
+	} {
+		ctx := fuse.NewContext(context.Background(), callers[tc.caller])
+		node, errno := dir.Lookup(ctx, tc.file, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%s) = %v", tc.file, errno)
+		}
+		if errno := node.Operations().(*File).Access(ctx, tc.mask); errno != tc.errno {
+			t.Errorf("Access(%s, %o) by %s = %v, expected %v", tc.file, tc.mask, tc.caller, errno, tc.errno)
+		}
+	}
+
+	ctx := fuse.NewContext(context.Background(), callers["other"])
+	if errno := dir.Access(ctx, accessExec|accessRead); errno != 0 {
+		t.Errorf("Access(app) by other = %v, expected 0", errno)
+	}
+	if errno := dir.Access(ctx, accessWrite); errno != syscall.EACCES {
+		t.Errorf("Access(app, W_OK) by other = %v, expected EACCES", errno)
+	}
+
+	_, root = newTestMng(t, fake, Options{ReadOnly: true, Uid: &uid, Gid: &gid})
+	ctx = fuse.NewContext(context.Background(), callers["owner"])
+	if errno := lookupDir(t, root, "app").Access(ctx, accessWrite); errno != syscall.EROFS {
+		t.Errorf("Access(W_OK) of read-only mount = %v, expected EROFS", errno)
+	}
+}
@@ -0,0 +1,238 @@
+package dockerfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/plesk/docker-fs/lib/log"
+)
+
+// Content of files read from container is cached on disk, keyed by path,
+// mtime and size of file. A cached copy is used only while the file in
+// container has the same mtime and size.
+
+// Directory of caches of all containers.
+func cacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache/dockerfs"), nil
+}
+
+// Directory of cached files of container.
+func fileCacheDir(id string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "files", id), nil
+}
+
+func pathHash(path string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(path)))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedFileName returns name of cached copy of file with stat.
+func cachedFileName(dir, path string, stat *types.ContainerPathStat) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%d-%d", pathHash(path), stat.Mtime.UnixNano(), stat.Size))
+}
+
+// readCachedFile returns cached content of path, if it's still the same as in container.
+func (m *Mng) readCachedFile(path string, stat *types.ContainerPathStat) ([]byte, bool) {
+	if !m.opts.FileCache {
+		return nil, false
+	}
+	dir, err := fileCacheDir(m.id)
+	if err != nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(cachedFileName(dir, path, stat))
+	if err != nil || int64(len(data)) != stat.Size {
+		return nil, false
+	}
+	log.Printf("[trace] Content of %q is read from cache", path)
+	if m.opts.MaxCacheSize > 0 {
+		// recently used copies are pruned last
+		now := time.Now()
+		os.Chtimes(cachedFileName(dir, path, stat), now, now)
+	}
+	return data, true
+}
+
+// cacheFile stores content of path, replacing its outdated copies.
+func (m *Mng) cacheFile(path string, stat *types.ContainerPathStat, data []byte) {
+	if !m.opts.FileCache {
+		return
+	}
+	dir, err := fileCacheDir(m.id)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		log.Printf("[warning] Cannot cache content of %q: %v", path, err)
+		return
+	}
+	m.uncacheFile(path)
+	name := cachedFileName(dir, path, stat)
+	// written aside and moved, so a partial copy is never read
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		log.Printf("[warning] Cannot cache content of %q: %v", path, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("[warning] Cannot cache content of %q: %v", path, err)
+	}
+}
+
+// uncacheFile removes all cached copies of path.
+func (m *Mng) uncacheFile(path string) {
+	if !m.opts.FileCache {
+		return
+	}
+	dir, err := fileCacheDir(m.id)
+	if err != nil {
+		return
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, pathHash(path)+"-*"))
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
+
+// pruneCache removes least recently modified files of the cache directory,
+// of all containers alike, until its size fits into max.
+func pruneCache(max int64) {
+	dir, err := cacheDir()
+	if err != nil {
+		return
+	}
+	type cached struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var files []cached
+	var total int64
+	users := filepath.Join(dir, "users")
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if path == users {
+			// files of processes holding caches, see holdCache
+			return filepath.SkipDir
+		}
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, cached{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		// unreadable directories are skipped
+		return nil
+	})
+	if total <= max {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		if total <= max {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("[warning] Cannot prune cache: %v", err)
+			continue
+		}
+		log.Printf("[debug] Pruned %q of %d bytes from cache", f.path, f.size)
+		total -= f.size
+	}
+}
+
+// Cache of a container is shared by all its mounts. Each mount process holds
+// it with a file named by its PID in the users directory of container, so the
+// cache is removed by the last one to unmount.
+
+// Directory of processes holding cache of container.
+func cacheUsersDir(id string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "users", id), nil
+}
+
+// holdCache records cached files of container to be removed on unmount, and
+// marks them used by this process.
+func (m *Mng) holdCache() {
+	if m.opts.KeepCache || m.opts.NoCache {
+		return
+	}
+	users, err := cacheUsersDir(m.id)
+	if err == nil {
+		err = os.MkdirAll(users, 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(users, strconv.Itoa(os.Getpid())), nil, 0600)
+	}
+	if err != nil {
+		log.Printf("[warning] Cannot hold cache of container, it'll be kept on unmount: %v", err)
+		return
+	}
+	files, _ := fileCacheDir(m.id)
+	m.cachePaths = []string{files, users}
+}
+
+// RemoveCache removes cached files of container, unless
+// Options.KeepCache is set or another process still mounts the container.
+func (m *Mng) RemoveCache() {
+	if m.cachePaths == nil {
+		return
+	}
+	users := m.cachePaths[len(m.cachePaths)-1]
+	os.Remove(filepath.Join(users, strconv.Itoa(os.Getpid())))
+	if pids := cacheUsers(users); len(pids) > 0 {
+		log.Printf("[debug] Cache of container is kept, it's still used by processes %v", pids)
+		m.cachePaths = nil
+		return
+	}
+	for _, path := range m.cachePaths {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("[warning] Cannot remove cache of container: %v", err)
+		}
+	}
+	m.cachePaths = nil
+}
+
+// cacheUsers returns PIDs of running processes holding cache in users
+// directory. Files of processes gone, e.g. crashed, are removed.
+func cacheUsers(users string) []int {
+	names, _ := ioutil.ReadDir(users)
+	var pids []int
+	for _, info := range names {
+		pid, err := strconv.Atoi(info.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+			pids = append(pids, pid)
+			continue
+		}
+		os.Remove(filepath.Join(users, info.Name()))
+	}
+	return pids
+}
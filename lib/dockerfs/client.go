@@ -0,0 +1,162 @@
+package dockerfs
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"golang.org/x/time/rate"
+)
+
+// ClientFactory creates docker clients sharing the same connection settings.
+// The client is created once and reused, so are its connections.
+type ClientFactory struct {
+	// Docker daemon address, DOCKER_HOST is used if empty. It may be any docker
+	// host URL (unix:///path, tcp://host:port, ssh://user@host) or a plain path
+	// to a unix socket, e.g. the socket of a Docker-in-Docker daemon shared from
+	// a sibling container.
+	Host string
+	// Path to docker unix socket, used if Host is empty
+	Socket string
+	// Docker API version, DOCKER_API_VERSION or negotiated with daemon if empty
+	APIVersion string
+
+	// Use TLS and verify the daemon certificate
+	TLSVerify bool
+	// CA certificate, client certificate and key to talk TLS to the daemon.
+	// Missing ones are looked up as ca.pem, cert.pem and key.pem
+	// in DOCKER_CERT_PATH or ~/.docker, but only if TLS is requested.
+	// Explicit CA certificate implies TLSVerify.
+	TLSCACert, TLSCert, TLSKey string
+
+	// Limit of a docker API request of container FS, 0 means none. Streamed
+	// content fails once no data comes for this long.
+	Timeout time.Duration
+	// Limit of bytes per second downloaded by all containers of the factory,
+	// i.e. read from their exports and archives, 0 means none
+	MaxDownloadRate int64
+
+	client  *client.Client
+	limiter *rate.Limiter
+	mutex   sync.Mutex
+}
+
+// downloadLimiter returns limiter of MaxDownloadRate shared by clients of the
+// factory, or nil if there is no limit.
+func (f *ClientFactory) downloadLimiter() *rate.Limiter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.MaxDownloadRate <= 0 {
+		return nil
+	}
+	if f.limiter == nil {
+		// a second worth of data at once at most
+		f.limiter = rate.NewLimiter(rate.Limit(f.MaxDownloadRate), int(f.MaxDownloadRate))
+	}
+	return f.limiter
+}
+
+// Client returns docker client configured from environment (DOCKER_HOST etc.)
+// and overridden by the factory settings.
+func (f *ClientFactory) Client() (*client.Client, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.client != nil {
+		return f.client, nil
+	}
+
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if f.TLSVerify || f.TLSCACert != "" || f.TLSCert != "" || f.TLSKey != "" {
+		tlsc, err := tlsconfig.Client(f.tlsOptions())
+		if err != nil {
+			return nil, err
+		}
+		// before host, its transport settings are applied on top
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsc},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	host := f.Host
+	if host == "" && f.Socket != "" {
+		host = "unix://" + f.Socket
+	}
+	if host == "" {
+		// applied by FromEnv to the default HTTP client only
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = rootlessSocket()
+	}
+	if host != "" {
+		if strings.HasPrefix(host, "/") {
+			host = "unix://" + host
+		}
+		opts = append(opts, client.WithHost(host))
+		if strings.HasPrefix(host, "ssh://") {
+			dialer, err := sshDialer(host)
+			if err != nil {
+				return nil, err
+			}
+			// after host, which sets up the transport for its protocol
+			opts = append(opts, client.WithDialContext(dialer))
+		}
+	}
+	if f.APIVersion != "" {
+		opts = append(opts, client.WithVersion(f.APIVersion))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	f.client = cli
+	return cli, nil
+}
+
+func (f *ClientFactory) tlsOptions() tlsconfig.Options {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			certPath = filepath.Join(home, ".docker")
+		}
+	}
+	// explicit path or the default one, if the file exists
+	file := func(path, name string) string {
+		if path != "" || certPath == "" {
+			return path
+		}
+		path = filepath.Join(certPath, name)
+		if _, err := os.Stat(path); err != nil {
+			return ""
+		}
+		return path
+	}
+	return tlsconfig.Options{
+		CAFile:             file(f.TLSCACert, "ca.pem"),
+		CertFile:           file(f.TLSCert, "cert.pem"),
+		KeyFile:            file(f.TLSKey, "key.pem"),
+		InsecureSkipVerify: !f.TLSVerify && f.TLSCACert == "",
+	}
+}
+
+// rootlessSocket returns socket of rootless docker daemon, if there is no
+// system-wide one.
+func rootlessSocket() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return ""
+	}
+	if _, err := os.Stat(strings.TrimPrefix(client.DefaultDockerHost, "unix://")); err == nil {
+		return ""
+	}
+	path := filepath.Join(runtimeDir, "docker.sock")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return "unix://" + path
+}
@@ -0,0 +1,251 @@
+package dockerfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/plesk/docker-fs/lib/log"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var _ = (fs.NodeGetattrer)((*Containers)(nil))
+var _ = (fs.NodeLookuper)((*Containers)(nil))
+var _ = (fs.NodeReaddirer)((*Containers)(nil))
+
+// Containers is a root directory listing all containers, stopped ones
+// included. Every container is a subdirectory named after it, its content is
+// fetched on first lookup.
+type Containers struct {
+	fs.Inode
+
+	clients *ClientFactory
+	opts    Options
+
+	// numbers of container directories, tables of containers are its siblings
+	inodes *Ino
+
+	// managers of looked up containers, by container ID
+	mngs  map[string]*Mng
+	mutex sync.Mutex
+	// initializations of managers, content of each container is fetched once
+	inits singleflight.Group
+
+	// containers by name, listed within listInterval are used again
+	listed       map[string]types.Container
+	listedAt     time.Time
+	listInterval time.Duration
+	listMutex    sync.Mutex
+
+	// makes docker API of container, the one of no container for empty ID
+	newDocker func(id string) (dockerMng, error)
+}
+
+// NewContainers creates root of all containers. Each container gets its own
+// Mng with opts, docker clients are made by clients factory.
+func NewContainers(clients *ClientFactory, opts Options) *Containers {
+	if clients == nil {
+		clients = &ClientFactory{}
+	}
+	interval := opts.ChangesInterval
+	if interval == 0 {
+		interval = DefaultChangesInterval
+	}
+	return &Containers{
+		clients:      clients,
+		opts:         opts,
+		inodes:       NewIno(),
+		mngs:         make(map[string]*Mng),
+		listInterval: interval,
+		newDocker: func(id string) (dockerMng, error) {
+			cli, err := clients.Client()
+			if err != nil {
+				return nil, err
+			}
+			return NewDockerMng(cli, id, clients.Timeout, clients.downloadLimiter()), nil
+		},
+	}
+}
+
+func (c *Containers) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	c.setAttr(&out.Attr)
+	return 0
+}
+
+func (c *Containers) setAttr(out *fuse.Attr) {
+	out.Mode = 0755
+	out.Owner.Uid, out.Owner.Gid = c.opts.owner()
+}
+
+// list returns containers by name, stopped ones included. Containers are
+// listed again once the FS changes interval passes, so lookups of every
+// entry of a listing don't ask docker each.
+func (c *Containers) list(ctx context.Context) (map[string]types.Container, error) {
+	c.listMutex.Lock()
+	defer c.listMutex.Unlock()
+	if c.listed != nil && time.Since(c.listedAt) < c.listInterval {
+		return c.listed, nil
+	}
+	docker, err := c.newDocker("")
+	if err != nil {
+		return nil, err
+	}
+	list, err := docker.ContainersList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]types.Container, len(list))
+	for _, ct := range list {
+		result[containerName(ct)] = ct
+	}
+	c.listed, c.listedAt = result, time.Now()
+	return result, nil
+}
+
+// Name of container directory, its first name or ID if it has none.
+func containerName(ct types.Container) string {
+	if len(ct.Names) == 0 {
+		return ct.ID
+	}
+	return strings.TrimPrefix(ct.Names[0], "/")
+}
+
+func (c *Containers) Readdir(ctx context.Context) (ds fs.DirStream, syserr syscall.Errno) {
+	defer log.Printf("[debug] Containers Readdir(): %v", syserr)
+	list, err := c.list(ctx)
+	if err != nil {
+		log.Printf("[error] Failed to list containers: %v", err)
+		return nil, syscall.EIO
+	}
+	entries := make([]fuse.DirEntry, 0, len(list))
+	for name, ct := range list {
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: fuse.S_IFDIR,
+			Ino:  c.inodes.Inode(ct.ID),
+		})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (c *Containers) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (node *fs.Inode, syserr syscall.Errno) {
+	defer log.Printf("[debug] Containers Lookup(%s): %v", name, syserr)
+	list, err := c.list(ctx)
+	if err != nil {
+		log.Printf("[error] Failed to list containers: %v", err)
+		return nil, syscall.EIO
+	}
+	ct, ok := list[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	mng, err := c.mng(ct.ID)
+	if err != nil {
+		log.Printf("[error] Failed to fetch content of container %q: %v", name, err)
+		return nil, syscall.EIO
+	}
+	mng.setDirAttr(&out.Attr, 0)
+	return c.NewInode(ctx, mng.Root(), fs.StableAttr{Mode: fuse.S_IFDIR, Ino: c.inodes.Inode(ct.ID)}), 0
+}
+
+// lookedUp returns manager of container, if it's initialized.
+func (c *Containers) lookedUp(id string) (*Mng, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	mng, ok := c.mngs[id]
+	return mng, ok
+}
+
+// mng returns manager of container, initializing it on first use.
+func (c *Containers) mng(id string) (*Mng, error) {
+	if mng, ok := c.lookedUp(id); ok {
+		return mng, nil
+	}
+	// lookups wait for content of the same container being fetched only
+	v, err, _ := c.inits.Do(id, func() (interface{}, error) {
+		if mng, ok := c.lookedUp(id); ok {
+			// initialized since the check above
+			return mng, nil
+		}
+		docker, err := c.newDocker(id)
+		if err != nil {
+			return nil, err
+		}
+		mng := NewMng(id, c.clients, c.opts)
+		mng.docker = docker
+		mng.inodes = c.inodes.Sibling(id)
+		if err := mng.Init(); err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		c.mngs[id] = mng
+		c.mutex.Unlock()
+		return mng, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Mng), nil
+}
+
+// all returns managers of looked up containers.
+func (c *Containers) all() []*Mng {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	mngs := make([]*Mng, 0, len(c.mngs))
+	for _, mng := range c.mngs {
+		mngs = append(mngs, mng)
+	}
+	return mngs
+}
+
+// Close stops background work of all containers.
+func (c *Containers) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, mng := range c.mngs {
+		mng.Close()
+	}
+}
+
+// Refresh lists containers and fetches content of all looked up ones again.
+func (c *Containers) Refresh(ctx context.Context) error {
+	c.listMutex.Lock()
+	c.listed = nil
+	c.listMutex.Unlock()
+	var failed []string
+	for _, mng := range c.all() {
+		if err := mng.Refresh(ctx); err != nil {
+			failed = append(failed, fmt.Sprintf("%.12s: %v", mng.id, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("refresh failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Sync saves deferred changes of all containers.
+func (c *Containers) Sync() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, mng := range c.mngs {
+		mng.Sync()
+	}
+}
+
+// RemoveCache removes cache of all looked up containers, see Mng.RemoveCache.
+func (c *Containers) RemoveCache() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, mng := range c.mngs {
+		mng.RemoveCache()
+	}
+}
@@ -0,0 +1,157 @@
+package dockerfs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestContainers(t *testing.T) {
+	daemon := newFakeDocker()
+	daemon.containers = []types.Container{
+		{ID: "1111", Names: []string{"/web"}},
+		{ID: "2222", Names: []string{"/db"}},
+	}
+	fakes := map[string]*fakeDocker{
+		"":     daemon,
+		"1111": newFakeDocker().addFile("/etc/hostname", "web\n"),
+		"2222": newFakeDocker().addFile("/etc/hostname", "db\n"),
+	}
+	root := NewContainers(nil, Options{})
+	root.newDocker = func(id string) (dockerMng, error) {
+		return fakes[id], nil
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+
+	ds, errno := root.Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir() = %v", errno)
+	}
+	var names []string
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		if e.Mode != fuse.S_IFDIR {
+			t.Errorf("%s: mode %o, expected directory", e.Name, e.Mode)
+		}
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "db" || names[1] != "web" {
+		t.Errorf("Readdir() = %v, expected [db web]", names)
+	}
+	if fakes["1111"].count("ContainerExport") != 0 {
+		t.Errorf("container exported by listing")
+	}
+
+	// content of each container is its own, with distinct inode numbers
+	inos := map[uint64]bool{}
+	for _, name := range names {
+		node, errno := root.Lookup(ctx, name, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%s) = %v", name, errno)
+		}
+		inos[node.StableAttr().Ino] = true
+		etc := lookupDir(t, node.Operations().(*Dir), "etc")
+		inos[etc.StableAttr().Ino] = true
+		file, errno := etc.Lookup(ctx, "hostname", &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%s/etc/hostname) = %v", name, errno)
+		}
+		inos[file.StableAttr().Ino] = true
+		f := file.Operations().(*File)
+		f.Open(ctx, syscall.O_RDONLY)
+		res, _ := f.Read(ctx, nil, make([]byte, 100), 0)
+		data, _ := res.Bytes(nil)
+		f.Release(ctx, nil)
+		if string(data) != name+"\n" {
+			t.Errorf("%s/etc/hostname = %q", name, data)
+		}
+	}
+	if len(inos) != 6 {
+		t.Errorf("%d distinct inode numbers of 6 nodes", len(inos))
+	}
+
+	// content is fetched once
+	if _, errno := root.Lookup(ctx, "web", &fuse.EntryOut{}); errno != 0 {
+		t.Fatalf("Lookup(web) = %v", errno)
+	}
+	if n := fakes["1111"].count("ContainerExport"); n != 1 {
+		t.Errorf("ContainerExport called %d times, expected 1", n)
+	}
+
+	if _, errno := root.Lookup(ctx, "gone", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("Lookup(gone) = %v, expected ENOENT", errno)
+	}
+}
+
+func TestContainersConcurrentLookups(t *testing.T) {
+	daemon := newFakeDocker()
+	daemon.containers = []types.Container{
+		{ID: "1111", Names: []string{"/web"}},
+		{ID: "2222", Names: []string{"/db"}},
+	}
+	fakes := map[string]*fakeDocker{
+		"":     daemon,
+		"1111": newFakeDocker().addFile("/etc/hostname", "web\n"),
+		"2222": newFakeDocker().addFile("/etc/hostname", "db\n"),
+	}
+	gate := make(chan struct{})
+	root := NewContainers(nil, Options{ChangesInterval: time.Hour})
+	root.newDocker = func(id string) (dockerMng, error) {
+		if id == "1111" {
+			<-gate
+		}
+		return fakes[id], nil
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+
+	// web is being fetched meanwhile
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, errno := root.Lookup(ctx, "web", &fuse.EntryOut{}); errno != 0 {
+				t.Errorf("Lookup(web) = %v", errno)
+			}
+		}()
+	}
+	done := make(chan syscall.Errno)
+	go func() {
+		_, errno := root.Lookup(ctx, "db", &fuse.EntryOut{})
+		done <- errno
+	}()
+	select {
+	case errno := <-done:
+		if errno != 0 {
+			t.Errorf("Lookup(db) = %v", errno)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Lookup(db) waits for another container")
+	}
+	close(gate)
+	wg.Wait()
+
+	if n := fakes["1111"].count("ContainerExport"); n != 1 {
+		t.Errorf("ContainerExport called %d times, expected 1", n)
+	}
+	if n := daemon.count("ContainersList"); n != 1 {
+		t.Errorf("ContainersList called %d times within interval, expected 1", n)
+	}
+	if err := root.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	root.Lookup(ctx, "db", &fuse.EntryOut{})
+	if n := daemon.count("ContainersList"); n != 2 {
+		t.Errorf("ContainersList called %d times after refresh, expected 2", n)
+	}
+}
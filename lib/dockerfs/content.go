@@ -0,0 +1,21 @@
+package dockerfs
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DetectContentType guesses MIME type of file content by its first 512 bytes
+// and reports whether it's binary, i.e. not safe to print to a terminal.
+func DetectContentType(data []byte) (mimeType string, binary bool) {
+	mimeType = http.DetectContentType(data)
+	if strings.HasPrefix(mimeType, "text/") {
+		return mimeType, false
+	}
+	for _, textual := range []string{"json", "xml", "javascript"} {
+		if strings.Contains(mimeType, textual) {
+			return mimeType, false
+		}
+	}
+	return mimeType, true
+}
@@ -1,11 +1,14 @@
 package dockerfs
 
 import (
+	"archive/tar"
 	"context"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/plesk/docker-fs/lib/log"
@@ -18,55 +21,131 @@ var _ = (fs.NodeGetattrer)((*Dir)(nil))
 var _ = (fs.NodeLookuper)((*Dir)(nil))
 var _ = (fs.NodeReaddirer)((*Dir)(nil))
 var _ = (fs.NodeCreater)((*Dir)(nil))
+var _ = (fs.NodeUnlinker)((*Dir)(nil))
+var _ = (fs.NodeMkdirer)((*Dir)(nil))
+var _ = (fs.NodeRmdirer)((*Dir)(nil))
+var _ = (fs.NodeRenamer)((*Dir)(nil))
+var _ = (fs.NodeSymlinker)((*Dir)(nil))
+var _ = (fs.NodeSetattrer)((*Dir)(nil))
+var _ = (fs.NodeStatfser)((*Dir)(nil))
+
+// renameat2() flag, not defined by go-fuse
+const renameNoReplace = 0x1
+
+// Block size and free space Statfs reports. Free space of container layer
+// isn't known, so plenty of it is reported, like FUSE FS of object
+// storages do, for file managers not to refuse copying to the mount.
+const (
+	statfsBlockSize  = 4096
+	statfsFreeBlocks = 1 << 38 // 1PB
+	statfsFreeFiles  = 1 << 32
+)
 
 type Dir struct {
 	fs.Inode
 	mng *Mng
 
 	fullpath string
+	// permissions and special bits, 0755 if unknown
+	mode     os.FileMode
+	modeLock sync.Mutex
 }
 
 func (d *Dir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) (err syscall.Errno) {
 	defer log.Printf("[debug] Dir (%s) Getattr(): %v", d.fullpath, err)
-	out.Owner.Uid = d.mng.uid
-	out.Owner.Gid = d.mng.gid
-	out.Mode = 0755
+	d.modeLock.Lock()
+	defer d.modeLock.Unlock()
+	d.mng.setDirAttr(&out.Attr, d.mode)
+	return 0
+}
+
+// Statfs reports size and number of exported files as used, so `df` shows
+// approximate usage of container FS.
+func (d *Dir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	size, files := d.mng.usage()
+	out.Bsize = statfsBlockSize
+	out.Frsize = statfsBlockSize
+	out.NameLen = 255
+	out.Blocks = uint64((size + statfsBlockSize - 1) / statfsBlockSize)
+	out.Files = uint64(files)
+	if !d.mng.readOnly {
+		out.Bfree, out.Bavail, out.Ffree = statfsFreeBlocks, statfsFreeBlocks, statfsFreeFiles
+		out.Blocks += statfsFreeBlocks
+		out.Files += statfsFreeFiles
+	}
 	return 0
 }
 
 func (d *Dir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (n *fs.Inode, syserr syscall.Errno) {
 	defer log.Printf("[debug] Dir (%s) Lookup(%s): %v", d.fullpath, name, syserr)
+	if d.fullpath == d.mng.filter.include && name == metaDirName {
+		d.mng.setDirAttr(&out.Attr, 0555)
+		ino := d.mng.inodes.Inode("/" + metaDirName)
+		return d.NewInode(ctx, &metaDir{mng: d.mng}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: ino}), 0
+	}
 	path := filepath.Join(d.fullpath, name)
-
-	attrs, err := d.mng.docker.GetPathAttrs(ctx, path)
-	if err != nil && strings.HasSuffix(err.Error(), "404") {
+	if d.mng.missing.has(path) || d.mng.filter.hides(path) {
 		return nil, syscall.ENOENT
 	}
+
+	attrs, err := d.mng.docker.GetPathAttrs(ctx, path)
 	if err != nil {
-		log.Printf("[error] Failed to get raw attrs: %v, (%T)", err, err)
-		return nil, syscall.EIO
+		errno := dockerErrno(err)
+		if errno == syscall.ENOENT {
+			d.mng.missing.add(path)
+		} else {
+			log.Printf("[error] Failed to get raw attrs: %v, (%T)", err, err)
+		}
+		return nil, errno
 	}
 	mode := attrs.Mode
 	log.Printf("[trace] (%s) Lookup(%s): mode = %o", d.fullpath, name, mode)
 
-	out.Owner.Uid, out.Owner.Gid = d.mng.uid, d.mng.gid
-
+	// same attributes as Getattr of the node reports, so kernel cache agrees with it
 	inode := d.mng.inodes.Inode(filepath.Clean(path))
 	if (mode & os.ModeSymlink) != 0 {
-		linkTarget := attrs.LinkTarget
-		return d.NewPersistentInode(ctx, &fs.MemSymlink{Data: []byte(linkTarget)}, fs.StableAttr{Mode: fuse.S_IFLNK, Ino: inode}), 0
+		linkTarget := d.mng.linkTarget(ctx, path, attrs.LinkTarget)
+		attrs.LinkTarget = linkTarget
+		attrs.Size = int64(len(linkTarget))
+		d.mng.setAttr(&out.Attr, path, &attrs)
+		return d.newInode(ctx, path, newSymlink(d.mng, path, linkTarget, &attrs), fs.StableAttr{Mode: fuse.S_IFLNK, Ino: inode}), 0
 	}
 
 	if mode.IsDir() {
-		return d.NewPersistentInode(ctx, &Dir{mng: d.mng, fullpath: path}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: inode}), 0
+		d.mng.setDirAttr(&out.Attr, mode&modeBits)
+		return d.newInode(ctx, path, &Dir{mng: d.mng, fullpath: path, mode: mode & modeBits}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: inode}), 0
 	}
 
-	return d.NewPersistentInode(ctx, &File{mng: d.mng, fullpath: path}, fs.StableAttr{Ino: inode}), 0
+	d.mng.setAttr(&out.Attr, path, &attrs)
+	if !mode.IsRegular() {
+		return d.newInode(ctx, path, &Special{mng: d.mng, fullpath: path}, fs.StableAttr{Mode: fuseType(mode), Ino: inode}), 0
+	}
+	return d.newInode(ctx, path, &File{mng: d.mng, fullpath: path, stat: &attrs, statUpdated: time.Now()}, fs.StableAttr{Ino: inode}), 0
+}
+
+// newInode creates a node released by go-fuse once the kernel forgets it
+// and registers it in the inode table, so its number stays stable meanwhile.
+func (d *Dir) newInode(ctx context.Context, path string, node fs.InodeEmbedder, attr fs.StableAttr) *fs.Inode {
+	inode := d.NewInode(ctx, node, attr)
+	d.mng.inodes.Track(filepath.Clean(path), inode)
+	return inode
 }
 
 func (d *Dir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	defer log.Printf("[debug] Dir (%s) Create(%q, flags=%o, mode=%o, ...): %v", d.fullpath, name, flags, mode, errno)
+	if d.mng.readOnly {
+		errno = syscall.EROFS
+		return
+	}
 	path := filepath.Join(d.fullpath, name)
+	unlock := d.mng.pathLocks.Lock(path)
+	defer unlock()
+	// created, but not saved to container yet
+	if d.mng.created.has(path) {
+		log.Printf("[error] File %q already exist", path)
+		errno = syscall.EEXIST
+		return
+	}
 	// check if file exist
 	_, syserr := d.Lookup(ctx, name, &fuse.EntryOut{})
 	if syserr == 0 {
@@ -81,22 +160,267 @@ func (d *Dir) Create(ctx context.Context, name string, flags uint32, mode uint32
 		return
 	}
 
+	if !d.mng.acquireHandle() {
+		log.Printf("[warning] Too many open files, cannot create %q", path)
+		errno = syscall.EMFILE
+		return
+	}
+
 	f := &File{
 		mng:      d.mng,
 		fullpath: path,
-		// Allow fsync on this file
-		write: true,
+		loaded:   true,
+		// released by kernel like opened ones
+		handles: 1,
+		writers: 1,
 		stat: &types.ContainerPathStat{
-			Mode: os.FileMode(mode),
+			Mode: fileMode(mode),
 		},
 	}
 
 	inode := d.mng.inodes.Inode(filepath.Clean(path))
 
-	node = d.NewPersistentInode(ctx, f, fs.StableAttr{Ino: inode})
+	node = d.newInode(ctx, path, f, fs.StableAttr{Ino: inode})
+	// new file is saved on flush, even if it's opened for reading
+	fh = &fileHandle{flags: flags, write: true}
+	d.mng.created.add(path)
+	d.mng.missing.remove(path)
 	return
 }
 
+// Unlink removes file with `rm` run in container, docker API has no other way
+// to do it. Until FS changes are refreshed, the file is hidden like a file
+// removed in container (see WasRemoved).
+func (d *Dir) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	defer log.Printf("[debug] Dir (%s) Unlink(%q): %v", d.fullpath, name, errno)
+	if d.mng.readOnly {
+		return syscall.EROFS
+	}
+	path := filepath.Join(d.fullpath, name)
+	unlock := d.mng.pathLocks.Lock(path)
+	defer unlock()
+	if child := d.GetChild(name); child != nil {
+		if f, ok := child.Operations().(*File); ok {
+			// write deferred content first, so it doesn't reappear later
+			f.sync()
+		}
+	}
+	if _, err := d.mng.exec(ctx, "rm", "--", path); err != nil {
+		errno = execErrno(err)
+		if errno != syscall.ENOENT || !d.mng.created.has(path) {
+			log.Printf("[error] Failed to remove %q: %v", path, err)
+			return errno
+		}
+		// still open and never saved
+	}
+	d.mng.created.remove(path)
+	d.mng.uncacheFile(path)
+	d.mng.markRemoved(path)
+	d.mng.inodes.Forget(path)
+	return 0
+}
+
+// Setattr supports changing mode only. Directory entry with the new mode is
+// copied over the existing one, as Mkdir does.
+func (d *Dir) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer log.Printf("[debug] Dir (%s) Setattr(): %v", d.fullpath, errno)
+	if mode, ok := in.GetMode(); ok {
+		if d.mng.readOnly {
+			return syscall.EROFS
+		}
+		if d.fullpath == "/" {
+			// container root can't be copied over
+			return syscall.EPERM
+		}
+		perm := fileMode(mode)
+		if err := d.mng.docker.MakeDir(ctx, d.fullpath, perm); err != nil {
+			log.Printf("[error] Failed to change mode of %q: %v", d.fullpath, err)
+			return syscall.EIO
+		}
+		d.modeLock.Lock()
+		d.mode = perm
+		d.modeLock.Unlock()
+	}
+	return d.Getattr(ctx, fh, out)
+}
+
+// Mkdir creates directory by copying an archive with it to container.
+func (d *Dir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	defer log.Printf("[debug] Dir (%s) Mkdir(%q, mode=%o): %v", d.fullpath, name, mode, errno)
+	if d.mng.readOnly {
+		return nil, syscall.EROFS
+	}
+	path := filepath.Join(d.fullpath, name)
+	unlock := d.mng.pathLocks.Lock(path)
+	defer unlock()
+	if d.mng.created.has(path) {
+		return nil, syscall.EEXIST
+	}
+	if _, errno = d.Lookup(ctx, name, &fuse.EntryOut{}); errno == 0 {
+		return nil, syscall.EEXIST
+	}
+	if errno != syscall.ENOENT {
+		return nil, errno
+	}
+
+	perm := fileMode(mode)
+	if err := d.mng.docker.MakeDir(ctx, path, perm); err != nil {
+		log.Printf("[error] Failed to create directory %q: %v", path, err)
+		return nil, syscall.EIO
+	}
+	d.mng.markAdded(path)
+	d.mng.setDirAttr(&out.Attr, perm)
+	inode := d.mng.inodes.Inode(filepath.Clean(path))
+	return d.newInode(ctx, path, &Dir{mng: d.mng, fullpath: path, mode: perm}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: inode}), 0
+}
+
+// Symlink creates link by copying an archive with it to container.
+func (d *Dir) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	defer log.Printf("[debug] Dir (%s) Symlink(%q, %q): %v", d.fullpath, target, name, errno)
+	if d.mng.readOnly {
+		return nil, syscall.EROFS
+	}
+	path := filepath.Join(d.fullpath, name)
+	unlock := d.mng.pathLocks.Lock(path)
+	defer unlock()
+	if d.mng.created.has(path) {
+		return nil, syscall.EEXIST
+	}
+	if _, errno = d.Lookup(ctx, name, &fuse.EntryOut{}); errno == 0 {
+		return nil, syscall.EEXIST
+	}
+	if errno != syscall.ENOENT {
+		return nil, errno
+	}
+
+	stat := types.ContainerPathStat{
+		Name:       name,
+		Size:       int64(len(target)),
+		Mode:       os.ModeSymlink | 0777,
+		Mtime:      time.Now(),
+		LinkTarget: target,
+	}
+	if err := d.mng.docker.SaveFile(ctx, path, nil, &stat, nil); err != nil {
+		log.Printf("[error] Failed to create symlink %q: %v", path, err)
+		return nil, syscall.EIO
+	}
+	d.mng.markAdded(path)
+	d.mng.setAttr(&out.Attr, path, &stat)
+	inode := d.mng.inodes.Inode(filepath.Clean(path))
+	return d.newInode(ctx, path, newSymlink(d.mng, path, target, &stat), fs.StableAttr{Mode: fuse.S_IFLNK, Ino: inode}), 0
+}
+
+// Rmdir removes directory with `rmdir` run in container, like Unlink does.
+func (d *Dir) Rmdir(ctx context.Context, name string) (errno syscall.Errno) {
+	defer log.Printf("[debug] Dir (%s) Rmdir(%q): %v", d.fullpath, name, errno)
+	if d.mng.readOnly {
+		return syscall.EROFS
+	}
+	path := filepath.Join(d.fullpath, name)
+	unlock := d.mng.pathLocks.Lock(path)
+	defer unlock()
+	if _, err := d.mng.exec(ctx, "rmdir", "--", path); err != nil {
+		log.Printf("[error] Failed to remove directory %q: %v", path, err)
+		return execErrno(err)
+	}
+	d.mng.markRemoved(path)
+	d.mng.inodes.Forget(path)
+	return 0
+}
+
+// Rename copies file to the new path and removes the old one, the same way
+// Unlink does. Directories aren't moved, EXDEV makes tools like mv copy
+// them recursively.
+func (d *Dir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	defer log.Printf("[debug] Dir (%s) Rename(%q, %q, flags=%x): %v", d.fullpath, name, newName, flags, errno)
+	if d.mng.readOnly {
+		return syscall.EROFS
+	}
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+	newDir, ok := newParent.(*Dir)
+	if !ok {
+		return syscall.EXDEV
+	}
+	oldPath := filepath.Join(d.fullpath, name)
+	newPath := filepath.Join(newDir.fullpath, newName)
+	unlock := d.mng.pathLocks.LockPair(oldPath, newPath)
+	defer unlock()
+
+	var f *File
+	var link *Symlink
+	if child := d.GetChild(name); child != nil {
+		if f, ok = child.Operations().(*File); ok {
+			// write deferred content first, it's copied from container
+			f.sync()
+		}
+		link, _ = child.Operations().(*Symlink)
+	}
+	stat, err := d.mng.docker.GetPathAttrs(ctx, oldPath)
+	if err != nil {
+		errno := dockerErrno(err)
+		if errno != syscall.ENOENT {
+			log.Printf("[error] Failed to get raw attrs of %q: %v", oldPath, err)
+		}
+		return errno
+	}
+	if stat.Mode.IsDir() {
+		return syscall.EXDEV
+	}
+	if target, err := d.mng.docker.GetPathAttrs(ctx, newPath); err == nil {
+		if flags&renameNoReplace != 0 {
+			return syscall.EEXIST
+		}
+		if target.Mode.IsDir() {
+			return syscall.EISDIR
+		}
+	}
+
+	var hdr *tar.Header
+	var data []byte
+	if stat.Mode.IsRegular() {
+		if hdr, data, err = getFile(ctx, d.mng.docker, oldPath); err != nil {
+			log.Printf("[error] Failed to get content of %q: %v", oldPath, err)
+			return syscall.EIO
+		}
+	} else {
+		if hdr, err = getHeader(ctx, d.mng.docker, oldPath); err != nil {
+			log.Printf("[error] Failed to read %q: %v", oldPath, err)
+			return syscall.EIO
+		}
+		if stat.Mode&os.ModeSymlink != 0 {
+			stat.LinkTarget = hdr.Linkname
+		}
+	}
+	// mode, mtime, owner and link target are kept
+	owner := &fileOwner{uid: hdr.Uid, gid: hdr.Gid}
+	if err := d.mng.docker.SaveFile(ctx, newPath, data, &stat, owner); err != nil {
+		log.Printf("[error] Failed to save %q: %v", newPath, err)
+		return syscall.EIO
+	}
+	if _, err := d.mng.exec(ctx, "rm", "--", oldPath); err != nil {
+		log.Printf("[error] Failed to remove %q, it's copied to %q: %v", oldPath, newPath, err)
+		return execErrno(err)
+	}
+	d.mng.uncacheFile(oldPath)
+	d.mng.uncacheFile(newPath)
+	d.mng.markRemoved(oldPath)
+	d.mng.markAdded(newPath)
+	d.mng.inodes.Rename(oldPath, newPath)
+	if f != nil {
+		f.mu.Lock()
+		f.fullpath = newPath
+		f.mu.Unlock()
+	}
+	if link != nil {
+		link.mu.Lock()
+		link.fullpath = newPath
+		link.mu.Unlock()
+	}
+	return 0
+}
+
 func (d *Dir) Readdir(ctx context.Context) (ds fs.DirStream, syserr syscall.Errno) {
 	defer log.Printf("[debug] Dir (%s) Readdir(): %v", d.fullpath, syserr)
 	children := make(map[string]uint32)
@@ -111,53 +435,58 @@ func (d *Dir) Readdir(ctx context.Context) (ds fs.DirStream, syserr syscall.Errn
 		return nil, syscall.EIO
 	}
 
-	// check static files and removed ones
-	for name, mode := range d.mng.staticFiles {
-		if !strings.HasPrefix(name, path) {
-			continue
+	static := d.mng.staticChildren(d.fullpath)
+	if d.mng.onVolume(d.fullpath) {
+		// volume content isn't exported, what the export has here is hidden by it
+		if static, err = d.mng.volumeChildren(ctx, d.fullpath); err != nil {
+			log.Printf("[error] Cannot list volume content of %q: %v", d.fullpath, err)
+			return nil, dockerErrno(err)
 		}
-		// Check if file is removed
-		if WasRemoved(name, changes) {
+	}
+	for _, name := range d.mng.volumesIn(d.fullpath) {
+		children[name] = fuse.S_IFDIR
+	}
+
+	// check static files and removed ones
+	for name, mode := range static {
+		if WasRemoved(filepath.Join(d.fullpath, name), changes) {
 			continue
 		}
-		sub := name[len(path):]
-		pos := strings.Index(sub, "/")
-		if pos > 0 {
-			log.Printf("[trace] Readdir (1): children[%v] = %o", sub[:pos], fuse.S_IFDIR)
-			children[sub[:pos]] = fuse.S_IFDIR
-		} else if pos < 0 {
-			log.Printf("[trace] Readdir (2): children[%v] = %o", sub, uint32(mode))
-			if (mode & fuse.S_IFLNK) == fuse.S_IFLNK {
-				children[sub] = fuse.S_IFLNK
-			} else {
-				children[sub] = fuse.S_IFREG
-			}
-		}
+		log.Printf("[trace] Readdir (1): children[%v] = %o", name, uint32(mode))
+		children[name] = fuseType(mode)
 	}
 
-	// check added files
+	// check added and modified files, stated by several requests at once
+	var added []string
 	for _, ch := range changes {
-		if ch.Kind != FileAdded {
+		if ch.Kind == FileRemoved {
 			continue
 		}
-		stat, err := d.mng.docker.GetPathAttrs(ctx, ch.Path)
-		if err != nil {
-			if err != nil && strings.HasSuffix(err.Error(), "404") {
-				log.Printf("[error] Failed to get raw attrs of %q: %v", ch.Path, err)
-			}
+		// a file added deeper lists its top directory, like static files do
+		if pos := strings.Index(ch.Path[len(path):], "/"); pos > 0 {
+			sub := ch.Path[len(path):][:pos]
+			log.Printf("[trace] Readdir (2): children[%v] = %o", sub, fuse.S_IFDIR)
+			children[sub] = fuse.S_IFDIR
 			continue
 		}
-		mode := uint32(stat.Mode)
-		log.Printf("[trace] Readdir (3): childred[%v] = %o", filepath.Base(ch.Path), mode)
-		fuseMode := uint32(fuse.S_IFREG)
-		if os.FileMode(mode).IsDir() {
-			fuseMode = fuse.S_IFDIR
-		}
-		children[filepath.Base(ch.Path)] = fuseMode
+		added = append(added, ch.Path)
+	}
+	for p, mode := range d.statPaths(ctx, added) {
+		log.Printf("[trace] Readdir (3): children[%v] = %o", filepath.Base(p), uint32(mode))
+		children[filepath.Base(p)] = fuseType(mode)
+	}
+
+	if d.fullpath == d.mng.filter.include {
+		// served instead of the container directory, see metadata.go
+		children[metaDirName] = fuse.S_IFDIR
 	}
 
 	var list []fuse.DirEntry
 	for child, mode := range children {
+		if d.mng.filter.hides(filepath.Join(d.fullpath, child)) {
+			// added or modified in container since export
+			continue
+		}
 		inode := d.mng.inodes.Inode(filepath.Clean(filepath.Join(d.fullpath, child)))
 		list = append(list, fuse.DirEntry{
 			Mode: mode,
@@ -167,3 +496,63 @@ func (d *Dir) Readdir(ctx context.Context) (ds fs.DirStream, syserr syscall.Errn
 	}
 	return fs.NewListDirStream(list), 0
 }
+
+// Number of stats made at once while listing a directory.
+const readdirStatWorkers = 8
+
+// statPaths returns modes of paths, stating each one once. Paths which are
+// gone (or fail to stat) are left out.
+func (d *Dir) statPaths(ctx context.Context, paths []string) map[string]os.FileMode {
+	modes := make(map[string]os.FileMode)
+	queue := make(chan string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < readdirStatWorkers && i < len(paths); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				stat, err := d.mng.docker.GetPathAttrs(ctx, p)
+				if err != nil {
+					if dockerErrno(err) != syscall.ENOENT {
+						log.Printf("[error] Failed to get raw attrs of %q: %v", p, err)
+					}
+					continue
+				}
+				mutex.Lock()
+				modes[p] = stat.Mode
+				mutex.Unlock()
+			}
+		}()
+	}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		if !seen[p] {
+			seen[p] = true
+			queue <- p
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return modes
+}
+
+// fuseType returns type of file for directory listing. Symlinks are listed as
+// links (even if they point to directories), the kernel resolves them itself.
+func fuseType(mode os.FileMode) uint32 {
+	switch {
+	case mode.IsDir():
+		return fuse.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		return fuse.S_IFLNK
+	case mode&os.ModeCharDevice != 0:
+		return syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		return syscall.S_IFBLK
+	case mode&os.ModeNamedPipe != 0:
+		return syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		return syscall.S_IFSOCK
+	}
+	return fuse.S_IFREG
+}
@@ -0,0 +1,659 @@
+package dockerfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestReaddirSymlinkToDir(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/usr/lib/libc.so", "ELF").
+		addSymlink("/lib", "/usr/lib")
+	_, root := newTestMng(t, fake, Options{})
+
+	if mode, ok := readdir(t, root)["lib"]; !ok || mode != fuse.S_IFLNK {
+		t.Errorf("/lib listed with mode %o, expected symlink", mode)
+	}
+
+	node, errno := root.Lookup(context.Background(), "lib", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup(lib) = %v", errno)
+	}
+	link, ok := node.Operations().(fs.NodeReadlinker)
+	if !ok {
+		t.Fatalf("/lib is %T, expected symlink", node.Operations())
+	}
+	if target, errno := link.Readlink(context.Background()); errno != 0 || string(target) != "/usr/lib" {
+		t.Errorf("Readlink(/lib) = %q, %v, expected /usr/lib", target, errno)
+	}
+
+	if _, ok := readdir(t, lookupDir(t, root, "usr", "lib"))["libc.so"]; !ok {
+		t.Errorf("libc.so is not listed in the link target")
+	}
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	fake := newFakeDocker().addDir("/tmp")
+	_, root := newTestMng(t, fake, Options{})
+	dir := lookupDir(t, root, "tmp")
+
+	const n = 50
+	results := make(chan syscall.Errno, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, errno := dir.Create(context.Background(), "lock", syscall.O_WRONLY|syscall.O_EXCL, 0644, &fuse.EntryOut{})
+			results <- errno
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	created := 0
+	for errno := range results {
+		switch errno {
+		case 0:
+			created++
+		case syscall.EEXIST:
+		default:
+			t.Errorf("Create() = %v, expected success or EEXIST", errno)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d creates succeeded, expected exactly one", created)
+	}
+}
+
+func TestLookupAttrsMatchGetattr(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/hosts", "127.0.0.1 localhost\n").addSymlink("/etc/localtime", "/usr/share/zoneinfo/UTC")
+	mng, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	etc := lookupDir(t, root, "etc")
+
+	for _, name := range []string{"hosts", "localtime"} {
+		var entry fuse.EntryOut
+		node, errno := etc.Lookup(ctx, name, &entry)
+		if errno != 0 {
+			t.Fatalf("Lookup(%s) = %v", name, errno)
+		}
+		var attr fuse.AttrOut
+		if errno := node.Operations().(fs.NodeGetattrer).Getattr(ctx, nil, &attr); errno != 0 {
+			t.Fatalf("Getattr(%s) = %v", name, errno)
+		}
+		if entry.Attr != attr.Attr {
+			t.Errorf("%s: Lookup attrs %+v differ from Getattr %+v", name, entry.Attr, attr.Attr)
+		}
+		if entry.Size == 0 || entry.Uid != mng.uid {
+			t.Errorf("%s: Lookup attrs are incomplete: %+v", name, entry.Attr)
+		}
+	}
+}
+
+func TestReaddirSymlinkChains(t *testing.T) {
+	fake := newFakeDocker()
+	const n = 100
+	for i := 0; i < n; i++ {
+		// static links form a loop, every link points to the next one
+		fake.addSymlink(fmt.Sprintf("/links/static%d", i), fmt.Sprintf("static%d", (i+1)%n))
+	}
+	_, root := newTestMng(t, fake, Options{})
+	for i := 0; i < n; i++ {
+		// added links point through the directory
+		path := fmt.Sprintf("/links/added%d", i)
+		fake.addSymlink(path, fmt.Sprintf("/links/added%d/../static%d", (i+1)%n, i))
+		fake.change(FileAdded, path)
+	}
+	dir := lookupDir(t, root, "links")
+	before := fake.count("GetPathAttrs")
+
+	entries := readdir(t, dir)
+	if len(entries) != 2*n {
+		t.Errorf("%d entries listed, expected %d", len(entries), 2*n)
+	}
+	for name, mode := range entries {
+		if mode != fuse.S_IFLNK {
+			t.Errorf("%s listed with mode %o, expected symlink", name, mode)
+		}
+	}
+	if stats := fake.count("GetPathAttrs") - before; stats != n {
+		t.Errorf("%d stats made, expected one per added link (%d)", stats, n)
+	}
+}
+
+func TestReaddirConcurrentStats(t *testing.T) {
+	fake := newFakeDocker()
+	_, root := newTestMng(t, fake, Options{})
+	const n = 40
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("/added/file%d", i)
+		fake.addFile(path, "x")
+		fake.change(FileAdded, path)
+	}
+	fake.addFile("/added/gone", "x")
+	fake.change(FileAdded, "/added/gone")
+	delete(fake.entries, "/added/gone")
+	dir := lookupDir(t, root, "added")
+	fake.statDelay = 10 * time.Millisecond
+	before := fake.count("GetPathAttrs")
+
+	entries := readdir(t, dir)
+	if len(entries) != n {
+		t.Errorf("%d entries listed, expected %d", len(entries), n)
+	}
+	if stats := fake.count("GetPathAttrs") - before; stats != n+1 {
+		t.Errorf("%d stats made, expected %d", stats, n+1)
+	}
+	if fake.maxStats < 2 || fake.maxStats > readdirStatWorkers {
+		t.Errorf("%d stats made at once, expected 2 to %d", fake.maxStats, readdirStatWorkers)
+	}
+}
+
+func TestLookupSymlinkTarget(t *testing.T) {
+	fake := newFakeDocker().addFile("/usr/lib/x", "x").
+		addSymlink("/usr/bin/rel", "../lib/x").
+		addSymlink("/usr/bin/abs", "/usr/lib/x")
+	_, root := newTestMng(t, fake, Options{})
+	dir := lookupDir(t, lookupDir(t, root, "usr"), "bin")
+
+	for name, expected := range map[string]string{"rel": "../lib/x", "abs": "/usr/lib/x"} {
+		var out fuse.EntryOut
+		node, errno := dir.Lookup(context.Background(), name, &out)
+		if errno != 0 {
+			t.Fatalf("Lookup(%s) = %v", name, errno)
+		}
+		link, ok := node.Operations().(*Symlink)
+		if !ok {
+			t.Fatalf("Lookup(%s) = %T, expected symlink", name, node.Operations())
+		}
+		// kernel resolves relative targets against the link's directory in the mount
+		if target, _ := link.Readlink(context.Background()); string(target) != expected {
+			t.Errorf("%s links to %q, expected %q", name, target, expected)
+		}
+		if out.Size != uint64(len(expected)) {
+			t.Errorf("%s size = %d, expected length of target", name, out.Size)
+		}
+	}
+	if n := fake.count("GetFile"); n != 0 {
+		t.Errorf("%d exported links read from container, expected targets from the export", n)
+	}
+}
+
+func TestReadlinkChanged(t *testing.T) {
+	fake := newFakeDocker().addSymlink("/etc/localtime", "/usr/share/zoneinfo/UTC")
+	_, root := newTestMng(t, fake, Options{ChangesInterval: -1})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "localtime", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup(localtime) = %v", errno)
+	}
+	link := node.Operations().(*Symlink)
+
+	// changed in container while the node is kept
+	fake.entries["/etc/localtime"].link = "../usr/share/zoneinfo/CET"
+	fake.change(FileModified, "/etc/localtime")
+	if target, errno := link.Readlink(ctx); errno != 0 || string(target) != "../usr/share/zoneinfo/CET" {
+		t.Errorf("Readlink() = %q, %v, expected the new target", target, errno)
+	}
+	var out fuse.AttrOut
+	if errno := link.Getattr(ctx, nil, &out); errno != 0 || out.Size != uint64(len("../usr/share/zoneinfo/CET")) {
+		t.Errorf("Getattr() size = %d, %v, expected length of the new target", out.Size, errno)
+	}
+
+	delete(fake.entries, "/etc/localtime")
+	if _, errno := link.Readlink(ctx); errno != syscall.ENOENT {
+		t.Errorf("Readlink() of removed link = %v, expected ENOENT", errno)
+	}
+}
+
+func TestReaddirNewSubdir(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/hosts", "localhost")
+	_, root := newTestMng(t, fake, Options{})
+	// only the file is reported, as if the directory isn't in the change set
+	fake.addFile("/newdir/newfile", "new")
+	fake.change(FileAdded, "/newdir/newfile")
+
+	if mode, ok := readdir(t, root)["newdir"]; !ok || mode != fuse.S_IFDIR {
+		t.Errorf("/newdir listed with mode %o (listed: %v), expected directory", mode, ok)
+	}
+	if _, ok := readdir(t, lookupDir(t, root, "newdir"))["newfile"]; !ok {
+		t.Errorf("newfile is not listed in /newdir")
+	}
+}
+
+func TestReaddirModified(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/srv/data", "old").
+		addFile("/srv/log", "x")
+	_, root := newTestMng(t, fake, Options{ChangesInterval: -1})
+	// replaced with a link to a new directory in container
+	fake.addDir("/data")
+	fake.addSymlink("/srv/data", "/data")
+	fake.change(FileModified, "/srv")
+	fake.change(FileModified, "/srv/data")
+	fake.change(FileAdded, "/data")
+	dir := lookupDir(t, root, "srv")
+
+	entries := readdir(t, dir)
+	if len(entries) != 2 {
+		t.Errorf("%d entries listed, expected 2: %v", len(entries), entries)
+	}
+	if mode := entries["data"]; mode != fuse.S_IFLNK {
+		t.Errorf("modified data listed with mode %o, expected symlink", mode)
+	}
+	if mode := entries["log"]; mode != fuse.S_IFREG {
+		t.Errorf("log listed with mode %o, expected regular file", mode)
+	}
+}
+
+func TestReaddirVolume(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/var/log/messages", "boot").
+		addFile("/var/lib/data/conf", "x=1").
+		addFile("/var/lib/data/db/table", "rows").
+		addVolume("/var/lib/data")
+	_, root := newTestMng(t, fake, Options{})
+
+	if mode, ok := readdir(t, lookupDir(t, root, "var"))["lib"]; !ok || mode != fuse.S_IFDIR {
+		t.Errorf("/var/lib listed with mode %o (listed: %v), expected directory", mode, ok)
+	}
+	data := lookupDir(t, lookupDir(t, lookupDir(t, root, "var"), "lib"), "data")
+	entries := readdir(t, data)
+	if len(entries) != 2 || entries["conf"] != fuse.S_IFREG || entries["db"] != fuse.S_IFDIR {
+		t.Errorf("volume content listed as %v, expected conf file and db directory", entries)
+	}
+	if entries := readdir(t, lookupDir(t, data, "db")); len(entries) != 1 || entries["table"] != fuse.S_IFREG {
+		t.Errorf("volume subdirectory content listed as %v, expected table file", entries)
+	}
+	if n := fake.count("GetFile"); n != 0 {
+		t.Errorf("running container volume listed from %d archives, expected find", n)
+	}
+
+	// the archive of a stopped container's volume is read once until refresh
+	fake.stopped = true
+	for i := 0; i < 2; i++ {
+		if entries := readdir(t, data); len(entries) != 2 || entries["conf"] != fuse.S_IFREG || entries["db"] != fuse.S_IFDIR {
+			t.Errorf("stopped container volume content listed as %v, expected conf file and db directory", entries)
+		}
+		if entries := readdir(t, lookupDir(t, data, "db")); len(entries) != 1 || entries["table"] != fuse.S_IFREG {
+			t.Errorf("stopped container volume subdirectory listed as %v, expected table file", entries)
+		}
+	}
+	if n := fake.count("GetFile"); n != 1 {
+		t.Errorf("volume archive fetched %d times, expected once", n)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/proc/cpuinfo", "cpu").
+		addFile("/app/main.js", "main()").
+		addFile("/app/node_modules/left-pad/index.js", "pad()")
+	mng, root := newTestMng(t, fake, Options{Exclude: []string{"/proc", "/*/node_modules"}})
+	fake.addFile("/proc/meminfo", "mem")
+	fake.change(FileAdded, "/proc/meminfo")
+
+	for dir, children := range mng.staticDirs {
+		for name, mode := range children {
+			if path := filepath.Join(dir, name); !mode.IsDir() && path != "/app/main.js" {
+				t.Errorf("excluded %s is kept in static files", path)
+			}
+		}
+	}
+	if entries := readdir(t, root); len(entries) != 2 || entries["app"] != fuse.S_IFDIR {
+		t.Errorf("root listed as %v, expected app and %s only", entries, metaDirName)
+	}
+	app := lookupDir(t, root, "app")
+	if entries := readdir(t, app); len(entries) != 1 || entries["main.js"] != fuse.S_IFREG {
+		t.Errorf("/app listed as %v, expected main.js only", entries)
+	}
+	for dir, name := range map[*Dir]string{root: "proc", app: "node_modules"} {
+		if _, errno := dir.Lookup(context.Background(), name, &fuse.EntryOut{}); errno != syscall.ENOENT {
+			t.Errorf("Lookup(%s) = %v, expected ENOENT", name, errno)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/etc/hosts", "localhost").
+		addFile("/app/main.js", "main()").
+		addFile("/app/lib/util.js", "util()").
+		addFile("/app/node_modules/left-pad/index.js", "pad()")
+	mng, root := newTestMng(t, fake, Options{Include: "/app/", Exclude: []string{"/app/node_modules"}})
+
+	if root.fullpath != "/app" {
+		t.Errorf("root is %s, expected /app", root.fullpath)
+	}
+	if _, files := mng.usage(); files != 2 {
+		t.Errorf("static files are %v, expected ones of /app but node_modules", mng.staticDirs)
+	}
+	entries := readdir(t, root)
+	if len(entries) != 3 || entries["main.js"] != fuse.S_IFREG || entries["lib"] != fuse.S_IFDIR || entries[metaDirName] != fuse.S_IFDIR {
+		t.Errorf("root listed as %v, expected main.js, lib and %s", entries, metaDirName)
+	}
+
+	for _, include := range []string{"/etc/hosts", "/srv"} {
+		mng := NewMng("fake", nil, Options{Include: include})
+		mng.docker = fake
+		if err := mng.Init(); err == nil {
+			t.Errorf("Init() with %s included succeeded", include)
+		}
+	}
+}
+
+func TestNegativeLookup(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		ttl   time.Duration
+		stats int
+	}{
+		{"cached", time.Minute, 1},
+		{"disabled", 0, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeDocker().addDir("/app")
+			_, root := newTestMng(t, fake, Options{NegativeLookupTTL: tc.ttl, ChangesInterval: -1})
+			dir := lookupDir(t, root, "app")
+			before := fake.count("GetPathAttrs")
+			for i := 0; i < 3; i++ {
+				if _, errno := dir.Lookup(context.Background(), ".env", &fuse.EntryOut{}); errno != syscall.ENOENT {
+					t.Fatalf("Lookup(.env) = %v, expected ENOENT", errno)
+				}
+			}
+			if stats := fake.count("GetPathAttrs") - before; stats != tc.stats {
+				t.Errorf("%d stats made, expected %d", stats, tc.stats)
+			}
+
+			// seen once FS changes report it
+			fake.addFile("/app/.env", "DEBUG=1")
+			fake.change(FileAdded, "/app/.env")
+			readdir(t, dir)
+			if _, errno := dir.Lookup(context.Background(), ".env", &fuse.EntryOut{}); errno != 0 {
+				t.Errorf("Lookup(.env) = %v after it's added", errno)
+			}
+		})
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	for _, readOnly := range []bool{true, false} {
+		fake := newFakeDocker().
+			addFile("/bin/sh", strings.Repeat("x", 5000)).
+			addFile("/etc/hosts", "localhost")
+		_, root := newTestMng(t, fake, Options{ReadOnly: readOnly})
+
+		var out fuse.StatfsOut
+		if errno := root.Statfs(context.Background(), &out); errno != 0 {
+			t.Fatalf("Statfs() = %v", errno)
+		}
+		if out.Bsize != statfsBlockSize || out.NameLen == 0 {
+			t.Errorf("Statfs() reports block size %d, name length %d", out.Bsize, out.NameLen)
+		}
+		// two blocks for 5009 bytes
+		if used := out.Blocks - out.Bfree; used != 2 {
+			t.Errorf("read-only %v: %d blocks used, expected 2", readOnly, used)
+		}
+		if used := out.Files - out.Ffree; used != 2 {
+			t.Errorf("read-only %v: %d files used, expected 2", readOnly, used)
+		}
+		if free := out.Bavail > 0; free == readOnly {
+			t.Errorf("read-only %v: %d blocks available", readOnly, out.Bavail)
+		}
+	}
+}
+
+func readdir(t *testing.T, dir *Dir) map[string]uint32 {
+	t.Helper()
+	ds, errno := dir.Readdir(context.Background())
+	if errno != 0 {
+		t.Fatalf("Readdir(%s) = %v", dir.fullpath, errno)
+	}
+	defer ds.Close()
+	entries := make(map[string]uint32)
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Readdir(%s): Next() = %v", dir.fullpath, errno)
+		}
+		entries[e.Name] = e.Mode
+	}
+	return entries
+}
+
+func TestUnlink(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n").addFile("/etc/hostname", "fake\n")
+	_, root := newTestMng(t, fake, Options{})
+	fake.addFile("/etc/added", "new\n").change(FileAdded, "/etc/added")
+	fake.entries["/etc/added"].hidden = true
+	ctx := context.Background()
+	dir := lookupDir(t, root, "etc")
+	if entries := readdir(t, dir); len(entries) != 3 {
+		t.Fatalf("listed %v, expected 3 entries", entries)
+	}
+
+	for _, name := range []string{"motd", "added"} {
+		if errno := dir.Unlink(ctx, name); errno != 0 {
+			t.Errorf("Unlink(%q) = %v", name, errno)
+		}
+		if _, errno := dir.Lookup(ctx, name, &fuse.EntryOut{}); errno != syscall.ENOENT {
+			t.Errorf("Lookup(%q) after Unlink = %v, expected ENOENT", name, errno)
+		}
+	}
+	// FS changes are still cached, removals must be applied to them
+	if entries := readdir(t, dir); len(entries) != 1 {
+		t.Errorf("listed %v, expected only hostname", entries)
+	}
+
+	if errno := dir.Unlink(ctx, "motd"); errno != syscall.ENOENT {
+		t.Errorf("Unlink(motd) again = %v, expected ENOENT", errno)
+	}
+	if errno := root.Unlink(ctx, "etc"); errno != syscall.EISDIR {
+		t.Errorf("Unlink(etc) = %v, expected EISDIR", errno)
+	}
+}
+
+func TestMkdirRmdir(t *testing.T) {
+	fake := newFakeDocker().addFile("/srv/index.html", "hi\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	dir := lookupDir(t, root, "srv")
+	readdir(t, dir)
+
+	var out fuse.EntryOut
+	node, errno := dir.Mkdir(ctx, "data", 0700, &out)
+	if errno != 0 {
+		t.Fatalf("Mkdir() = %v", errno)
+	}
+	if out.Mode&07777 != 0700 {
+		t.Errorf("Mkdir() mode = %o, expected 0700", out.Mode&07777)
+	}
+	var attr fuse.AttrOut
+	node.Operations().(*Dir).Getattr(ctx, nil, &attr)
+	if attr.Mode&07777 != 0700 {
+		t.Errorf("Getattr() mode = %o, expected 0700", attr.Mode&07777)
+	}
+	// FS changes are still cached, the new directory must be listed anyway
+	if mode, ok := readdir(t, dir)["data"]; !ok || mode != fuse.S_IFDIR {
+		t.Errorf("data is not listed as directory")
+	}
+	if _, errno := dir.Mkdir(ctx, "data", 0755, &fuse.EntryOut{}); errno != syscall.EEXIST {
+		t.Errorf("Mkdir() of existing directory = %v, expected EEXIST", errno)
+	}
+
+	if errno := root.Rmdir(ctx, "srv"); errno != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir(srv) = %v, expected ENOTEMPTY", errno)
+	}
+	if errno := dir.Rmdir(ctx, "data"); errno != 0 {
+		t.Fatalf("Rmdir(data) = %v", errno)
+	}
+	if _, ok := readdir(t, dir)["data"]; ok {
+		t.Errorf("data is listed after Rmdir")
+	}
+	if _, errno := dir.Lookup(ctx, "data", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("Lookup(data) after Rmdir = %v, expected ENOENT", errno)
+	}
+}
+
+func TestRename(t *testing.T) {
+	fake := newFakeDocker().addFile("/src/secret", "key\n").addSymlink("/src/link", "secret").addFile("/dst/other", "x")
+	fake.entries["/src/secret"].mode = 0600
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	src, dst := lookupDir(t, root, "src"), lookupDir(t, root, "dst")
+	readdir(t, src)
+	readdir(t, dst)
+	node, errno := src.Lookup(ctx, "secret", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup(secret) = %v", errno)
+	}
+	// as go-fuse does on lookup
+	src.AddChild("secret", node, true)
+
+	if errno := src.Rename(ctx, "secret", dst, "other", renameNoReplace); errno != syscall.EEXIST {
+		t.Errorf("Rename() over existing file with RENAME_NOREPLACE = %v, expected EEXIST", errno)
+	}
+	if errno := src.Rename(ctx, "secret", dst, "moved", 0); errno != 0 {
+		t.Fatalf("Rename(secret) = %v", errno)
+	}
+	e, ok := fake.entries["/dst/moved"]
+	if !ok || string(e.data) != "key\n" || e.mode != 0600 {
+		t.Errorf("moved file = %+v, expected content and mode of the source", e)
+	}
+	if f := node.Operations().(*File); f.fullpath != "/dst/moved" {
+		t.Errorf("renamed node path = %q, expected /dst/moved", f.fullpath)
+	}
+	if _, ok := readdir(t, src)["secret"]; ok {
+		t.Errorf("secret is listed in source directory after Rename")
+	}
+	if _, ok := readdir(t, dst)["moved"]; !ok {
+		t.Errorf("moved is not listed in target directory after Rename")
+	}
+
+	if errno := src.Rename(ctx, "link", src, "link2", 0); errno != 0 {
+		t.Fatalf("Rename(link) = %v", errno)
+	}
+	if e, ok := fake.entries["/src/link2"]; !ok || e.link != "secret" {
+		t.Errorf("renamed link = %+v, expected link to secret", e)
+	}
+	if errno := root.Rename(ctx, "src", root, "src2", 0); errno != syscall.EXDEV {
+		t.Errorf("Rename() of directory = %v, expected EXDEV", errno)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	_, root := newTestMng(t, fake, Options{ReadOnly: true})
+	ctx := context.Background()
+	dir := lookupDir(t, root, "etc")
+
+	if _, _, _, errno := dir.Create(ctx, "new", syscall.O_WRONLY, 0644, &fuse.EntryOut{}); errno != syscall.EROFS {
+		t.Errorf("Create() = %v, expected EROFS", errno)
+	}
+	if _, errno := dir.Mkdir(ctx, "new", 0755, &fuse.EntryOut{}); errno != syscall.EROFS {
+		t.Errorf("Mkdir() = %v, expected EROFS", errno)
+	}
+	if errno := dir.Unlink(ctx, "motd"); errno != syscall.EROFS {
+		t.Errorf("Unlink() = %v, expected EROFS", errno)
+	}
+	if errno := dir.Rename(ctx, "motd", dir, "moved", 0); errno != syscall.EROFS {
+		t.Errorf("Rename() = %v, expected EROFS", errno)
+	}
+	node, _ := dir.Lookup(ctx, "motd", &fuse.EntryOut{})
+	if _, _, errno := node.Operations().(*File).Open(ctx, syscall.O_RDWR); errno != syscall.EROFS {
+		t.Errorf("Open(O_RDWR) = %v, expected EROFS", errno)
+	}
+	if n := fake.count("SaveFile") + fake.count("Exec"); n != 0 {
+		t.Errorf("container modified %d times", n)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	dir := lookupDir(t, root, "etc")
+	readdir(t, dir)
+
+	var out fuse.EntryOut
+	if _, errno := dir.Symlink(ctx, "motd", "issue", &out); errno != 0 {
+		t.Fatalf("Symlink() = %v", errno)
+	}
+	if out.Size != uint64(len("motd")) {
+		t.Errorf("Symlink() size = %d, expected length of target", out.Size)
+	}
+	node, errno := dir.Lookup(ctx, "issue", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup(issue) = %v", errno)
+	}
+	if link, ok := node.Operations().(*Symlink); !ok {
+		t.Errorf("Lookup(issue) = %T, expected symlink", node.Operations())
+	} else if target, _ := link.Readlink(ctx); string(target) != "motd" {
+		t.Errorf("issue links to %q, expected motd", target)
+	}
+	if mode := readdir(t, dir)["issue"]; mode != fuse.S_IFLNK {
+		t.Errorf("issue listed with mode %o, expected symlink", mode)
+	}
+	if _, errno := dir.Symlink(ctx, "motd", "issue", &fuse.EntryOut{}); errno != syscall.EEXIST {
+		t.Errorf("Symlink() over existing link = %v, expected EEXIST", errno)
+	}
+}
+
+func TestSpecialNodes(t *testing.T) {
+	fake := newFakeDocker().
+		addNode("/dev/null", os.ModeDevice|os.ModeCharDevice|0666).
+		addNode("/run/fifo", os.ModeNamedPipe|0600)
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+
+	for path, expected := range map[string]uint32{"/dev/null": syscall.S_IFCHR, "/run/fifo": syscall.S_IFIFO} {
+		dir := lookupDir(t, root, filepath.Base(filepath.Dir(path)))
+		name := filepath.Base(path)
+		if mode := readdir(t, dir)[name]; mode != expected {
+			t.Errorf("%s listed with mode %o, expected %o", path, mode, expected)
+		}
+		node, errno := dir.Lookup(ctx, name, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%s) = %v", path, errno)
+		}
+		if node.Mode() != expected {
+			t.Errorf("%s node mode = %o, expected %o", path, node.Mode(), expected)
+		}
+		if _, ok := node.Operations().(*Special); !ok {
+			t.Errorf("%s node is %T, expected special one", path, node.Operations())
+		}
+	}
+}
+
+func TestOwner(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	uid := uint32(1234)
+	_, root := newTestMng(t, fake, Options{Uid: &uid})
+	ctx := context.Background()
+
+	var out fuse.EntryOut
+	etc, errno := root.Lookup(ctx, "etc", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(etc) = %v", errno)
+	}
+	if out.Owner.Uid != uid || out.Owner.Gid != uint32(os.Getgid()) {
+		t.Errorf("etc owned by %d:%d, expected %d:%d", out.Owner.Uid, out.Owner.Gid, uid, os.Getgid())
+	}
+	if _, errno := etc.Operations().(*Dir).Lookup(ctx, "motd", &out); errno != 0 {
+		t.Fatalf("Lookup(motd) = %v", errno)
+	}
+	if out.Owner.Uid != uid || out.Owner.Gid != uint32(os.Getgid()) {
+		t.Errorf("motd owned by %d:%d, expected %d:%d", out.Owner.Uid, out.Owner.Gid, uid, os.Getgid())
+	}
+}
@@ -4,19 +4,30 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/time/rate"
 )
 
 type dockerMng interface {
 	// returns read-closer to tar-archive fetched by /containers/{id}/export api method
 	ContainerExport(ctx context.Context) (io.ReadCloser, error)
 
+	// Stat a path, error wraps ErrorNotFound if it's missing, like errors of
+	// GetFile, SaveFile and MakeDir do
 	GetPathAttrs(ctx context.Context, path string) (types.ContainerPathStat, error)
 
 	GetFsChanges(ctx context.Context) ([]container.ContainerChangeResponseItem, error)
@@ -24,11 +35,30 @@ type dockerMng interface {
 	// Get plain file content
 	GetFile(ctx context.Context, path string) (io.ReadCloser, error)
 
-	// Save file
-	SaveFile(ctx context.Context, path string, data []byte, stat *types.ContainerPathStat) (err error)
+	// Save file, owned by owner (root if nil)
+	SaveFile(ctx context.Context, path string, data []byte, stat *types.ContainerPathStat, owner *fileOwner) (err error)
 
-	// List containers
+	// Create directory, its parent must exist
+	MakeDir(ctx context.Context, path string, mode os.FileMode) error
+
+	// List containers, stopped ones included
 	ContainersList(ctx context.Context) ([]types.Container, error)
+
+	// Tell if container is running
+	IsRunning(ctx context.Context) (bool, error)
+
+	// Get container details, like docker inspect does
+	Inspect(ctx context.Context) (types.ContainerJSON, error)
+
+	// Get size of files changed in container and of all its files, as
+	// docker reports them
+	Size(ctx context.Context) (rw, rootFs int64, err error)
+
+	// List volumes and bind mounts of container
+	Mounts(ctx context.Context) ([]types.MountPoint, error)
+
+	// Run command in container and wait for it to finish
+	Exec(ctx context.Context, cmd []string) (stdout, stderr []byte, exitCode int, err error)
 }
 
 var _ = (dockerMng)((*dockerMngImpl)(nil))
@@ -36,61 +66,456 @@ var _ = (dockerMng)((*dockerMngImpl)(nil))
 type dockerMngImpl struct {
 	dockerClient *client.Client
 	id           string
+	// limit of a request, 0 means none
+	timeout time.Duration
+	// limit of download rate of streamed responses, nil means none
+	limiter *rate.Limiter
 }
 
-func NewDockerMng(cli *client.Client, containerId string) dockerMng {
+// NewDockerMng returns docker API of container. Requests not done within
+// timeout fail, streamed responses fail once no data comes for timeout.
+// Streamed responses are read no faster than limiter allows, if it's set.
+func NewDockerMng(cli *client.Client, containerId string, timeout time.Duration, limiter *rate.Limiter) dockerMng {
 	return &dockerMngImpl{
 		dockerClient: cli,
 		id:           containerId,
+		timeout:      timeout,
+		limiter:      limiter,
+	}
+}
+
+func (d *dockerMngImpl) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.timeout)
+}
+
+// stream makes a request which response is read afterwards, so the timeout
+// is applied to waiting for it and then to every read of the body.
+func (d *dockerMngImpl) stream(ctx context.Context, request func(ctx context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if d.limiter != nil {
+		unlimited := request
+		request = func(ctx context.Context) (io.ReadCloser, error) {
+			body, err := unlimited(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &rateLimitedReader{ReadCloser: body, limiter: d.limiter, ctx: ctx}, nil
+		}
+	}
+	if d.timeout <= 0 {
+		return request(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(d.timeout, cancel)
+	body, err := request(ctx)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	return &idleTimeoutReader{ReadCloser: body, timer: timer, timeout: d.timeout, cancel: cancel}, nil
+}
+
+// idleTimeoutReader cancels its request once no data comes within timeout.
+type idleTimeoutReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// upload makes a request sending body, which fails once no data is sent
+// within the timeout, or no response comes within it after that.
+func (d *dockerMngImpl) upload(ctx context.Context, body io.Reader, request func(ctx context.Context, body io.Reader) error) error {
+	if d.timeout <= 0 {
+		return request(ctx, body)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := time.AfterFunc(d.timeout, cancel)
+	defer timer.Stop()
+	return request(ctx, &idleTimeoutBody{Reader: body, timer: timer, timeout: d.timeout})
+}
+
+// idleTimeoutBody restarts timer of its request on every read. Unlike
+// idleTimeoutReader it's closed by the HTTP client once sent, which must
+// not cancel the request.
+type idleTimeoutBody struct {
+	io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+// idleDeadlineReader fails reads of a hijacked connection, which context
+// doesn't reach, once no data comes within timeout.
+type idleDeadlineReader struct {
+	io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleDeadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.Reader.Read(p)
+}
+
+// rateLimitedReader waits after every read until limiter lets the read bytes
+// through, so the body is downloaded no faster than the limit.
+type rateLimitedReader struct {
+	io.ReadCloser
+	limiter *rate.Limiter
+	ctx     context.Context
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// limiter refuses to wait for more than its burst
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
 	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
 }
 
 func (d *dockerMngImpl) ContainerExport(ctx context.Context) (readr io.ReadCloser, err error) {
-	readr, err = d.dockerClient.ContainerExport(ctx, d.id)
-	return
+	return d.stream(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+		return d.dockerClient.ContainerExport(ctx, d.id)
+	})
 }
 
 func (d *dockerMngImpl) GetPathAttrs(ctx context.Context, path string) (path_stat types.ContainerPathStat, err error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 	path_stat, err = d.dockerClient.ContainerStatPath(ctx, d.id, path)
-	return
+	return path_stat, pathError(err, path)
 }
 
 func (d *dockerMngImpl) GetFsChanges(ctx context.Context) (changes []container.ContainerChangeResponseItem, err error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 	changes, err = d.dockerClient.ContainerDiff(ctx, d.id)
 	return
 }
 
 func (d *dockerMngImpl) GetFile(ctx context.Context, path string) (readr io.ReadCloser, err error) {
-	readr, _, err = d.dockerClient.CopyFromContainer(ctx, d.id, path)
-	return
+	return d.stream(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+		readr, _, err := d.dockerClient.CopyFromContainer(ctx, d.id, path)
+		return readr, pathError(err, path)
+	})
 }
 
 func (d *dockerMngImpl) ContainersList(ctx context.Context) (container_list []types.Container, err error) {
-	container_list, err = d.dockerClient.ContainerList(ctx, types.ContainerListOptions{})
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	container_list, err = d.dockerClient.ContainerList(ctx, types.ContainerListOptions{All: true})
 	return
 }
 
-// Save file content.
-func (d *dockerMngImpl) SaveFile(ctx context.Context, path string, data []byte, stat *types.ContainerPathStat) (err error) {
-	var buffer bytes.Buffer
-	writer := tar.NewWriter(&buffer)
-	defer writer.Close()
+func (d *dockerMngImpl) IsRunning(ctx context.Context) (bool, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	info, err := d.dockerClient.ContainerInspect(ctx, d.id)
+	if err != nil {
+		return false, err
+	}
+	return info.State != nil && info.State.Running, nil
+}
+
+func (d *dockerMngImpl) Inspect(ctx context.Context) (types.ContainerJSON, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	return d.dockerClient.ContainerInspect(ctx, d.id)
+}
+
+func (d *dockerMngImpl) Size(ctx context.Context) (rw, rootFs int64, err error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	info, _, err := d.dockerClient.ContainerInspectWithRaw(ctx, d.id, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.SizeRw != nil {
+		rw = *info.SizeRw
+	}
+	if info.SizeRootFs != nil {
+		rootFs = *info.SizeRootFs
+	}
+	return rw, rootFs, nil
+}
 
-	dir, name := filepath.Split(path)
+func (d *dockerMngImpl) Mounts(ctx context.Context) ([]types.MountPoint, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	info, err := d.dockerClient.ContainerInspect(ctx, d.id)
+	if err != nil {
+		return nil, err
+	}
+	return info.Mounts, nil
+}
+
+// Exec runs cmd, the timeout applies to each request and to every read of
+// the output, not to the whole run.
+func (d *dockerMngImpl) Exec(ctx context.Context, cmd []string) (stdout, stderr []byte, exitCode int, err error) {
+	setupCtx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	exec, err := d.dockerClient.ContainerExecCreate(setupCtx, d.id, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	resp, err := d.dockerClient.ContainerExecAttach(setupCtx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Close()
+	var output io.Reader = resp.Reader
+	if d.timeout > 0 {
+		output = &idleDeadlineReader{Reader: resp.Reader, conn: resp.Conn, timeout: d.timeout}
+	}
+	var outBuf, errBuf bytes.Buffer
+	if _, err := stdcopy.StdCopy(&outBuf, &errBuf, output); err != nil {
+		return nil, nil, 0, err
+	}
+	inspectCtx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	inspect, err := d.dockerClient.ContainerExecInspect(inspectCtx, exec.ID)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), inspect.ExitCode, nil
+}
+
+// Save file content. Mode and modification time are taken from stat,
+// symlinks are saved as links to stat.LinkTarget.
+func (d *dockerMngImpl) SaveFile(ctx context.Context, path string, data []byte, stat *types.ContainerPathStat, owner *fileOwner) (err error) {
 	hdr := &tar.Header{
-		Name:    name,
+		Name:    filepath.Base(path),
 		Size:    int64(len(data)),
-		Mode:    int64(stat.Mode),
-		ModTime: time.Now(),
+		Mode:    tarMode(stat.Mode),
+		ModTime: stat.Mtime,
+	}
+	if owner != nil {
+		hdr.Uid, hdr.Gid = owner.uid, owner.gid
+	}
+	if stat.Mode&os.ModeSymlink != 0 {
+		hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, stat.LinkTarget, 0
+		data = nil
+	}
+	err = d.copyToContainer(ctx, filepath.Dir(path), hdr, data)
+	if !errors.Is(err, ErrorNotFound) {
+		return err
+	}
+	// the directory is gone from container meanwhile, e.g. removed by app
+	if err := d.makeParents(ctx, filepath.Dir(path)); err != nil {
+		return err
+	}
+	return d.copyToContainer(ctx, filepath.Dir(path), hdr, data)
+}
+
+// makeParents creates dir and its missing parents. Directories are created
+// one by one, archive with all of them would reset mode and mtime of the
+// existing ones.
+func (d *dockerMngImpl) makeParents(ctx context.Context, dir string) error {
+	var missing []string
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		_, err := d.GetPathAttrs(ctx, dir)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrorNotFound) {
+			return err
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := d.MakeDir(ctx, missing[i], 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create directory.
+func (d *dockerMngImpl) MakeDir(ctx context.Context, path string, mode os.FileMode) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     filepath.Base(path) + "/",
+		Mode:     tarMode(mode),
+		ModTime:  time.Now(),
 	}
+	return d.copyToContainer(ctx, filepath.Dir(path), hdr, nil)
+}
+
+// tarMode converts permissions and special bits of mode to tar header mode.
+func tarMode(mode os.FileMode) int64 {
+	return int64(unixMode(mode))
+}
+
+// unixMode returns permissions and special bits of mode as unix mode bits.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+// fileMode is the reverse of unixMode.
+func fileMode(unix uint32) os.FileMode {
+	m := os.FileMode(unix).Perm()
+	if unix&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if unix&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if unix&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// special bits and permissions
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// copyToContainer extracts a single entry archive into dir. Format of the
+// header is left to tar writer, it adds PAX records for names and link
+// targets too long for USTAR.
+func (d *dockerMngImpl) copyToContainer(ctx context.Context, dir string, hdr *tar.Header, data []byte) error {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
 	if err := writer.WriteHeader(hdr); err != nil {
 		return err
 	}
 	if _, err := writer.Write(data); err != nil {
 		return err
 	}
-	reader := tar.NewReader(bytes.NewReader(buffer.Bytes()))
-	err = d.dockerClient.CopyToContainer(ctx, d.id, dir, reader, types.CopyToContainerOptions{})
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return pathError(d.upload(ctx, &buffer, func(ctx context.Context, body io.Reader) error {
+		return d.dockerClient.CopyToContainer(ctx, d.id, dir, body, types.CopyToContainerOptions{})
+	}), dir)
+}
 
-	return
+// pathError turns not found error of docker client into ErrorNotFound, the
+// only way callers tell missing paths.
+func pathError(err error, path string) error {
+	if err != nil && client.IsErrNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrorNotFound, path)
+	}
+	return err
+}
+
+// fileOwner is owner of a file in container. Stat of the daemon doesn't
+// report it, it's taken from the file archive.
+type fileOwner struct {
+	uid, gid int
+}
+
+// Fetch content of a regular file unpacked from its archive.
+func getFileContent(ctx context.Context, docker dockerMng, path string) ([]byte, error) {
+	_, data, err := getFile(ctx, docker, path)
+	return data, err
+}
+
+// Fetch archive header and content of a regular file.
+func getFile(ctx context.Context, docker dockerMng, path string) (*tar.Header, []byte, error) {
+	reader, err := docker.GetFile(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("broken archive of %q: %w", path, err)
+	}
+	data, err := ioutil.ReadAll(tr)
+	return hdr, data, err
+}
+
+// Fetch archive header of a file, the content isn't read.
+func getHeader(ctx context.Context, docker dockerMng, path string) (*tar.Header, error) {
+	reader, err := docker.GetFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	hdr, err := tar.NewReader(reader).Next()
+	if err != nil {
+		return nil, fmt.Errorf("broken archive of %q: %w", path, err)
+	}
+	return hdr, nil
+}
+
+// Fetch owner of a file.
+func getOwner(ctx context.Context, docker dockerMng, path string) (*fileOwner, error) {
+	hdr, err := getHeader(ctx, docker, path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOwner{uid: hdr.Uid, gid: hdr.Gid}, nil
+}
+
+// Fetch target of a symlink as stored in its archive. Stat of the daemon
+// reports the target evaluated to an absolute path, which breaks relative
+// links pointing outside of the mount or across other links.
+func getLinkTarget(ctx context.Context, docker dockerMng, path string) (string, error) {
+	hdr, err := getHeader(ctx, docker, path)
+	if err != nil {
+		return "", err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		return "", fmt.Errorf("%q is not a symlink in its archive", path)
+	}
+	return hdr.Linkname, nil
+}
+
+// dockerErrno maps error of docker API request to errno, by the status code
+// the daemon responded with.
+func dockerErrno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrorNotFound):
+		return syscall.ENOENT
+	case errdefs.IsUnauthorized(err), errdefs.IsForbidden(err):
+		return syscall.EACCES
+	default:
+		return syscall.EIO
+	}
 }
@@ -0,0 +1,591 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestClientFactoryHost(t *testing.T) {
+	os.Unsetenv("DOCKER_HOST")
+	os.Unsetenv("XDG_RUNTIME_DIR")
+	for host, expected := range map[string]string{
+		"":                                "unix:///var/run/docker.sock",
+		"/builds/dind/docker.sock":        "unix:///builds/dind/docker.sock",
+		"unix:///builds/dind/docker.sock": "unix:///builds/dind/docker.sock",
+		"tcp://docker:2375":               "tcp://docker:2375",
+	} {
+		f := &ClientFactory{Host: host}
+		cli, err := f.Client()
+		if err != nil {
+			t.Errorf("Client() for host %q failed: %v", host, err)
+			continue
+		}
+		if cli.DaemonHost() != expected {
+			t.Errorf("Client().DaemonHost() for host %q = %q, expected %q", host, cli.DaemonHost(), expected)
+		}
+	}
+}
+
+func TestClientFactorySocket(t *testing.T) {
+	os.Unsetenv("DOCKER_HOST")
+	f := &ClientFactory{Socket: "/run/user/1000/docker.sock"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	if cli.DaemonHost() != "unix:///run/user/1000/docker.sock" {
+		t.Errorf("DaemonHost() = %q, expected the socket", cli.DaemonHost())
+	}
+
+	if _, err := os.Stat("/var/run/docker.sock"); err == nil {
+		t.Skip("system-wide docker socket exists")
+	}
+	runtimeDir := os.Getenv("HOME")
+	if err := ioutil.WriteFile(filepath.Join(runtimeDir, "docker.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(runtimeDir, "docker.sock"))
+	os.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	defer os.Unsetenv("XDG_RUNTIME_DIR")
+	f = &ClientFactory{}
+	if cli, err = f.Client(); err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	if expected := "unix://" + filepath.Join(runtimeDir, "docker.sock"); cli.DaemonHost() != expected {
+		t.Errorf("DaemonHost() = %q, expected rootless socket %q", cli.DaemonHost(), expected)
+	}
+}
+
+func TestClientFactoryShared(t *testing.T) {
+	f := &ClientFactory{Host: "tcp://docker:2375", APIVersion: "1.40"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	if cli.ClientVersion() != "1.40" {
+		t.Errorf("ClientVersion() = %q, expected 1.40", cli.ClientVersion())
+	}
+
+	mng := NewMng("fake", f, Options{})
+	if err := mng.connect(); err != nil {
+		t.Fatalf("connect() failed: %v", err)
+	}
+	if got := mng.docker.(*dockerMngImpl).dockerClient; got != cli {
+		t.Errorf("Mng uses its own docker client, expected the shared one")
+	}
+}
+
+func TestClientFactoryTLS(t *testing.T) {
+	os.Unsetenv("DOCKER_HOST")
+	os.Unsetenv("DOCKER_CERT_PATH")
+
+	f := &ClientFactory{Host: "tcp://docker:2376"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	if tr := cli.HTTPClient().Transport.(*http.Transport); tr.TLSClientConfig != nil {
+		t.Errorf("TLS is configured, but not requested")
+	}
+
+	f = &ClientFactory{Host: "tcp://docker:2376", TLSCACert: "/nonexistent/ca.pem"}
+	if _, err := f.Client(); err == nil {
+		t.Errorf("Client() with missing CA certificate succeeded, expected error")
+	}
+
+	// no certificates in ~/.docker, system CAs are used
+	f = &ClientFactory{Host: "tcp://docker:2376", TLSVerify: true}
+	cli, err = f.Client()
+	if err != nil {
+		t.Fatalf("Client() with TLS failed: %v", err)
+	}
+	tr := cli.HTTPClient().Transport.(*http.Transport)
+	if tr.TLSClientConfig == nil || tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("TLS config = %+v, expected verifying one", tr.TLSClientConfig)
+	}
+	if cli.DaemonHost() != "tcp://docker:2376" {
+		t.Errorf("DaemonHost() = %q, expected tcp://docker:2376", cli.DaemonHost())
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/export") {
+			// response starts, but its body never ends
+			w.Write([]byte("data"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	f := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	docker := NewDockerMng(cli, "web", 100*time.Millisecond, nil)
+	ctx := context.Background()
+
+	start := time.Now()
+	if _, err := docker.GetPathAttrs(ctx, "/etc/motd"); err == nil {
+		t.Errorf("GetPathAttrs() of hung daemon succeeded")
+	}
+	body, err := docker.ContainerExport(ctx)
+	if err != nil {
+		t.Fatalf("ContainerExport() failed: %v", err)
+	}
+	defer body.Close()
+	if _, err := ioutil.ReadAll(body); err == nil {
+		t.Errorf("reading of hung export succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("requests timed out in %v", elapsed)
+	}
+}
+
+func TestExecIdleTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/web/exec"):
+			var config types.ExecConfig
+			json.NewDecoder(r.Body).Decode(&config)
+			json.NewEncoder(w).Encode(types.IDResponse{ID: config.Cmd[0]})
+		case strings.HasSuffix(r.URL.Path, "/start"):
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Hijack() failed: %v", err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			buf.Flush()
+			if strings.Contains(r.URL.Path, "/hung/") {
+				<-hung
+				return
+			}
+			// output takes longer than timeout, but keeps coming
+			stdout := stdcopy.NewStdWriter(conn, stdcopy.Stdout)
+			for i := 0; i < 5; i++ {
+				time.Sleep(timeout / 2)
+				stdout.Write([]byte("line\n"))
+			}
+		case strings.HasSuffix(r.URL.Path, "/json"):
+			json.NewEncoder(w).Encode(types.ContainerExecInspect{ExitCode: 0})
+		}
+	}))
+	defer srv.Close()
+	defer close(hung)
+	f := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	docker := NewDockerMng(cli, "web", timeout, nil)
+	ctx := context.Background()
+
+	stdout, _, _, err := docker.Exec(ctx, []string{"slow"})
+	if err != nil || string(stdout) != strings.Repeat("line\n", 5) {
+		t.Errorf("Exec(slow) = %q, %v", stdout, err)
+	}
+	start := time.Now()
+	if _, _, _, err := docker.Exec(ctx, []string{"hung"}); err == nil {
+		t.Errorf("Exec(hung) succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("hung exec timed out in %v", elapsed)
+	}
+}
+
+func TestMaxDownloadRate(t *testing.T) {
+	const size, rate = 30000, 10000
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, size))
+	}))
+	defer srv.Close()
+	f := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40", MaxDownloadRate: rate}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	docker := NewDockerMng(cli, "web", time.Second, f.downloadLimiter())
+
+	start := time.Now()
+	body, err := docker.ContainerExport(context.Background())
+	if err != nil {
+		t.Fatalf("ContainerExport() failed: %v", err)
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil || len(data) != size {
+		t.Fatalf("read %d bytes of export, error %v", len(data), err)
+	}
+	// the first second worth of data comes at once
+	if elapsed, expected := time.Since(start), time.Duration(size-rate)*time.Second/rate; elapsed < expected {
+		t.Errorf("export read in %v, expected %v at least", elapsed, expected)
+	}
+}
+
+func TestLookupSpecialChars(t *testing.T) {
+	const name = "a b?c#d.txt"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if !strings.HasSuffix(r.URL.Path, "/containers/web/archive") || path != "/tmp/"+name {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		stat, _ := json.Marshal(types.ContainerPathStat{Name: name, Size: 5, Mode: 0644})
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+	}))
+	defer srv.Close()
+	clients := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}
+	mng := NewMng("web", clients, Options{})
+	if err := mng.connect(); err != nil {
+		t.Fatalf("connect() failed: %v", err)
+	}
+	dir := &Dir{mng: mng, fullpath: "/tmp"}
+	fs.NewNodeFS(dir, &fs.Options{})
+
+	var out fuse.EntryOut
+	if _, errno := dir.Lookup(context.Background(), name, &out); errno != 0 {
+		t.Fatalf("Lookup(%q) = %v", name, errno)
+	}
+	if out.Size != 5 {
+		t.Errorf("Lookup(%q) size = %d, expected 5", name, out.Size)
+	}
+}
+
+func TestArchiveVersionedAPI(t *testing.T) {
+	var version string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" {
+			w.Header().Set("API-Version", "1.41")
+			return
+		}
+		// like newer daemons, only versioned paths are served
+		if r.URL.Path != "/v"+version+"/containers/web/archive" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		stat, _ := json.Marshal(types.ContainerPathStat{Name: "hosts", Size: 9, Mode: 0644})
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+		if r.Method == http.MethodGet {
+			tw := tar.NewWriter(w)
+			tw.WriteHeader(&tar.Header{Name: "hosts", Typeflag: tar.TypeReg, Size: 9, Mode: 0644})
+			tw.Write([]byte("localhost"))
+			tw.Close()
+		}
+	}))
+	defer srv.Close()
+	defer os.Unsetenv("DOCKER_API_VERSION")
+
+	for env, expected := range map[string]string{
+		// negotiated with daemon
+		"":     "1.41",
+		"1.40": "1.40",
+	} {
+		version = expected
+		os.Setenv("DOCKER_API_VERSION", env)
+		f := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String()}
+		cli, err := f.Client()
+		if err != nil {
+			t.Fatalf("Client() failed: %v", err)
+		}
+		docker := NewDockerMng(cli, "web", time.Second, nil)
+		if stat, err := docker.GetPathAttrs(context.Background(), "/etc/hosts"); err != nil || stat.Size != 9 {
+			t.Errorf("GetPathAttrs() with API %s = %+v, %v", expected, stat, err)
+		}
+		body, err := docker.GetFile(context.Background(), "/etc/hosts")
+		if err != nil {
+			t.Fatalf("GetFile() with API %s failed: %v", expected, err)
+		}
+		tr := tar.NewReader(body)
+		if _, err := tr.Next(); err != nil {
+			t.Errorf("GetFile() with API %s returned broken archive: %v", expected, err)
+		} else if data, _ := ioutil.ReadAll(tr); string(data) != "localhost" {
+			t.Errorf("GetFile() with API %s returned %q", expected, data)
+		}
+		body.Close()
+	}
+}
+
+func TestLongNames(t *testing.T) {
+	dir := "/" + strings.Repeat("d", 150)
+	name := strings.Repeat("f", 200)
+	saved := make(map[string]*tar.Header)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Query().Get("path") != dir {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		tr := tar.NewReader(r.Body)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Errorf("broken archive: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		saved[hdr.Name] = hdr
+	}))
+	defer srv.Close()
+	f := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	docker := NewDockerMng(cli, "web", time.Second, nil)
+
+	ctx := context.Background()
+	if err := docker.SaveFile(ctx, dir+"/"+name, []byte("x"), &types.ContainerPathStat{Mode: 0644}, &fileOwner{uid: 33, gid: 33}); err != nil {
+		t.Fatalf("SaveFile() failed: %v", err)
+	}
+	if hdr, ok := saved[name]; !ok || hdr.Size != 1 || hdr.Uid != 33 || hdr.Gid != 33 {
+		t.Errorf("file saved as %v, expected %d chars long name owned by 33:33", saved, len(name))
+	}
+	link := dir + "/" + name
+	stat := &types.ContainerPathStat{Mode: os.ModeSymlink | 0777, LinkTarget: link}
+	if err := docker.SaveFile(ctx, dir+"/link", nil, stat, nil); err != nil {
+		t.Fatalf("SaveFile() of link failed: %v", err)
+	}
+	if hdr, ok := saved["link"]; !ok || hdr.Linkname != link {
+		t.Errorf("link saved as %+v, expected target %q", hdr, link)
+	}
+	if err := docker.MakeDir(ctx, dir+"/"+name, 0755); err != nil {
+		t.Fatalf("MakeDir() failed: %v", err)
+	}
+	if _, ok := saved[name+"/"]; !ok {
+		t.Errorf("directory with long name not saved")
+	}
+}
+
+func TestSaveFileMissingParents(t *testing.T) {
+	dirs := map[string]bool{"/": true, "/a": true}
+	var files []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if !dirs[path] {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Could not find the file " + path + " in container web"})
+			return
+		}
+		switch r.Method {
+		case http.MethodHead:
+			stat, _ := json.Marshal(types.ContainerPathStat{Name: filepath.Base(path), Mode: os.ModeDir | 0755})
+			w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+		case http.MethodPut:
+			hdr, err := tar.NewReader(r.Body).Next()
+			if err != nil {
+				t.Errorf("broken archive: %v", err)
+				return
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				dirs[filepath.Join(path, hdr.Name)] = true
+			} else {
+				files = append(files, filepath.Join(path, hdr.Name))
+			}
+		}
+	}))
+	defer srv.Close()
+	f := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	docker := NewDockerMng(cli, "web", time.Second, nil)
+
+	if err := docker.SaveFile(context.Background(), "/a/b/c/newfile", []byte("x"), &types.ContainerPathStat{Mode: 0644}, nil); err != nil {
+		t.Fatalf("SaveFile() failed: %v", err)
+	}
+	if !dirs["/a/b"] || !dirs["/a/b/c"] {
+		t.Errorf("parents not created, directories: %v", dirs)
+	}
+	if len(files) != 1 || files[0] != "/a/b/c/newfile" {
+		t.Errorf("saved files %v, expected /a/b/c/newfile", files)
+	}
+}
+
+func TestLookupIncompleteStat(t *testing.T) {
+	headers := map[string]string{
+		"nomode": base64.StdEncoding.EncodeToString([]byte(`{"name":"nomode","size":3}`)),
+		"broken": "not base64!",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Docker-Container-Path-Stat", headers[filepath.Base(r.URL.Query().Get("path"))])
+	}))
+	defer srv.Close()
+	clients := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}
+	mng := NewMng("web", clients, Options{})
+	if err := mng.connect(); err != nil {
+		t.Fatalf("connect() failed: %v", err)
+	}
+	dir := &Dir{mng: mng, fullpath: "/tmp"}
+	fs.NewNodeFS(dir, &fs.Options{})
+
+	// stat is decoded into typed struct, missing fields are zero
+	var out fuse.EntryOut
+	node, errno := dir.Lookup(context.Background(), "nomode", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(nomode) = %v", errno)
+	}
+	if _, ok := node.Operations().(*File); !ok || out.Mode != 0 || out.Size != 3 {
+		t.Errorf("Lookup(nomode) = %T with mode %o, size %d, expected regular file without permissions", node.Operations(), out.Mode, out.Size)
+	}
+	if _, errno := dir.Lookup(context.Background(), "broken", &fuse.EntryOut{}); errno != syscall.EIO {
+		t.Errorf("Lookup(broken) = %v, expected EIO", errno)
+	}
+}
+
+func TestLookupErrno(t *testing.T) {
+	statuses := map[string]int{
+		"missing": http.StatusNotFound,
+		"denied":  http.StatusForbidden,
+		"unauth":  http.StatusUnauthorized,
+		"broken":  http.StatusInternalServerError,
+		"busy":    http.StatusServiceUnavailable,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[filepath.Base(r.URL.Query().Get("path"))])
+	}))
+	defer srv.Close()
+	clients := &ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}
+	mng := NewMng("web", clients, Options{})
+	if err := mng.connect(); err != nil {
+		t.Fatalf("connect() failed: %v", err)
+	}
+	dir := &Dir{mng: mng, fullpath: "/tmp"}
+	fs.NewNodeFS(dir, &fs.Options{})
+
+	for name, expected := range map[string]syscall.Errno{
+		"missing": syscall.ENOENT,
+		"denied":  syscall.EACCES,
+		"unauth":  syscall.EACCES,
+		"broken":  syscall.EIO,
+		"busy":    syscall.EIO,
+	} {
+		if _, errno := dir.Lookup(context.Background(), name, &fuse.EntryOut{}); errno != expected {
+			t.Errorf("Lookup(%s) = %v, expected %v", name, errno, expected)
+		}
+	}
+}
+
+// TestSSHHelperProcess stands for `docker system dial-stdio` run over ssh: it
+// connects stdin and stdout to the daemon at DOCKERFS_TEST_DAEMON.
+func TestSSHHelperProcess(t *testing.T) {
+	addr := os.Getenv("DOCKERFS_TEST_DAEMON")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Exit(1)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestSSHHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			json.NewEncoder(w).Encode([]types.Container{{ID: "web"}})
+		case strings.HasSuffix(r.URL.Path, "/containers/web/archive"):
+			stat, _ := json.Marshal(types.ContainerPathStat{Name: "motd", Size: 6, Mode: 0644})
+			w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+			body, _ := newFakeDocker().addFile("/etc/motd", "hello\n").GetFile(r.Context(), "/etc/motd")
+			io.Copy(w, body)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "dockerfs-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	argsFile := filepath.Join(dir, "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nDOCKERFS_TEST_DAEMON=%s exec %s -test.run=TestSSHHelperProcess\n",
+		argsFile, srv.Listener.Addr(), os.Args[0])
+	defer func(command string) { sshCommand = command }(sshCommand)
+	sshCommand = filepath.Join(dir, "ssh")
+	if err := ioutil.WriteFile(sshCommand, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &ClientFactory{Host: "ssh://alice@docker.example.com:2222", APIVersion: "1.40"}
+	cli, err := f.Client()
+	if err != nil {
+		t.Fatalf("Client() failed: %v", err)
+	}
+	docker := NewDockerMng(cli, "web", time.Second, nil)
+	list, err := docker.ContainersList(context.Background())
+	if err != nil || len(list) != 1 || list[0].ID != "web" {
+		t.Errorf("ContainersList() = %v, %v", list, err)
+	}
+	data, err := getFileContent(context.Background(), docker, "/etc/motd")
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("getFileContent() = %q, %v", data, err)
+	}
+	args, _ := ioutil.ReadFile(argsFile)
+	if expected := "-l alice -p 2222 -- docker.example.com docker system dial-stdio\n"; !strings.HasPrefix(string(args), expected) {
+		t.Errorf("ssh run with %q, expected %q", args, expected)
+	}
+}
+
+func TestCommandConnDeadline(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	read := func(name string, args ...string) (string, error) {
+		t.Helper()
+		conn, err := newCommandConn(name, args...)
+		if err != nil {
+			t.Fatalf("newCommandConn() failed: %v", err)
+		}
+		defer conn.Close()
+		data, err := ioutil.ReadAll(&idleDeadlineReader{Reader: conn, conn: conn, timeout: timeout})
+		return string(data), err
+	}
+
+	// output takes longer than timeout, but keeps coming
+	if data, err := read("sh", "-c", "for i in 1 2 3 4 5; do sleep 0.1; echo line; done"); err != nil || data != strings.Repeat("line\n", 5) {
+		t.Errorf("read %q, %v", data, err)
+	}
+	start := time.Now()
+	_, err := read("sleep", "10")
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("read of hung command failed with %v, expected timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("hung command timed out in %v", elapsed)
+	}
+}
@@ -0,0 +1,120 @@
+package dockerfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/plesk/docker-fs/lib/log"
+)
+
+// Ways to run helper commands (rm, mkdir...) in container.
+const (
+	execUnknown = iota
+	// via shell: sh -c 'cmd args'
+	execShell
+	// binaries are run directly, e.g. in images without shell
+	execDirect
+	// nothing can be run, features based on exec are disabled
+	execNone
+)
+
+var ErrNoExec = errors.New("cannot run commands in container")
+
+// ExecError is returned when a command in container exits with non-zero code.
+type ExecError struct {
+	Cmd      []string
+	ExitCode int
+	Stderr   string
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("%q exited with code %d: %s", strings.Join(e.Cmd, " "), e.ExitCode, strings.TrimSpace(e.Stderr))
+}
+
+// exec runs a helper command in container, returns its stdout.
+func (m *Mng) exec(ctx context.Context, args ...string) ([]byte, error) {
+	m.execMutex.Lock()
+	if m.execMode == execUnknown {
+		m.execMode = m.detectExec(ctx)
+	}
+	mode := m.execMode
+	m.execMutex.Unlock()
+
+	cmd := args
+	switch mode {
+	case execNone:
+		return nil, ErrNoExec
+	case execShell:
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		cmd = []string{m.shell(), "-c", strings.Join(quoted, " ")}
+	}
+	stdout, stderr, code, err := m.docker.Exec(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, &ExecError{Cmd: args, ExitCode: code, Stderr: string(stderr)}
+	}
+	return stdout, nil
+}
+
+// execErrno maps failure of a helper command to errno, judging by the
+// messages of coreutils and busybox.
+func execErrno(err error) syscall.Errno {
+	var execErr *ExecError
+	if errors.Is(err, ErrNoExec) {
+		return syscall.ENOTSUP
+	}
+	if !errors.As(err, &execErr) {
+		return syscall.EIO
+	}
+	stderr := strings.ToLower(execErr.Stderr)
+	for _, e := range []struct {
+		msg   string
+		errno syscall.Errno
+	}{
+		{"no such file or directory", syscall.ENOENT},
+		{"is a directory", syscall.EISDIR},
+		{"not a directory", syscall.ENOTDIR},
+		{"directory not empty", syscall.ENOTEMPTY},
+		{"file exists", syscall.EEXIST},
+		{"permission denied", syscall.EACCES},
+		{"operation not permitted", syscall.EPERM},
+		{"read-only file system", syscall.EROFS},
+	} {
+		if strings.Contains(stderr, e.msg) {
+			return e.errno
+		}
+	}
+	return syscall.EIO
+}
+
+func (m *Mng) shell() string {
+	if m.opts.ContainerShell != "" {
+		return m.opts.ContainerShell
+	}
+	return "/bin/sh"
+}
+
+func (m *Mng) detectExec(ctx context.Context) int {
+	if _, _, code, err := m.docker.Exec(ctx, []string{m.shell(), "-c", "true"}); err == nil && code == 0 {
+		log.Printf("[debug] Helper commands run with %v", m.shell())
+		return execShell
+	}
+	if _, _, code, err := m.docker.Exec(ctx, []string{"true"}); err == nil && code == 0 {
+		log.Printf("[info] No usable shell (%v) in container, helper commands are run directly", m.shell())
+		return execDirect
+	}
+	log.Printf("[warning] Cannot run commands in container, features based on them are disabled")
+	return execNone
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
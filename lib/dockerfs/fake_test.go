@@ -0,0 +1,474 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+type fakeEntry struct {
+	mode   os.FileMode
+	data   []byte
+	link   string
+	mtime  time.Time
+	owner  fileOwner
+	hidden bool // not part of the export, e.g. added after mount
+}
+
+// fakeDocker is an in-memory container used instead of the docker daemon.
+type fakeDocker struct {
+	mu      sync.Mutex
+	entries map[string]*fakeEntry
+	changes []container.ContainerChangeResponseItem
+
+	// listed by ContainersList, the fake itself if empty
+	containers []types.Container
+	// FS changes and exec fail like in a container which isn't running
+	stopped bool
+	// volumes and bind mounts, see addVolume
+	mounts []types.MountPoint
+	// GetFile waits for it to be closed, if set
+	fileGate chan struct{}
+	// GetPathAttrs takes that long, with the most calls made at once recorded
+	statDelay    time.Duration
+	statsRunning int
+	maxStats     int
+
+	// errors returned by successive ContainerExport calls
+	exportErrs []error
+	// errors returned by successive GetFsChanges calls
+	changesErrs []error
+	// errors returned by successive SaveFile calls
+	saveErrs []error
+	// number of next exports which break halfway
+	brokenExports int
+	calls         map[string]int
+}
+
+var _ = (dockerMng)((*fakeDocker)(nil))
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		entries: map[string]*fakeEntry{
+			"/": {mode: os.ModeDir | 0755},
+		},
+		calls: make(map[string]int),
+	}
+}
+
+func (f *fakeDocker) addFile(path, content string) *fakeDocker {
+	f.addParents(path)
+	f.entries[path] = &fakeEntry{mode: 0644, data: []byte(content), mtime: time.Unix(1600000000, 0)}
+	return f
+}
+
+func (f *fakeDocker) addSymlink(path, target string) *fakeDocker {
+	f.addParents(path)
+	f.entries[path] = &fakeEntry{mode: os.ModeSymlink | 0777, link: target}
+	return f
+}
+
+func (f *fakeDocker) addDir(path string) *fakeDocker {
+	f.addParents(path)
+	f.entries[path] = &fakeEntry{mode: os.ModeDir | 0755}
+	return f
+}
+
+func (f *fakeDocker) addNode(path string, mode os.FileMode) *fakeDocker {
+	f.addParents(path)
+	f.entries[path] = &fakeEntry{mode: mode}
+	return f
+}
+
+func (f *fakeDocker) addParents(path string) {
+	for dir := filepath.Dir(path); dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := f.entries[dir]; !ok {
+			f.entries[dir] = &fakeEntry{mode: os.ModeDir | 0755}
+		}
+	}
+}
+
+// addVolume makes path a volume, files added under it so far are not exported.
+func (f *fakeDocker) addVolume(path string) *fakeDocker {
+	f.mounts = append(f.mounts, types.MountPoint{Type: "volume", Destination: path})
+	for p, e := range f.entries {
+		if p == path || isUnder(p, path) {
+			e.hidden = true
+		}
+	}
+	return f
+}
+
+// change records a change in the container made after the export.
+func (f *fakeDocker) change(kind uint8, path string) *fakeDocker {
+	f.changes = append(f.changes, container.ContainerChangeResponseItem{Kind: kind, Path: path})
+	if kind == FileRemoved {
+		delete(f.entries, path)
+	}
+	return f
+}
+
+func (f *fakeDocker) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeDocker) called(method string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[method]++
+}
+
+var errNotRunning = errdefs.Conflict(errors.New("Container fake is not running"))
+
+func notFound(path string) error {
+	return fmt.Errorf("%w: %s", ErrorNotFound, path)
+}
+
+func (f *fakeDocker) ContainerExport(ctx context.Context) (io.ReadCloser, error) {
+	f.called("ContainerExport")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.exportErrs) > 0 {
+		err := f.exportErrs[0]
+		f.exportErrs = f.exportErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []string
+	for path, e := range f.entries {
+		if path != "/" && !e.hidden {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	body, err := f.archive(paths, func(path string) string { return path[1:] })
+	if err != nil || f.brokenExports == 0 {
+		return body, err
+	}
+	f.brokenExports--
+	data, _ := ioutil.ReadAll(body)
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(data[:len(data)/2]), resetReader{})), nil
+}
+
+// resetReader fails like a connection reset by the daemon.
+type resetReader struct{}
+
+func (resetReader) Read(p []byte) (int, error) {
+	return 0, syscall.ECONNRESET
+}
+
+// archive packs entries at paths, named in the archive by name.
+func (f *fakeDocker) archive(paths []string, name func(path string) string) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, path := range paths {
+		e := f.entries[path]
+		hdr := &tar.Header{Name: name(path), Mode: int64(e.mode.Perm()), ModTime: e.mtime, Uid: e.owner.uid, Gid: e.owner.gid}
+		switch {
+		case e.mode.IsDir():
+			hdr.Typeflag, hdr.Name = tar.TypeDir, hdr.Name+"/"
+		case e.mode&os.ModeSymlink != 0:
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		case e.mode&os.ModeCharDevice != 0:
+			hdr.Typeflag = tar.TypeChar
+		case e.mode&os.ModeNamedPipe != 0:
+			hdr.Typeflag = tar.TypeFifo
+		default:
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(e.data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (f *fakeDocker) GetPathAttrs(ctx context.Context, path string) (types.ContainerPathStat, error) {
+	f.called("GetPathAttrs")
+	if f.statDelay > 0 {
+		f.mu.Lock()
+		f.statsRunning++
+		if f.statsRunning > f.maxStats {
+			f.maxStats = f.statsRunning
+		}
+		f.mu.Unlock()
+		time.Sleep(f.statDelay)
+		f.mu.Lock()
+		f.statsRunning--
+		f.mu.Unlock()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[filepath.Clean(path)]
+	if !ok {
+		return types.ContainerPathStat{}, notFound(path)
+	}
+	// like the daemon, stat reports relative link targets as absolute paths
+	link := e.link
+	if link != "" && !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(filepath.Clean(path)), link)
+	}
+	return types.ContainerPathStat{
+		Name:       filepath.Base(path),
+		Size:       int64(len(e.data)),
+		Mode:       e.mode,
+		Mtime:      e.mtime,
+		LinkTarget: link,
+	}, nil
+}
+
+func (f *fakeDocker) Inspect(ctx context.Context) (types.ContainerJSON, error) {
+	f.called("Inspect")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := &types.ContainerState{Status: "running", Running: true}
+	if f.stopped {
+		state = &types.ContainerState{Status: "exited"}
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:      "fake",
+			Name:    "/fake",
+			Created: "2020-09-13T12:26:40Z",
+			State:   state,
+		},
+		Config: &container.Config{Image: "fake:latest", Hostname: "fake", Cmd: []string{"sleep", "infinity"},
+			Env: []string{"PATH=/usr/bin:/bin", "LANG=C.UTF-8"}},
+		Mounts: append([]types.MountPoint(nil), f.mounts...),
+	}, nil
+}
+
+func (f *fakeDocker) Size(ctx context.Context) (rw, rootFs int64, err error) {
+	f.called("Size")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.entries {
+		if e.hidden {
+			rw += int64(len(e.data))
+		}
+		rootFs += int64(len(e.data))
+	}
+	return rw, rootFs, nil
+}
+
+func (f *fakeDocker) Mounts(ctx context.Context) ([]types.MountPoint, error) {
+	f.called("Mounts")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]types.MountPoint(nil), f.mounts...), nil
+}
+
+func (f *fakeDocker) GetFsChanges(ctx context.Context) ([]container.ContainerChangeResponseItem, error) {
+	f.called("GetFsChanges")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		return nil, errNotRunning
+	}
+	if len(f.changesErrs) > 0 {
+		err := f.changesErrs[0]
+		f.changesErrs = f.changesErrs[1:]
+		return nil, err
+	}
+	return append([]container.ContainerChangeResponseItem(nil), f.changes...), nil
+}
+
+func (f *fakeDocker) GetFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	f.called("GetFile")
+	if f.fileGate != nil {
+		<-f.fileGate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path = filepath.Clean(path)
+	e, ok := f.entries[path]
+	if !ok {
+		return nil, notFound(path)
+	}
+	if e.mode.IsDir() {
+		// the whole subtree, named from the base name of dir
+		var paths []string
+		for p := range f.entries {
+			if p == path || isUnder(p, path) {
+				paths = append(paths, p)
+			}
+		}
+		sort.Strings(paths)
+		return f.archive(paths, func(p string) string { return filepath.Base(path) + p[len(path):] })
+	}
+	return f.archive([]string{path}, filepath.Base)
+}
+
+func (f *fakeDocker) SaveFile(ctx context.Context, path string, data []byte, stat *types.ContainerPathStat, owner *fileOwner) error {
+	f.called("SaveFile")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.saveErrs) > 0 {
+		err := f.saveErrs[0]
+		f.saveErrs = f.saveErrs[1:]
+		return err
+	}
+	f.addParents(path)
+	e := &fakeEntry{mode: stat.Mode, data: append([]byte(nil), data...), link: stat.LinkTarget, mtime: stat.Mtime}
+	if owner != nil {
+		e.owner = *owner
+	}
+	f.entries[path] = e
+	return nil
+}
+
+func (f *fakeDocker) MakeDir(ctx context.Context, path string, mode os.FileMode) error {
+	f.called("MakeDir")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.entries[filepath.Dir(path)]; !ok {
+		return notFound(filepath.Dir(path))
+	}
+	if e, ok := f.entries[path]; ok {
+		// extracting archive over existing directory updates its mode
+		e.mode = os.ModeDir | mode
+		return nil
+	}
+	f.entries[path] = &fakeEntry{mode: os.ModeDir | mode, mtime: time.Now(), hidden: true}
+	f.changes = append(f.changes, container.ContainerChangeResponseItem{Kind: FileAdded, Path: path})
+	return nil
+}
+
+func (f *fakeDocker) IsRunning(ctx context.Context) (bool, error) {
+	f.called("IsRunning")
+	return !f.stopped, nil
+}
+
+func (f *fakeDocker) ContainersList(ctx context.Context) ([]types.Container, error) {
+	f.called("ContainersList")
+	if len(f.containers) > 0 {
+		return f.containers, nil
+	}
+	return []types.Container{{ID: "fake", Names: []string{"/fake"}}}, nil
+}
+
+// Exec supports `true`, `rm -- path`, `rmdir -- path` and listing of
+// a directory with find, directly or via shell.
+func (f *fakeDocker) Exec(ctx context.Context, cmd []string) ([]byte, []byte, int, error) {
+	f.called("Exec")
+	if f.stopped {
+		return nil, nil, 0, errNotRunning
+	}
+	if len(cmd) == 3 && cmd[1] == "-c" {
+		if cmd[0] != "/bin/sh" {
+			return nil, nil, 0, fmt.Errorf("OCI runtime exec failed: exec: %q: no such file or directory", cmd[0])
+		}
+		cmd = strings.Fields(strings.Replace(cmd[2], "'", "", -1))
+	}
+	switch {
+	case len(cmd) == 1 && cmd[0] == "true":
+		return nil, nil, 0, nil
+	case len(cmd) == 3 && (cmd[0] == "rm" || cmd[0] == "rmdir") && cmd[1] == "--":
+		return f.rm(cmd[0], cmd[2])
+	case len(cmd) > 1 && cmd[0] == "find":
+		return f.find(cmd[1])
+	}
+	return nil, []byte("not supported"), 127, nil
+}
+
+// find lists dir the way `find dir -maxdepth 1 -exec stat -c '%f %n'` does.
+func (f *fakeDocker) find(dir string) ([]byte, []byte, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.entries[dir]; !ok {
+		return nil, []byte(fmt.Sprintf("find: %s: No such file or directory", dir)), 1, nil
+	}
+	var out bytes.Buffer
+	for p, e := range f.entries {
+		if p == dir || filepath.Dir(p) == dir {
+			fmt.Fprintf(&out, "%x %s\n", unixMode(e.mode)|fuseType(e.mode), p)
+		}
+	}
+	return out.Bytes(), nil, 0, nil
+}
+
+func (f *fakeDocker) rm(cmd, path string) ([]byte, []byte, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[path]
+	switch {
+	case !ok:
+		return nil, []byte(fmt.Sprintf("%s: can't remove '%s': No such file or directory", cmd, path)), 1, nil
+	case cmd == "rm" && e.mode.IsDir():
+		return nil, []byte(fmt.Sprintf("rm: '%s' is a directory", path)), 1, nil
+	case cmd == "rmdir" && !e.mode.IsDir():
+		return nil, []byte(fmt.Sprintf("rmdir: '%s': Not a directory", path)), 1, nil
+	}
+	for child := range f.entries {
+		if strings.HasPrefix(child, path+"/") {
+			return nil, []byte(fmt.Sprintf("rmdir: '%s': Directory not empty", path)), 1, nil
+		}
+	}
+	delete(f.entries, path)
+	// docker diff forgets files added after export
+	changes := f.changes[:0:0]
+	for _, ch := range f.changes {
+		if ch.Path != path {
+			changes = append(changes, ch)
+		}
+	}
+	if !e.hidden {
+		changes = append(changes, container.ContainerChangeResponseItem{Kind: FileRemoved, Path: path})
+	}
+	f.changes = changes
+	return nil, nil, 0, nil
+}
+
+// Keep export caches out of the real home directory.
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "dockerfs-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// newTestMng initializes a Mng backed by the fake and returns it with its
+// root directory attached to a FUSE bridge, so nodes can be created.
+func newTestMng(t *testing.T, fake *fakeDocker, opts Options) (*Mng, *Dir) {
+	t.Helper()
+	mng := NewMng("fake", nil, opts)
+	mng.docker = fake
+	if err := mng.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	root := mng.Root().(*Dir)
+	fs.NewNodeFS(root, &fs.Options{})
+	return mng, root
+}
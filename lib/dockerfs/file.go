@@ -1,11 +1,12 @@
 package dockerfs
 
 import (
-	"archive/tar"
 	"context"
-	"io/ioutil"
-	"strings"
+	"errors"
+	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/plesk/docker-fs/lib/log"
@@ -20,77 +21,242 @@ var _ = (fs.NodeWriter)((*File)(nil))
 var _ = (fs.NodeGetattrer)((*File)(nil))
 var _ = (fs.NodeFlusher)((*File)(nil))
 var _ = (fs.NodeFsyncer)((*File)(nil))
+var _ = (fs.NodeReleaser)((*File)(nil))
+var _ = (fs.NodeSetattrer)((*File)(nil))
 
 type File struct {
 	fs.Inode
 	mng *Mng
 
-	fullpath    string
-	data        []byte
-	read, write bool
-	pos         int64
-	stat        *types.ContainerPathStat
+	mu       sync.Mutex
+	fullpath string
+	data     []byte
+	// content is loaded, for open handles or a deferred save
+	loaded bool
+	// number of open file handles
+	handles int
+	// number of handles open for writing
+	writers int
+	// content is read from stream instead of data, see stream.go
+	streaming bool
+	stream    *fileStream
+	stat      *types.ContainerPathStat
+	// when stat was fetched, zero if it's outdated
+	statUpdated time.Time
+	// owner in container, fetched on the first save
+	owner *fileOwner
+	// time of the last write
+	modified time.Time
+	// armed when saving is deferred by the write-back delay
+	saveTimer *time.Timer
+	// failure of a deferred save, reported by the next Flush, Fsync or Release
+	saveErr error
+}
+
+// fileHandle keeps flags a file was opened with.
+type fileHandle struct {
+	flags uint32
+	// content is written through the handle
+	write bool
+}
+
+// appending tells if writes through fh go to the end of file.
+func appending(fh fs.FileHandle) bool {
+	h, ok := fh.(*fileHandle)
+	return ok && h.flags&syscall.O_APPEND != 0
+}
+
+// writable tells if fh was opened for writing.
+func writable(fh fs.FileHandle) bool {
+	h, ok := fh.(*fileHandle)
+	return ok && h.write
 }
 
 func (f *File) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, mode uint32, syserr syscall.Errno) {
 	defer log.Printf("[debug] File (%s) Open(%o): %v", f.fullpath, flags, syserr)
-	// Fetch file content
-	reader, err := f.mng.docker.GetFile(ctx, f.fullpath)
-	if err != nil && strings.HasSuffix(err.Error(), "404") {
-		return nil, 0, syscall.ENOENT
+	if !f.mng.acquireHandle() {
+		log.Printf("[warning] Too many open files, cannot open %q", f.fullpath)
+		return nil, 0, syscall.EMFILE
 	}
-	if err != nil {
-		log.Printf("[error] Failed to get file archive for %q: %v", f.fullpath, err)
-		return nil, 0, syscall.EIO
+	defer func() {
+		if syserr != 0 {
+			f.mng.releaseHandle()
+		}
+	}()
+	writing := flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0
+	if writing && f.mng.readOnly {
+		return nil, 0, syscall.EROFS
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.needsContent(writing) {
+		// fetched unlocked, so that concurrent opens share the download
+		path := f.fullpath
+		f.mu.Unlock()
+		stat, data, streaming, syserr := f.mng.fetchOpened(ctx, path, writing)
+		f.mu.Lock()
+		if syserr != 0 {
+			return nil, 0, syserr
+		}
+		// otherwise content was loaded by another open meanwhile
+		if f.needsContent(writing) {
+			f.closeStream()
+			f.stat, f.statUpdated = stat, time.Now()
+			f.data, f.streaming = data, streaming
+			f.loaded = true
+		}
 	}
-	defer reader.Close()
-	tr := tar.NewReader(reader)
-	if _, err := tr.Next(); err != nil {
-		return nil, 0, syscall.EIO
+	h := &fileHandle{flags: flags, write: flags&syscall.O_ACCMODE != syscall.O_RDONLY}
+	if h.write && f.saveTimer != nil {
+		// the buffer is newer than the container content, it's saved on
+		// flush of the new handle
+		f.saveTimer.Stop()
+		f.saveTimer = nil
+		f.mng.pending.remove(f)
 	}
+	f.handles++
+	if h.write {
+		f.writers++
+	}
+	log.Printf("[trace] File (%s) handles = %d, writers = %d", f.fullpath, f.handles, f.writers)
+	if (flags & syscall.O_TRUNC) == syscall.O_TRUNC {
+		log.Printf("[trace] File (%s) truncate", f.fullpath)
+		f.truncate(0)
+	}
+	return h, 0, 0
+}
 
-	data, err := ioutil.ReadAll(reader)
-	if err != nil {
-		log.Printf("[error] Failed to read file from tar archive for %q: %v", f.fullpath, err)
-		return nil, 0, syscall.EIO
+func (f *File) Release(ctx context.Context, fh fs.FileHandle) (res syscall.Errno) {
+	defer log.Printf("[debug] File (%v) Release() = %v", f.fullpath, res)
+	f.mu.Lock()
+	res = f.takeSaveErr()
+	if writable(fh) {
+		f.writers--
 	}
-	f.data = data
+	// content read by the last handle may get stale, keep only unsaved one
+	if f.handles--; f.handles == 0 && f.saveTimer == nil {
+		f.release()
+	}
+	f.mu.Unlock()
+	f.mng.releaseHandle()
+	return res
+}
 
-	// load mode
-	// TODO make a single API call to retrieve file content and attributes
-	attrs, err := f.mng.docker.GetPathAttrs(ctx, f.fullpath)
-	if err != nil && strings.HasSuffix(err.Error(), "404") {
-		return nil, 0, syscall.ENOENT
+// needsContent tells if open must fetch content of file. Content loaded
+// for open handles and the buffer of a deferred save are reused, unless it's
+// streamed and file is opened for writing.
+func (f *File) needsContent(writing bool) bool {
+	return !f.loaded || writing && f.streaming
+}
+
+// fetchOpened fetches attributes of file at path and its content, unless
+// it's big and is opened for reading only, then it's streamed on read.
+func (m *Mng) fetchOpened(ctx context.Context, path string, writing bool) (*types.ContainerPathStat, []byte, bool, syscall.Errno) {
+	stat, syserr := m.statFile(ctx, path)
+	if syserr != 0 {
+		return nil, nil, false, syserr
+	}
+	if writing || stat.Size < streamMinSize {
+		data, syserr := m.fileContent(path, stat)
+		return stat, data, false, syserr
+	}
+	if data, ok := m.readCachedFile(path, stat); ok {
+		return stat, data, false, 0
+	}
+	log.Printf("[trace] File (%s) of %d bytes is streamed", path, stat.Size)
+	return stat, nil, true, 0
+}
+
+// Fetch file content and attributes from container.
+func (f *File) load(ctx context.Context) syscall.Errno {
+	if syserr := f.fetchStat(ctx); syserr != 0 {
+		return syserr
+	}
+	return f.loadContent(ctx)
+}
+
+func (f *File) fetchStat(ctx context.Context) syscall.Errno {
+	stat, syserr := f.mng.statFile(ctx, f.fullpath)
+	if syserr != 0 {
+		return syserr
 	}
+	f.stat, f.statUpdated = stat, time.Now()
+	return 0
+}
+
+func (m *Mng) statFile(ctx context.Context, path string) (*types.ContainerPathStat, syscall.Errno) {
+	// TODO make a single API call to retrieve file content and attributes
+	attrs, err := m.docker.GetPathAttrs(ctx, path)
 	if err != nil {
-		log.Printf("[error] Failed to get file attributes for %q: %v", f.fullpath, err)
-		return nil, 0, syscall.EIO
+		errno := dockerErrno(err)
+		if errno != syscall.ENOENT {
+			log.Printf("[error] Failed to get file attributes for %q: %v", path, err)
+		}
+		return nil, errno
 	}
-	f.stat = &attrs
+	return &attrs, 0
+}
 
-	// check flags
-	if (flags&syscall.O_RDONLY) == syscall.O_RDONLY || (flags&syscall.O_RDWR) == syscall.O_RDWR {
-		log.Printf("[trace] File (%s) read", f.fullpath)
-		f.read = true
+// loadContent fetches content of file, it's read from memory since then.
+func (f *File) loadContent(ctx context.Context) syscall.Errno {
+	f.closeStream()
+	data, syserr := f.mng.fileContent(f.fullpath, f.stat)
+	if syserr != 0 {
+		return syserr
 	}
-	if (flags&syscall.O_WRONLY) == syscall.O_WRONLY || (flags&syscall.O_RDWR) == syscall.O_RDWR {
-		log.Printf("[trace] File (%s) write", f.fullpath)
-		f.write = true
+	f.data = data
+	return 0
+}
+
+// fileContent returns content of file at path with stat, from file cache
+// if it's there.
+func (m *Mng) fileContent(path string, stat *types.ContainerPathStat) ([]byte, syscall.Errno) {
+	attrs := *stat
+	if data, ok := m.readCachedFile(path, &attrs); ok {
+		return data, 0
 	}
-	if (flags & syscall.O_APPEND) == syscall.O_APPEND {
-		log.Printf("[trace] File (%s) append", f.fullpath)
-		f.pos = int64(len(f.data))
+	data, err := m.fetchFile(path)
+	if err != nil {
+		errno := dockerErrno(err)
+		if errno != syscall.ENOENT {
+			log.Printf("[error] Failed to get content of %q: %v", path, err)
+		}
+		return nil, errno
 	}
-	if (flags & syscall.O_TRUNC) == syscall.O_TRUNC {
-		log.Printf("[trace] File (%s) truncate", f.fullpath)
-		f.data = f.data[:0]
+	m.cacheFile(path, &attrs, data)
+	return data, 0
+}
+
+// fetchFile downloads content of file at path. Concurrent downloads of the
+// same path are made once, every caller gets its own copy of content, as
+// writes change it in place. The download isn't canceled with the request
+// which started it, others may wait for it.
+func (m *Mng) fetchFile(path string) ([]byte, error) {
+	v, err, shared := m.fetches.Do(path, func() (interface{}, error) {
+		return getFileContent(context.Background(), m.docker, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := v.([]byte)
+	if shared {
+		data = append([]byte(nil), data...)
 	}
-	return nil, 0, 0
+	return data, nil
 }
 
-// Read simply returns the data that was already unpacked in the Open call
+// Read simply returns the data that was already unpacked in the Open call,
+// big files are read from stream instead.
 func (f *File) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (result fuse.ReadResult, syserr syscall.Errno) {
 	defer log.Printf("[debug] File (%s) Read(%d bytes, offset = %d): %v, %v", f.fullpath, len(dest), off, result, syserr)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.streaming {
+		return f.readStream(ctx, dest, off)
+	}
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
 	end := int(off) + len(dest)
 	if end > len(f.data) {
 		end = len(f.data)
@@ -98,35 +264,197 @@ func (f *File) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int6
 	return fuse.ReadResultData(f.data[off:end]), 0
 }
 
+// readStream reads content from stream, switching to the whole content
+// loaded in memory if the file isn't read sequentially.
+func (f *File) readStream(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if f.stream == nil && off <= streamWindow {
+		// stream outlives the request
+		stream, err := openFileStream(context.Background(), f.mng.docker, f.fullpath)
+		if err != nil {
+			log.Printf("[error] Failed to get content of %q: %v", f.fullpath, err)
+			return nil, syscall.EIO
+		}
+		f.stream = stream
+	}
+	if f.stream != nil {
+		n, ok, err := f.stream.readAt(dest, off)
+		if err != nil {
+			log.Printf("[error] Failed to read content of %q: %v", f.fullpath, err)
+			return nil, syscall.EIO
+		}
+		if ok {
+			return fuse.ReadResultData(dest[:n]), 0
+		}
+	}
+	log.Printf("[trace] File (%s) is read at random offset %d, loading whole content", f.fullpath, off)
+	if syserr := f.loadContent(ctx); syserr != 0 {
+		return nil, syserr
+	}
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := int(off) + len(dest)
+	if end > len(f.data) {
+		end = len(f.data)
+	}
+	return fuse.ReadResultData(f.data[off:end]), 0
+}
+
+func (f *File) closeStream() {
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+	f.streaming = false
+}
+
+// Getattr reports attributes fetched within the FS changes refresh interval
+// without asking container again. Content being written is reported as is.
 func (f *File) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) (syserr syscall.Errno) {
 	defer log.Printf("[debug] File (%s) Getattr(): %v", f.fullpath, syserr)
-	attrs, err := f.mng.docker.GetPathAttrs(ctx, f.fullpath)
-	if err != nil && strings.HasSuffix(err.Error(), "404") {
-		return syscall.ENOENT
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stat != nil && (f.writers > 0 || f.saveTimer != nil) {
+		stat := *f.stat
+		stat.Size = int64(len(f.data))
+		if !f.modified.IsZero() {
+			stat.Mtime = f.modified
+		}
+		f.mng.setAttr(&out.Attr, f.fullpath, &stat)
+		return 0
+	}
+	if f.stat == nil || time.Since(f.statUpdated) >= f.mng.changesUpdateInterval {
+		attrs, err := f.mng.docker.GetPathAttrs(ctx, f.fullpath)
+		if err != nil {
+			errno := dockerErrno(err)
+			if errno != syscall.ENOENT {
+				log.Printf("[error] File(%s) Getting raw attrs failed: %v (%T)", f.fullpath, err, err)
+			}
+			return errno
+		}
+		f.stat, f.statUpdated = &attrs, time.Now()
 	}
+	f.mng.setAttr(&out.Attr, f.fullpath, f.stat)
+	return 0
+}
+
+// Setattr supports changing size, which is how kernel truncates files
+// (O_TRUNC included), and mode. Other attributes are kept as they are.
+func (f *File) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (syserr syscall.Errno) {
+	defer log.Printf("[debug] File (%s) Setattr(): %v", f.fullpath, syserr)
+	size, sizeOk := in.GetSize()
+	mode, modeOk := in.GetMode()
+	if (sizeOk || modeOk) && f.mng.readOnly {
+		return syscall.EROFS
+	}
+	if sizeOk {
+		if syserr = f.resize(ctx, int64(size)); syserr != 0 {
+			return syserr
+		}
+	}
+	if modeOk {
+		if syserr = f.chmod(ctx, fileMode(mode)); syserr != 0 {
+			return syserr
+		}
+	}
+	return f.Getattr(ctx, fh, out)
+}
+
+// chmod saves file with new mode, unless it's open for writing, then the mode
+// is saved with content on flush. Modification time is kept.
+func (f *File) chmod(ctx context.Context, mode os.FileMode) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writers > 0 || f.saveTimer != nil {
+		f.stat.Mode = f.stat.Mode&^modeBits | mode
+		return 0
+	}
+	if !f.loaded {
+		if syserr := f.load(ctx); syserr != 0 {
+			return syserr
+		}
+		defer f.release()
+	} else if f.streaming {
+		if syserr := f.loadContent(ctx); syserr != 0 {
+			return syserr
+		}
+	}
+	owner, err := f.fileOwner(ctx)
 	if err != nil {
-		log.Printf("[error] File(%s) Getting raw attrs failed: %v (%T)", f.fullpath, err, err)
+		log.Printf("[error] Failed to get owner of %q: %v", f.fullpath, err)
+		return dockerErrno(err)
+	}
+	stat := *f.stat
+	stat.Mode = stat.Mode&^modeBits | mode
+	if err := f.mng.docker.SaveFile(ctx, f.fullpath, f.data, &stat, owner); err != nil {
+		log.Printf("[error] Failed to change mode of %q: %v", f.fullpath, err)
 		return syscall.EIO
 	}
-	out.Mode = uint32(attrs.Mode) & 07777
-	out.Nlink = 1
-	out.Size = uint64(attrs.Size)
-	out.SetTimes(nil, &attrs.Mtime, nil)
+	f.mng.uncacheFile(f.fullpath)
+	f.stat = &stat
+	return 0
+}
 
-	out.Owner.Uid, out.Owner.Gid = f.mng.uid, f.mng.gid
+// resize changes size of the file content, saving it right away unless
+// the file is open for writing, then it's saved on flush.
+func (f *File) resize(ctx context.Context, size int64) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writers > 0 || f.saveTimer != nil {
+		f.truncate(size)
+		return 0
+	}
+	// content of file open for reading is loaded already and is kept
+	if !f.loaded {
+		if syserr := f.load(ctx); syserr != 0 {
+			return syserr
+		}
+		defer f.release()
+	} else if f.streaming {
+		if syserr := f.loadContent(ctx); syserr != 0 {
+			return syserr
+		}
+	}
+	f.truncate(size)
+	if err := f.save(ctx); err != nil {
+		log.Printf("[error] Failed to save file: %v", err)
+		return syscall.EIO
+	}
 	return 0
 }
 
+// truncate shrinks or extends content with zeroes to size.
+func (f *File) truncate(size int64) {
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		data := make([]byte, size)
+		copy(data, f.data)
+		f.data = data
+	}
+	f.modified = time.Now()
+}
+
 func (f *File) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (n uint32, syserr syscall.Errno) {
 	defer log.Printf("[debug] File (%s) Write(%d bytes, offset = %d): %d, %v", f.fullpath, len(data), off, n, syserr)
-	if !f.write {
+	if !writable(fh) {
 		return 0, syscall.EBADF
 	}
 
-	off += f.pos
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.saveTimer != nil {
+		// burst continues, it will be saved on next flush
+		f.saveTimer.Stop()
+		f.saveTimer = nil
+		f.mng.pending.remove(f)
+	}
 
-	// f.mu.Lock()
-	// defer f.mu.Unlock()
+	// offset of kernel may be behind the content loaded on open, e.g. if
+	// the file grew in container since its size was cached
+	if appending(fh) {
+		off = int64(len(f.data))
+	}
 	end := int64(len(data)) + off
 	if int64(len(f.data)) < end {
 		n := make([]byte, end)
@@ -135,6 +463,7 @@ func (f *File) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int
 	}
 
 	copy(f.data[off:off+int64(len(data))], data)
+	f.modified = time.Now()
 
 	return uint32(len(data)), 0
 }
@@ -142,27 +471,156 @@ func (f *File) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int
 // On closing file
 func (f *File) Flush(ctx context.Context, fh fs.FileHandle) (res syscall.Errno) {
 	defer log.Printf("[debug] File (%v) Flush() = %v", f.fullpath, res)
-	if !f.write {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.reportSaveErr(&res)
+	if !writable(fh) {
 		return 0
 	}
-	if err := f.mng.docker.SaveFile(ctx, f.fullpath, f.data, f.stat); err != nil {
+	if delay := f.mng.opts.WritebackDelay; delay > 0 {
+		if f.saveTimer != nil {
+			f.saveTimer.Stop()
+		}
+		f.saveTimer = time.AfterFunc(delay, f.delayedSave)
+		f.mng.pending.add(f)
+		return 0
+	}
+	if err := f.save(ctx); err != nil {
 		log.Printf("[error] Failed to save file: %v", err)
 		return syscall.EIO
 	}
-	// reset/free memory
-	f.data = nil
-	f.read, f.write = false, false
+	// content is kept for other handles, it's released with the last one
 	return 0
 }
 
 func (f *File) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) (res syscall.Errno) {
 	defer log.Printf("[debug] File (%v) Fsync() = %v", f.fullpath, res)
-	if !f.write {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.reportSaveErr(&res)
+	if !writable(fh) {
 		return 0
 	}
-	if err := f.mng.docker.SaveFile(ctx, f.fullpath, f.data, f.stat); err != nil {
+	if f.saveTimer != nil {
+		f.saveTimer.Stop()
+		f.saveTimer = nil
+		f.mng.pending.remove(f)
+	}
+	if err := f.save(ctx); err != nil {
 		log.Printf("[error] Failed to save file: %v", err)
 		return syscall.EIO
 	}
 	return 0
 }
+
+// Save changes deferred by Flush, unless more writes came in meanwhile.
+func (f *File) delayedSave() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.saveTimer == nil {
+		return
+	}
+	f.saveTimer = nil
+	f.saveDeferred()
+}
+
+// sync immediately saves changes deferred by Flush.
+func (f *File) sync() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.saveTimer == nil {
+		return
+	}
+	f.saveTimer.Stop()
+	f.saveTimer = nil
+	f.saveDeferred()
+}
+
+func (f *File) saveDeferred() {
+	f.mng.pending.remove(f)
+	if err := f.save(context.Background()); err != nil {
+		log.Printf("[error] Failed to save file %q: %v", f.fullpath, err)
+		f.saveErr = err
+		return
+	}
+	if f.handles == 0 {
+		f.release()
+	}
+}
+
+// takeSaveErr returns EIO once after a deferred save failed, as nobody
+// waits for its result.
+func (f *File) takeSaveErr() syscall.Errno {
+	if f.saveErr == nil {
+		return 0
+	}
+	log.Printf("[debug] File (%s) reports failed deferred save: %v", f.fullpath, f.saveErr)
+	f.saveErr = nil
+	return syscall.EIO
+}
+
+// reportSaveErr overrides result with EIO of a failed deferred save.
+func (f *File) reportSaveErr(res *syscall.Errno) {
+	if errno := f.takeSaveErr(); errno != 0 {
+		*res = errno
+	}
+}
+
+// fileOwner returns owner the file is saved with, so saving it doesn't make
+// it owned by root. New files are.
+func (f *File) fileOwner(ctx context.Context) (*fileOwner, error) {
+	if f.owner != nil || f.mng.created.has(f.fullpath) {
+		return f.owner, nil
+	}
+	owner, err := getOwner(ctx, f.mng.docker, f.fullpath)
+	if errors.Is(err, ErrorNotFound) {
+		// removed in container meanwhile, saving creates it again
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.owner = owner
+	return owner, nil
+}
+
+func (f *File) save(ctx context.Context) error {
+	stat := *f.stat
+	switch f.mng.opts.TimestampSource {
+	case TimestampArchive:
+		stat.Mtime = f.mng.mtime(f.fullpath, f.stat)
+	case TimestampNow:
+		stat.Mtime = time.Now()
+	default:
+		if !f.modified.IsZero() {
+			stat.Mtime = f.modified
+		}
+		// otherwise nothing was written, the time is kept
+	}
+	if stat.Mtime.IsZero() {
+		// new file
+		stat.Mtime = time.Now()
+	}
+	owner, err := f.fileOwner(ctx)
+	if err != nil {
+		return err
+	}
+	if err := f.mng.docker.SaveFile(ctx, f.fullpath, f.data, &stat, owner); err != nil {
+		return err
+	}
+	f.mng.uncacheFile(f.fullpath)
+	// changed by saving, fetch it again
+	f.statUpdated = time.Time{}
+	if f.mng.created.has(f.fullpath) {
+		f.mng.markAdded(f.fullpath)
+		f.mng.created.remove(f.fullpath)
+	}
+	return nil
+}
+
+// reset/free memory
+func (f *File) release() {
+	f.closeStream()
+	f.data = nil
+	f.loaded = false
+}
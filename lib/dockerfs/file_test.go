@@ -0,0 +1,864 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestWritebackDelayCoalescesSaves(t *testing.T) {
+	fake := newFakeDocker().addDir("/var/log")
+	mng, root := newTestMng(t, fake, Options{WritebackDelay: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	dir := lookupDir(t, root, "var", "log")
+	node, fh, _, errno := dir.Create(ctx, "app.log", syscall.O_WRONLY, 0644, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Create() = %v", errno)
+	}
+	f := node.Operations().(*File)
+
+	expected := ""
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			if fh, _, errno = f.Open(ctx, syscall.O_WRONLY); errno != 0 {
+				t.Fatalf("Open() = %v", errno)
+			}
+		}
+		line := fmt.Sprintf("line %d\n", i)
+		if _, errno := f.Write(ctx, fh, []byte(line), int64(len(expected))); errno != 0 {
+			t.Fatalf("Write() = %v", errno)
+		}
+		expected += line
+		if errno := f.Flush(ctx, fh); errno != 0 {
+			t.Fatalf("Flush() = %v", errno)
+		}
+		f.Release(ctx, fh)
+	}
+	if n := fake.count("SaveFile"); n != 0 {
+		t.Errorf("SaveFile called %d times within write-back delay", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := fake.count("SaveFile"); n != 1 {
+		t.Errorf("SaveFile called %d times, expected 1", n)
+	}
+	if got := string(fake.entries["/var/log/app.log"].data); got != expected {
+		t.Errorf("saved content %q, expected %q", got, expected)
+	}
+
+	// fsync doesn't wait
+	fh, _, _ = f.Open(ctx, syscall.O_WRONLY|syscall.O_TRUNC)
+	f.Write(ctx, fh, []byte("synced"), 0)
+	if errno := f.Fsync(ctx, fh, 0); errno != 0 {
+		t.Fatalf("Fsync() = %v", errno)
+	}
+	if n := fake.count("SaveFile"); n != 2 {
+		t.Errorf("SaveFile called %d times after fsync, expected 2", n)
+	}
+	f.Flush(ctx, fh)
+	f.Release(ctx, fh)
+	mng.Sync()
+	if n := fake.count("SaveFile"); n != 3 {
+		t.Errorf("SaveFile called %d times after Sync, expected 3", n)
+	}
+}
+
+func TestWritebackDelayReportsFailure(t *testing.T) {
+	fake := newFakeDocker().addFile("/var/log/app.log", "old\n")
+	mng, root := newTestMng(t, fake, Options{WritebackDelay: time.Hour})
+	ctx := context.Background()
+
+	node, errno := lookupDir(t, root, "var", "log").Lookup(ctx, "app.log", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup(app.log) = %v", errno)
+	}
+	f := node.Operations().(*File)
+	fh, _, errno := f.Open(ctx, syscall.O_WRONLY|syscall.O_APPEND)
+	if errno != 0 {
+		t.Fatalf("Open() = %v", errno)
+	}
+	f.Write(ctx, fh, []byte("new\n"), 0)
+	if errno := f.Flush(ctx, fh); errno != 0 {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	if errno := f.Release(ctx, fh); errno != 0 {
+		t.Fatalf("Release() = %v", errno)
+	}
+	fake.saveErrs = []error{errors.New("no space left on device")}
+	mng.Sync()
+
+	if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != 0 {
+		t.Fatalf("Open() after failed save = %v", errno)
+	}
+	if errno := f.Flush(ctx, nil); errno != syscall.EIO {
+		t.Errorf("Flush() after failed save = %v, expected EIO", errno)
+	}
+	if errno := f.Release(ctx, nil); errno != 0 {
+		t.Errorf("Release() = %v, failure is reported once", errno)
+	}
+}
+
+func lookupDir(t *testing.T, root *Dir, names ...string) *Dir {
+	t.Helper()
+	dir := root
+	for _, name := range names {
+		node, errno := dir.Lookup(context.Background(), name, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%q) = %v", name, errno)
+		}
+		dir = node.Operations().(*Dir)
+	}
+	return dir
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/passwd", "root:x:0:0::/root:/bin/sh\n")
+	_, root := newTestMng(t, fake, Options{MaxOpenFiles: 2})
+	ctx := context.Background()
+
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "passwd", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup(passwd) = %v", errno)
+	}
+	f := node.Operations().(*File)
+	for i := 0; i < 2; i++ {
+		if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != 0 {
+			t.Fatalf("Open() #%d = %v", i, errno)
+		}
+	}
+	if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != syscall.EMFILE {
+		t.Errorf("Open() beyond limit = %v, expected EMFILE", errno)
+	}
+	if _, _, _, errno := root.Create(ctx, "new", syscall.O_WRONLY, 0644, &fuse.EntryOut{}); errno != syscall.EMFILE {
+		t.Errorf("Create() beyond limit = %v, expected EMFILE", errno)
+	}
+
+	f.Release(ctx, nil)
+	if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != 0 {
+		t.Errorf("Open() after Release = %v", errno)
+	}
+}
+
+func TestTimestampSource(t *testing.T) {
+	archived := time.Unix(1600000000, 0)
+	touched := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		source   string
+		reported time.Time
+		// nil means a time of the edit
+		saved *time.Time
+	}{
+		{"", touched, nil},
+		{TimestampStat, touched, nil},
+		{TimestampArchive, archived, &archived},
+		{TimestampNow, touched, nil},
+	} {
+		fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+		_, root := newTestMng(t, fake, Options{TimestampSource: tc.source})
+		// touched in container after export
+		fake.entries["/etc/motd"].mtime = touched
+		ctx := context.Background()
+
+		node, errno := lookupDir(t, root, "etc").Lookup(ctx, "motd", &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("%q: Lookup() = %v", tc.source, errno)
+		}
+		f := node.Operations().(*File)
+		var out fuse.AttrOut
+		if errno := f.Getattr(ctx, nil, &out); errno != 0 {
+			t.Fatalf("%q: Getattr() = %v", tc.source, errno)
+		}
+		if mtime := time.Unix(int64(out.Mtime), 0); !mtime.Equal(tc.reported) {
+			t.Errorf("%q: Getattr() mtime = %v, expected %v", tc.source, mtime, tc.reported)
+		}
+
+		before := time.Now()
+		fh, _, _ := f.Open(ctx, syscall.O_WRONLY|syscall.O_APPEND)
+		f.Write(ctx, fh, []byte("bye\n"), 0)
+		if errno := f.Flush(ctx, fh); errno != 0 {
+			t.Fatalf("%q: Flush() = %v", tc.source, errno)
+		}
+		f.Release(ctx, fh)
+		saved := fake.entries["/etc/motd"].mtime
+		if tc.saved != nil && !saved.Equal(*tc.saved) {
+			t.Errorf("%q: saved mtime = %v, expected %v", tc.source, saved, *tc.saved)
+		}
+		if tc.saved == nil && (saved.Before(before) || saved.After(time.Now())) {
+			t.Errorf("%q: saved mtime = %v, expected time of the edit", tc.source, saved)
+		}
+	}
+}
+
+func TestWriteback(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello world\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "motd", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	saved := func() string {
+		return string(fake.entries["/etc/motd"].data)
+	}
+
+	// partial write in the middle, then past the end
+	fh, _, _ := f.Open(ctx, syscall.O_RDWR)
+	f.Write(ctx, fh, []byte("HELLO"), 0)
+	f.Write(ctx, fh, []byte("!"), 14)
+	if errno := f.Flush(ctx, fh); errno != 0 {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	f.Release(ctx, fh)
+	if expected := "HELLO world\n\x00\x00!"; saved() != expected {
+		t.Errorf("saved %q, expected %q", saved(), expected)
+	}
+
+	// kernel truncates with setattr, file is saved once on flush
+	fh, _, _ = f.Open(ctx, syscall.O_WRONLY)
+	var in fuse.SetAttrIn
+	in.Valid, in.Size = fuse.FATTR_SIZE, 0
+	if errno := f.Setattr(ctx, fh, &in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatalf("Setattr() = %v", errno)
+	}
+	f.Write(ctx, fh, []byte("bye\n"), 0)
+	f.Flush(ctx, fh)
+	f.Release(ctx, fh)
+	if saved() != "bye\n" {
+		t.Errorf("saved %q, expected %q", saved(), "bye\n")
+	}
+	if n := fake.count("SaveFile"); n != 2 {
+		t.Errorf("SaveFile called %d times, expected 2", n)
+	}
+
+	// truncate(1) of a file which isn't open
+	in.Size = 2
+	var out fuse.AttrOut
+	if errno := f.Setattr(ctx, nil, &in, &out); errno != 0 {
+		t.Fatalf("Setattr() = %v", errno)
+	}
+	if saved() != "by" || out.Size != 2 {
+		t.Errorf("saved %q of size %d, expected %q", saved(), out.Size, "by")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	fake := newFakeDocker().addFile("/var/log/app.log", "start\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, lookupDir(t, root, "var"), "log").Lookup(ctx, "app.log", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+
+	// echo x >> app.log, twice; offsets are stale, as if the size kernel
+	// knows is outdated
+	for i := 0; i < 2; i++ {
+		fh, _, errno := f.Open(ctx, syscall.O_WRONLY|syscall.O_APPEND)
+		if errno != 0 {
+			t.Fatalf("Open() = %v", errno)
+		}
+		if _, errno := f.Write(ctx, fh, []byte("x\n"), 0); errno != 0 {
+			t.Fatalf("Write() = %v", errno)
+		}
+		if errno := f.Flush(ctx, fh); errno != 0 {
+			t.Fatalf("Flush() = %v", errno)
+		}
+		f.Release(ctx, fh)
+	}
+	if saved, expected := string(fake.entries["/var/log/app.log"].data), "start\nx\nx\n"; saved != expected {
+		t.Errorf("saved %q, expected %q", saved, expected)
+	}
+}
+
+func TestFsync(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/app.conf", "old")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "app.conf", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+
+	fh, _, errno := f.Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open(O_RDONLY) = %v", errno)
+	}
+	if errno := f.Fsync(ctx, fh, 0); errno != 0 {
+		t.Errorf("Fsync() of read-only file = %v", errno)
+	}
+	f.Release(ctx, fh)
+	if n := fake.count("SaveFile"); n != 0 {
+		t.Errorf("SaveFile called %d times by fsync of read-only file", n)
+	}
+
+	// editors fsync before close (and before renaming the file over another)
+	fh, _, errno = f.Open(ctx, syscall.O_WRONLY|syscall.O_TRUNC)
+	if errno != 0 {
+		t.Fatalf("Open(O_WRONLY) = %v", errno)
+	}
+	f.Write(ctx, fh, []byte("new"), 0)
+	if errno := f.Fsync(ctx, fh, 0); errno != 0 {
+		t.Fatalf("Fsync() = %v", errno)
+	}
+	if saved := string(fake.entries["/etc/app.conf"].data); saved != "new" {
+		t.Errorf("saved %q before close, expected new", saved)
+	}
+	f.Flush(ctx, fh)
+	f.Release(ctx, fh)
+}
+
+func TestSaveKeepsOwner(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/app.conf", "old")
+	fake.entries["/etc/app.conf"].owner = fileOwner{uid: 33, gid: 33}
+	mtime := fake.entries["/etc/app.conf"].mtime
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	dir := lookupDir(t, root, "etc")
+	node, errno := dir.Lookup(ctx, "app.conf", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	check := func(path, action string) *fakeEntry {
+		t.Helper()
+		e, ok := fake.entries[path]
+		if !ok {
+			t.Fatalf("%s missing after %s", path, action)
+		}
+		if e.owner != (fileOwner{uid: 33, gid: 33}) {
+			t.Errorf("%s owned by %v after %s, expected 33:33", path, e.owner, action)
+		}
+		return e
+	}
+
+	// nothing written, e.g. opened by an editor and closed
+	fh, _, errno := f.Open(ctx, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatalf("Open() = %v", errno)
+	}
+	f.Flush(ctx, fh)
+	f.Release(ctx, fh)
+	if e := check("/etc/app.conf", "save"); !e.mtime.Equal(mtime) {
+		t.Errorf("mtime %v after save without writes, expected %v", e.mtime, mtime)
+	}
+
+	fh, _, _ = f.Open(ctx, syscall.O_WRONLY|syscall.O_TRUNC)
+	f.Write(ctx, fh, []byte("new"), 0)
+	f.Flush(ctx, fh)
+	f.Release(ctx, fh)
+	if e := check("/etc/app.conf", "write"); e.mtime.Equal(mtime) {
+		t.Errorf("mtime kept after write")
+	}
+
+	in := &fuse.SetAttrIn{}
+	in.Valid, in.Mode = fuse.FATTR_MODE, 0600
+	if errno := f.Setattr(ctx, nil, in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatalf("Setattr(mode) = %v", errno)
+	}
+	check("/etc/app.conf", "chmod")
+
+	if errno := dir.Rename(ctx, "app.conf", dir, "app.conf.bak", 0); errno != 0 {
+		t.Fatalf("Rename() = %v", errno)
+	}
+	check("/etc/app.conf.bak", "rename")
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	fake := newFakeDocker().addFile("/var/log/big.log", "lines\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, lookupDir(t, root, "var"), "log").Lookup(ctx, "big.log", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	fake.fileGate = make(chan struct{})
+
+	const readers = 3
+	opened := make(chan syscall.Errno, readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			_, _, errno := f.Open(ctx, syscall.O_RDONLY)
+			opened <- errno
+		}()
+	}
+	// let all readers wait for the first download
+	time.Sleep(50 * time.Millisecond)
+	close(fake.fileGate)
+
+	for i := 0; i < readers; i++ {
+		if errno := <-opened; errno != 0 {
+			t.Fatalf("Open() = %v", errno)
+		}
+	}
+	defer func() {
+		for i := 0; i < readers; i++ {
+			f.Release(ctx, nil)
+		}
+	}()
+	if n := fake.count("GetFile"); n != 1 {
+		t.Errorf("GetFile called %d times, expected 1", n)
+	}
+	res, _ := f.Read(ctx, nil, make([]byte, 100), 0)
+	if data, _ := res.Bytes(nil); string(data) != "lines\n" {
+		t.Errorf("read %q, expected %q", data, "lines\n")
+	}
+
+	// content is reused while the file is open
+	if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != 0 {
+		t.Fatalf("Open() = %v", errno)
+	}
+	f.Release(ctx, nil)
+	if n := fake.count("GetFile"); n != 1 {
+		t.Errorf("GetFile called %d times while the file is open, expected 1", n)
+	}
+}
+
+func TestReopenWhileOpen(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "motd", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	read := func(fh fs.FileHandle) string {
+		t.Helper()
+		res, errno := f.Read(ctx, fh, make([]byte, 100), 0)
+		if errno != 0 {
+			t.Fatalf("Read() = %v", errno)
+		}
+		data, _ := res.Bytes(nil)
+		return string(data)
+	}
+
+	writer, _, _ := f.Open(ctx, syscall.O_WRONLY)
+	defer f.Release(ctx, writer)
+	reader, _, _ := f.Open(ctx, syscall.O_RDONLY)
+	f.Flush(ctx, reader)
+	f.Release(ctx, reader)
+
+	reader, _, errno = f.Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open() = %v", errno)
+	}
+	defer f.Release(ctx, reader)
+	if got := read(reader); got != "hello\n" {
+		t.Errorf("read %q after another handle was closed, expected %q", got, "hello\n")
+	}
+}
+
+func TestWriteAfterReaderClosed(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "motd", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+
+	writer, _, _ := f.Open(ctx, syscall.O_RDWR)
+	reader, _, _ := f.Open(ctx, syscall.O_RDONLY)
+	if _, errno := f.Write(ctx, reader, []byte("x"), 0); errno != syscall.EBADF {
+		t.Errorf("Write() through read-only handle = %v, expected EBADF", errno)
+	}
+	f.Write(ctx, writer, []byte("HE"), 0)
+	f.Flush(ctx, reader)
+	f.Release(ctx, reader)
+
+	if _, errno := f.Write(ctx, writer, []byte("LLO"), 2); errno != 0 {
+		t.Fatalf("Write() after reader was closed = %v", errno)
+	}
+	if errno := f.Flush(ctx, writer); errno != 0 {
+		t.Fatalf("Flush() = %v", errno)
+	}
+	f.Release(ctx, writer)
+	if saved := string(fake.entries["/etc/motd"].data); saved != "HELLO\n" {
+		t.Errorf("saved %q, expected %q", saved, "HELLO\n")
+	}
+	if n := fake.count("SaveFile"); n != 1 {
+		t.Errorf("SaveFile called %d times, expected 1", n)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello world\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "motd", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	saved := func() string {
+		return string(fake.entries["/etc/motd"].data)
+	}
+	truncate := func(size uint64) {
+		t.Helper()
+		var in fuse.SetAttrIn
+		in.Valid, in.Size = fuse.FATTR_SIZE, size
+		if errno := f.Setattr(ctx, nil, &in, &fuse.AttrOut{}); errno != 0 {
+			t.Fatalf("Setattr() = %v", errno)
+		}
+	}
+
+	// editor rewrites the file with shorter content
+	fh, _, _ := f.Open(ctx, syscall.O_WRONLY)
+	truncate(0)
+	f.Write(ctx, fh, []byte("hi"), 0)
+	f.Write(ctx, fh, []byte("!\n"), 2)
+	f.Flush(ctx, fh)
+	f.Release(ctx, fh)
+	if saved() != "hi!\n" {
+		t.Errorf("saved %q, expected %q", saved(), "hi!\n")
+	}
+
+	// extended part is zeroed, not the old content
+	truncate(1)
+	truncate(4)
+	if saved() != "h\x00\x00\x00" {
+		t.Errorf("saved %q, expected %q", saved(), "h\x00\x00\x00")
+	}
+
+	// ftruncate of file open for reading keeps it readable
+	f.Open(ctx, syscall.O_RDONLY)
+	truncate(2)
+	res, _ := f.Read(ctx, nil, make([]byte, 100), 0)
+	data, _ := res.Bytes(nil)
+	f.Release(ctx, nil)
+	if string(data) != "h\x00" || saved() != "h\x00" {
+		t.Errorf("read %q, saved %q, expected %q", data, saved(), "h\x00")
+	}
+
+	// changed in container after the file was read
+	fake.entries["/etc/motd"].data = []byte("changed\n")
+	truncate(3)
+	if saved() != "cha" {
+		t.Errorf("saved %q, expected %q", saved(), "cha")
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	mng, root := newTestMng(t, fake, Options{FileCache: true})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "motd", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	read := func() string {
+		t.Helper()
+		if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != 0 {
+			t.Fatalf("Open() = %v", errno)
+		}
+		defer f.Release(ctx, nil)
+		res, _ := f.Read(ctx, nil, make([]byte, 100), 0)
+		data, _ := res.Bytes(nil)
+		return string(data)
+	}
+
+	read()
+	if got := read(); got != "hello\n" {
+		t.Errorf("read %q from cache, expected %q", got, "hello\n")
+	}
+	if n := fake.count("GetFile"); n != 1 {
+		t.Errorf("GetFile called %d times, expected 1", n)
+	}
+
+	// changed with the same size and mtime, docker diff reports it
+	fake.entries["/etc/motd"].data = []byte("HELLO\n")
+	fake.change(FileModified, "/etc/motd")
+	if err := mng.updateFsChanges(); err != nil {
+		t.Fatalf("updateFsChanges() failed: %v", err)
+	}
+	if got := read(); got != "HELLO\n" {
+		t.Errorf("read %q, expected modified content", got)
+	}
+
+	// changed again, stat tells
+	fake.entries["/etc/motd"].data = []byte("bye\n")
+	if got := read(); got != "bye\n" {
+		t.Errorf("read %q, expected modified content", got)
+	}
+	if n := fake.count("GetFile"); n != 3 {
+		t.Errorf("GetFile called %d times, expected 3", n)
+	}
+}
+
+func TestRemoveCache(t *testing.T) {
+	dir, err := fileCacheDir("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := func(opts Options, otherPid int) bool {
+		t.Helper()
+		fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+		mng, _ := newTestMng(t, fake, opts)
+		if otherPid != 0 {
+			// the same container mounted by another process
+			users, _ := cacheUsersDir("fake")
+			ioutil.WriteFile(filepath.Join(users, strconv.Itoa(otherPid)), nil, 0600)
+		}
+		data, err := mng.ReadFile(context.Background(), "/etc/motd")
+		if err != nil {
+			t.Fatalf("ReadFile() failed: %v", err)
+		}
+		mng.cacheFile("/etc/motd", &types.ContainerPathStat{Size: int64(len(data))}, data)
+		mng.RemoveCache()
+		_, err = os.Stat(dir)
+		return err == nil
+	}
+
+	if cached(Options{FileCache: true}, 0) {
+		t.Errorf("cache is kept on unmount")
+	}
+	if !cached(Options{FileCache: true, KeepCache: true}, 0) {
+		t.Errorf("cache is removed with KeepCache")
+	}
+	os.RemoveAll(dir)
+	if !cached(Options{FileCache: true}, os.Getppid()) {
+		t.Errorf("cache is removed while another process uses it")
+	}
+	// the other process is gone
+	users, _ := cacheUsersDir("fake")
+	os.RemoveAll(users)
+	if cached(Options{FileCache: true}, math.MaxInt32) {
+		t.Errorf("cache is kept for a process which is gone")
+	}
+}
+
+func TestGetattrCachesStat(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "etc").Lookup(ctx, "motd", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	getattr := func() *fuse.AttrOut {
+		t.Helper()
+		var out fuse.AttrOut
+		if errno := f.Getattr(ctx, nil, &out); errno != 0 {
+			t.Fatalf("Getattr() = %v", errno)
+		}
+		return &out
+	}
+
+	before := fake.count("GetPathAttrs")
+	for i := 0; i < 10; i++ {
+		if out := getattr(); out.Size != 6 || out.Mode&07777 != 0644 || out.Mtime != 1600000000 {
+			t.Errorf("Getattr() = size %d, mode %o, mtime %d", out.Size, out.Mode&07777, out.Mtime)
+		}
+	}
+	if n := fake.count("GetPathAttrs") - before; n != 0 {
+		t.Errorf("GetPathAttrs called %d times, expected stat cached by Lookup to be used", n)
+	}
+
+	// content being written
+	fh, _, _ := f.Open(ctx, syscall.O_WRONLY|syscall.O_TRUNC)
+	f.Write(ctx, fh, []byte("hi\n"), 0)
+	if out := getattr(); out.Size != 3 {
+		t.Errorf("Getattr() size = %d while writing, expected 3", out.Size)
+	}
+	f.Flush(ctx, fh)
+	f.Release(ctx, fh)
+
+	before = fake.count("GetPathAttrs")
+	if out := getattr(); out.Size != 3 {
+		t.Errorf("Getattr() size = %d after save, expected 3", out.Size)
+	}
+	if n := fake.count("GetPathAttrs") - before; n != 1 {
+		t.Errorf("GetPathAttrs called %d times after save, expected 1", n)
+	}
+}
+
+func TestChmod(t *testing.T) {
+	fake := newFakeDocker().addFile("/usr/bin/run.sh", "#!/bin/sh\n")
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	dir := lookupDir(t, root, "usr", "bin")
+	node, errno := dir.Lookup(ctx, "run.sh", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+
+	var in fuse.SetAttrIn
+	in.Valid, in.Mode = fuse.FATTR_MODE, 04755
+	var out fuse.AttrOut
+	if errno := f.Setattr(ctx, nil, &in, &out); errno != 0 {
+		t.Fatalf("Setattr() = %v", errno)
+	}
+	if out.Mode&07777 != 04755 {
+		t.Errorf("Setattr() mode = %o, expected 4755", out.Mode&07777)
+	}
+	e := fake.entries["/usr/bin/run.sh"]
+	if e.mode != os.ModeSetuid|0755 || string(e.data) != "#!/bin/sh\n" || !e.mtime.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("saved %+v, expected new mode with content and mtime kept", e)
+	}
+
+	in.Mode = 0700
+	if errno := dir.Setattr(ctx, nil, &in, &out); errno != 0 {
+		t.Fatalf("Dir.Setattr() = %v", errno)
+	}
+	if out.Mode&07777 != 0700 || fake.entries["/usr/bin"].mode != os.ModeDir|0700 {
+		t.Errorf("directory mode = %o (%v in container), expected 0700", out.Mode&07777, fake.entries["/usr/bin"].mode)
+	}
+}
+
+func TestStreamRead(t *testing.T) {
+	defer func(size int64) { streamMinSize = size }(streamMinSize)
+	streamMinSize = 10
+	content := strings.Repeat("0123456789", 3*streamWindow/10)
+	fake := newFakeDocker().addFile("/var/log/big.log", content)
+	_, root := newTestMng(t, fake, Options{})
+	ctx := context.Background()
+	node, errno := lookupDir(t, root, "var", "log").Lookup(ctx, "big.log", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	read := func(off int64, size int) string {
+		t.Helper()
+		res, errno := f.Read(ctx, nil, make([]byte, size), off)
+		if errno != 0 {
+			t.Fatalf("Read(%d) = %v", off, errno)
+		}
+		data, _ := res.Bytes(nil)
+		return string(data)
+	}
+
+	f.Open(ctx, syscall.O_RDONLY)
+	if f.data != nil {
+		t.Errorf("content is loaded on open")
+	}
+	// sequential reads, some slightly reordered
+	var got strings.Builder
+	for off := 0; off < len(content); off += 2 * 4096 {
+		got.WriteString(read(int64(off+4096), 4096))
+		got.WriteString(read(int64(off), 4096))
+	}
+	if got.Len() != len(content) {
+		t.Errorf("read %d bytes, expected %d", got.Len(), len(content))
+	}
+	if s := read(int64(len(content)-5), 100); s != "56789" {
+		t.Errorf("read %q at the end", s)
+	}
+	if f.data != nil || len(f.stream.buf) > streamWindow {
+		t.Errorf("%d bytes are kept while streaming", len(f.stream.buf)+len(f.data))
+	}
+
+	// random access loads the whole file
+	if s := read(10, 5); s != "01234" {
+		t.Errorf("read %q at offset 10", s)
+	}
+	if len(f.data) != len(content) || f.stream != nil {
+		t.Errorf("content is not loaded on random access")
+	}
+	if n := fake.count("GetFile"); n != 2 {
+		t.Errorf("GetFile called %d times, expected 2", n)
+	}
+	f.Release(ctx, nil)
+}
+
+// bigFileDocker serves a file of zeroes without keeping it in memory.
+type bigFileDocker struct {
+	*fakeDocker
+	path string
+	size int64
+}
+
+func (d *bigFileDocker) GetPathAttrs(ctx context.Context, path string) (types.ContainerPathStat, error) {
+	if path != d.path {
+		return d.fakeDocker.GetPathAttrs(ctx, path)
+	}
+	return types.ContainerPathStat{Name: filepath.Base(path), Size: d.size, Mode: 0644}, nil
+}
+
+func (d *bigFileDocker) GetFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	if path != d.path {
+		return d.fakeDocker.GetFile(ctx, path)
+	}
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		err := tw.WriteHeader(&tar.Header{Name: filepath.Base(path), Mode: 0644, Size: d.size})
+		if err == nil {
+			_, err = io.CopyN(tw, zeroes{}, d.size)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+type zeroes struct{}
+
+func (zeroes) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Reads 1GB file sequentially, reporting peak heap in use.
+func BenchmarkStreamRead(b *testing.B) {
+	const size = 1 << 30
+	fake := &bigFileDocker{fakeDocker: newFakeDocker().addDir("/var/log"), path: "/var/log/big.log", size: size}
+	mng := NewMng("fake", nil, Options{})
+	mng.docker = fake
+	if err := mng.Init(); err != nil {
+		b.Fatalf("Init() failed: %v", err)
+	}
+	f := &File{mng: mng, fullpath: fake.path}
+	ctx := context.Background()
+	dest := make([]byte, 128<<10)
+	var peak uint64
+	var stats runtime.MemStats
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != 0 {
+			b.Fatalf("Open() = %v", errno)
+		}
+		for off := int64(0); off < size; off += int64(len(dest)) {
+			if _, errno := f.Read(ctx, nil, dest, off); errno != 0 {
+				b.Fatalf("Read(%d) = %v", off, errno)
+			}
+			if off%(64<<20) == 0 {
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peak {
+					peak = stats.HeapInuse
+				}
+			}
+		}
+		f.Release(ctx, nil)
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+}
@@ -1,28 +1,184 @@
 package dockerfs
 
-import "sync"
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Inode numbers are derived from paths, so a path gets the same number in
+// every session and tools caching files by inode aren't confused by remounts.
+// The number is FNV-1a hash of the path, prefixed by the key of the table if
+// it's one of several container tables. If the hash is 0 or 1 (the root), or
+// is taken by another path or by a removed file the kernel still references,
+// the number is taken from a fallback sequence, stable within session only.
+
+// Sweep forgotten entries once the table has grown past this size.
+const minInoSweep = 1024
+
+// node is the part of fs.Inode needed to tell if the kernel still references it.
+type node interface {
+	Forgotten() bool
+}
+
+// inoSpace is the range of numbers shared by tables of several containers,
+// so their nodes never share a number.
+type inoSpace struct {
+	// path with table key by number allocated to it
+	owners map[uint64]string
+	// nodes of numbers released by Forget, kept until the kernel forgets them
+	released map[uint64]node
+	// next number of the fallback sequence
+	next  uint64
+	mutex sync.Mutex
+}
 
 type Ino struct {
+	space *inoSpace
+	// prefix of paths hashed, tells tables sharing the space apart
+	key    string
 	inodes map[string]uint64
-	mutex  sync.Mutex
+	// nodes handed to the kernel, by path
+	nodes   map[string]node
+	sweepAt int
 }
 
 func NewIno() *Ino {
+	return newIno(&inoSpace{
+		owners:   make(map[uint64]string),
+		released: make(map[uint64]node),
+		// fallback numbers start from 2, 1 is the root
+		next: 2,
+	}, "")
+}
+
+func newIno(space *inoSpace, key string) *Ino {
 	return &Ino{
-		inodes: make(map[string]uint64),
+		space:   space,
+		key:     key,
+		inodes:  make(map[string]uint64),
+		nodes:   make(map[string]node),
+		sweepAt: minInoSweep,
 	}
 }
 
+// Sibling returns an empty table allocating numbers from the same space, so
+// nodes of different containers served by one mount never share a number.
+// Paths of the table are hashed with key, e.g. container ID.
+func (i *Ino) Sibling(key string) *Ino {
+	return newIno(i.space, key+"\x00")
+}
+
+// inoHash returns FNV-1a hash of key and path.
+func inoHash(key, path string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte(path))
+	return h.Sum64()
+}
+
 func (i *Ino) Inode(path string) uint64 {
-	i.mutex.Lock()
-	defer i.mutex.Unlock()
+	i.space.mutex.Lock()
+	defer i.space.mutex.Unlock()
 
 	if value, ok := i.inodes[path]; ok {
 		return value
 	}
 
-	// generate inode starting from 2
-	n := uint64(len(i.inodes)) + 2
+	if len(i.inodes) >= i.sweepAt {
+		i.sweep()
+		i.sweepAt = 2 * len(i.inodes)
+		if i.sweepAt < minInoSweep {
+			i.sweepAt = minInoSweep
+		}
+	}
+
+	n := inoHash(i.key, path)
+	for _, taken := i.space.owners[n]; taken || n < 2; _, taken = i.space.owners[n] {
+		n = i.space.next
+		i.space.next++
+	}
+	i.space.owners[n] = i.key + path
 	i.inodes[path] = n
 	return n
 }
+
+// Track remembers the node returned to the kernel for path, so the mapping
+// is kept as long as the kernel references it.
+func (i *Ino) Track(path string, n node) {
+	i.space.mutex.Lock()
+	defer i.space.mutex.Unlock()
+	i.nodes[path] = n
+}
+
+// Forget releases the mapping of path. If the kernel still references its
+// node, e.g. a removed file is open, the number stays taken and the next Inode
+// call for the path gets a fallback number.
+func (i *Ino) Forget(path string) {
+	i.space.mutex.Lock()
+	defer i.space.mutex.Unlock()
+	i.forget(path)
+}
+
+func (i *Ino) forget(path string) {
+	n, ok := i.inodes[path]
+	if !ok {
+		return
+	}
+	if node, ok := i.nodes[path]; ok && !node.Forgotten() {
+		i.space.released[n] = node
+	} else {
+		delete(i.space.owners, n)
+	}
+	delete(i.inodes, path)
+	delete(i.nodes, path)
+}
+
+// Rename moves mapping of oldPath to newPath, so a renamed node keeps its number.
+func (i *Ino) Rename(oldPath, newPath string) {
+	i.space.mutex.Lock()
+	defer i.space.mutex.Unlock()
+	i.forget(newPath)
+	if value, ok := i.inodes[oldPath]; ok {
+		i.inodes[newPath] = value
+		i.space.owners[value] = i.key + newPath
+		delete(i.inodes, oldPath)
+	}
+	if n, ok := i.nodes[oldPath]; ok {
+		i.nodes[newPath] = n
+		delete(i.nodes, oldPath)
+	}
+}
+
+// Sweep releases mappings of paths whose nodes were forgotten by the kernel
+// (or were only listed and never looked up). Returns the number of released paths.
+func (i *Ino) Sweep() int {
+	i.space.mutex.Lock()
+	defer i.space.mutex.Unlock()
+	return i.sweep()
+}
+
+func (i *Ino) sweep() int {
+	released := 0
+	for path, n := range i.inodes {
+		if node, ok := i.nodes[path]; ok && !node.Forgotten() {
+			continue
+		}
+		delete(i.inodes, path)
+		delete(i.nodes, path)
+		delete(i.space.owners, n)
+		released++
+	}
+	for n, node := range i.space.released {
+		if node.Forgotten() {
+			delete(i.space.released, n)
+			delete(i.space.owners, n)
+		}
+	}
+	return released
+}
+
+func (i *Ino) Len() int {
+	i.space.mutex.Lock()
+	defer i.space.mutex.Unlock()
+	return len(i.inodes)
+}
@@ -0,0 +1,94 @@
+package dockerfs
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeNode struct {
+	forgotten bool
+}
+
+func (n *fakeNode) Forgotten() bool {
+	return n.forgotten
+}
+
+func TestInoForget(t *testing.T) {
+	ino := NewIno()
+
+	live := &fakeNode{}
+	dropped := &fakeNode{}
+	liveIno := ino.Inode("/live")
+	droppedIno := ino.Inode("/dropped")
+	ino.Inode("/listed")
+	ino.Track("/live", live)
+	ino.Track("/dropped", dropped)
+
+	// kernel sends FORGET for /dropped
+	dropped.forgotten = true
+	if released := ino.Sweep(); released != 2 {
+		t.Errorf("Sweep() released %d paths, expected 2", released)
+	}
+	if ino.Len() != 1 {
+		t.Errorf("Len() = %d, expected 1", ino.Len())
+	}
+	if got := ino.Inode("/live"); got != liveIno {
+		t.Errorf("Inode(/live) = %d, expected stable %d", got, liveIno)
+	}
+	// the number isn't referenced anymore, so the path gets it again
+	if got := ino.Inode("/dropped"); got != droppedIno {
+		t.Errorf("Inode(/dropped) = %d, expected stable %d", got, droppedIno)
+	}
+
+	// removed, but still referenced by kernel
+	ino.Forget("/live")
+	if got := ino.Inode("/live"); got == liveIno {
+		t.Errorf("Inode(/live) = %d after Forget, expected a fresh number", got)
+	}
+}
+
+func TestInoStable(t *testing.T) {
+	ino := NewIno()
+	n := ino.Inode("/etc/hosts")
+	if n != inoHash("", "/etc/hosts") {
+		t.Errorf("Inode(/etc/hosts) = %d, expected hash of the path", n)
+	}
+	if got := NewIno().Inode("/etc/hosts"); got != n {
+		t.Errorf("Inode(/etc/hosts) = %d in another session, expected %d", got, n)
+	}
+
+	// containers sharing a mount get different numbers for the same path
+	web, db := ino.Sibling("web"), ino.Sibling("db")
+	if a, b := web.Inode("/etc/hosts"), db.Inode("/etc/hosts"); a == b || a == n || b == n {
+		t.Errorf("Inode(/etc/hosts) = %d, %d, %d in sibling tables, expected different numbers", n, a, b)
+	}
+	if got := ino.Sibling("web").Inode("/etc/hosts"); got == web.Inode("/etc/hosts") {
+		t.Errorf("Inode(/etc/hosts) = %d in a second table of the same key, expected a fallback number", got)
+	}
+
+	// a hash taken by another path
+	ino.space.owners[inoHash("", "/etc/motd")] = "/collision"
+	if got := ino.Inode("/etc/motd"); got == inoHash("", "/etc/motd") || got < 2 {
+		t.Errorf("Inode(/etc/motd) = %d, expected a fallback number", got)
+	}
+}
+
+func TestInoBounded(t *testing.T) {
+	ino := NewIno()
+	keep := &fakeNode{}
+	keepIno := ino.Inode("/keep")
+	ino.Track("/keep", keep)
+
+	// simulate `find /mount`: every entry is looked up and later forgotten
+	for i := 0; i < 100*minInoSweep; i++ {
+		path := fmt.Sprintf("/dir/file%d", i)
+		ino.Inode(path)
+		ino.Track(path, &fakeNode{forgotten: true})
+	}
+	if ino.Len() > 2*minInoSweep {
+		t.Errorf("Len() = %d, expected at most %d", ino.Len(), 2*minInoSweep)
+	}
+	if got := ino.Inode("/keep"); got != keepIno {
+		t.Errorf("Inode(/keep) = %d, expected stable %d", got, keepIno)
+	}
+}
@@ -0,0 +1,413 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/plesk/docker-fs/lib/log"
+)
+
+// FS of image as of one of its layers is made by applying layers in order,
+// the way overlay storage does: a ".wh.<name>" entry removes name of lower
+// layers and ".wh..wh..opq" hides all lower content of its directory.
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Returned on attempts to modify FS of image layers.
+var errLayersReadOnly = errors.New("image layers are read-only")
+
+// ServeLayer makes m serve FS of image as of its layer with digest (a diff
+// ID, as 'docker image inspect' lists them, or its unique prefix) instead
+// of content of the container, which must be created from image. Layers are
+// flattened into a temporary archive, remove deletes it once m is done.
+func (m *Mng) ServeLayer(ctx context.Context, image, digest string) (remove func(), err error) {
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+	cli, err := m.clients.Client()
+	if err != nil {
+		return nil, err
+	}
+	info, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := layersUpTo(info.RootFS.Layers, digest)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "dockerfs-layers-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	log.Printf("[debug] Saving %d layers of image %v...", len(layers), image)
+	paths, err := saveLayers(ctx, cli, image, layers, dir)
+	if err != nil {
+		return nil, err
+	}
+	archive := filepath.Join(dir, "flat.tar")
+	entries, err := flattenLayers(paths, archive)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	m.docker = newLayerMng(m.docker, archive, entries)
+	return func() { os.RemoveAll(dir) }, nil
+}
+
+// layersUpTo returns diff IDs of layers up to and including the one with
+// digest.
+func layersUpTo(layers []string, digest string) ([]string, error) {
+	prefix := strings.TrimPrefix(digest, "sha256:")
+	found := -1
+	for i, layer := range layers {
+		if !strings.HasPrefix(strings.TrimPrefix(layer, "sha256:"), prefix) {
+			continue
+		}
+		if found >= 0 && layers[found] != layer {
+			return nil, fmt.Errorf("layer digest %s is ambiguous", digest)
+		}
+		if found < 0 {
+			found = i
+		}
+	}
+	if prefix == "" || found < 0 {
+		return nil, fmt.Errorf("image has no layer %s", digest)
+	}
+	return layers[:found+1], nil
+}
+
+// saveLayers stores uncompressed layers of image with diff IDs of layers
+// in dir, returning their paths in the same order.
+func saveLayers(ctx context.Context, cli client.APIClient, image string, layers []string, dir string) ([]string, error) {
+	body, err := cli.ImageSave(ctx, []string{image})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	wanted := make(map[string]bool)
+	for _, layer := range layers {
+		wanted[layer] = true
+	}
+	saved := make(map[string]string)
+	tr := tar.NewReader(body)
+	for n := 0; ; n++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("broken image archive: %w", err)
+		}
+		// layers of docker format, or blobs of OCI one, which are told apart
+		// from configs by their digest only
+		if hdr.Typeflag != tar.TypeReg || !(strings.HasSuffix(hdr.Name, "/layer.tar") || strings.HasPrefix(hdr.Name, "blobs/")) {
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf("layer%d.tar", n))
+		digest, err := saveLayer(tr, path)
+		if err != nil {
+			return nil, err
+		}
+		if wanted[digest] && saved[digest] == "" {
+			saved[digest] = path
+		} else {
+			os.Remove(path)
+		}
+	}
+	paths := make([]string, len(layers))
+	for i, layer := range layers {
+		if paths[i] = saved[layer]; paths[i] == "" {
+			return nil, fmt.Errorf("layer %s is missing in image archive", layer)
+		}
+	}
+	return paths, nil
+}
+
+// saveLayer writes layer uncompressed to path and returns its diff ID.
+func saveLayer(r io.Reader, path string) (string, error) {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		src = gz
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// layerEntry is an entry of layer archive.
+type layerEntry struct {
+	hdr *tar.Header
+	// offset of content in archive
+	offset int64
+	// index of layer it comes from
+	layer int
+}
+
+// flattenLayers applies layer archives at paths in order and writes the
+// resulting FS to archive, as container export would have it. Entries of
+// archive are returned by path.
+func flattenLayers(paths []string, archive string) (map[string]*layerEntry, error) {
+	merged := make(map[string]*layerEntry)
+	// entries keep their place in archive, so parents come before children
+	var order []string
+	listed := make(map[string]bool)
+	for i, path := range paths {
+		if err := applyLayer(merged, path, i, func(path string) {
+			if !listed[path] {
+				listed[path] = true
+				order = append(order, path)
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	layers := make([]*os.File, len(paths))
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		layers[i] = f
+	}
+	out, err := os.Create(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	bw := bufio.NewWriter(out)
+	cw := &countingWriter{w: bw}
+	tw := tar.NewWriter(cw)
+	entries := make(map[string]*layerEntry, len(merged))
+	for _, path := range order {
+		e, ok := merged[path]
+		if !ok {
+			continue
+		}
+		hdr := *e.hdr
+		hdr.Name = strings.TrimPrefix(path, "/")
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = strings.TrimPrefix(filepath.Join("/", hdr.Linkname), "/")
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return nil, err
+		}
+		offset := cw.n
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			if _, err := io.Copy(tw, io.NewSectionReader(layers[e.layer], e.offset, hdr.Size)); err != nil {
+				return nil, err
+			}
+		}
+		entries[path] = &layerEntry{hdr: &hdr, offset: offset}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	return entries, out.Close()
+}
+
+// applyLayer adds entries of layer archive at path with index layer to
+// merged, removing ones of lower layers it hides. Paths of added entries
+// are passed to add.
+func applyLayer(merged map[string]*layerEntry, path string, layer int, add func(path string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// os.File isn't passed as is, tar would seek over content then
+	r := &countingReader{r: f}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("broken layer archive: %w", err)
+		}
+		path := filepath.Join("/", hdr.Name)
+		if path == "/" {
+			continue
+		}
+		dir, name := filepath.Split(path)
+		switch {
+		case name == whiteoutOpaque:
+			hideLower(merged, filepath.Clean(dir), layer, false)
+		case strings.HasPrefix(name, whiteoutPrefix):
+			hideLower(merged, filepath.Join(dir, strings.TrimPrefix(name, whiteoutPrefix)), layer, true)
+		default:
+			if hdr.Typeflag != tar.TypeDir {
+				// replaced directory takes its content with it
+				hideLower(merged, path, layer, false)
+			}
+			merged[path] = &layerEntry{hdr: hdr, offset: r.n, layer: layer}
+			add(path)
+		}
+	}
+}
+
+// hideLower removes entries of layers below layer inside path, and path
+// itself if self is set.
+func hideLower(merged map[string]*layerEntry, path string, layer int, self bool) {
+	prefix := path + "/"
+	if path == "/" {
+		prefix = "/"
+	}
+	for p, e := range merged {
+		if e.layer < layer && (strings.HasPrefix(p, prefix) || self && p == path) {
+			delete(merged, p)
+		}
+	}
+}
+
+// countingWriter counts bytes written through it.
+type countingWriter struct {
+	n int64
+	w io.Writer
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// layerMng serves FS of image layers flattened into a local archive. Other
+// requests are passed to the container created from the image.
+type layerMng struct {
+	dockerMng
+	archive string
+	entries map[string]*layerEntry
+	// directories with entries, which may have none of their own
+	dirs map[string]bool
+}
+
+func newLayerMng(docker dockerMng, archive string, entries map[string]*layerEntry) *layerMng {
+	dirs := map[string]bool{"/": true}
+	for path := range entries {
+		for dir := filepath.Dir(path); !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	return &layerMng{dockerMng: docker, archive: archive, entries: entries, dirs: dirs}
+}
+
+// entry returns entry of path, hard links are resolved to their targets.
+func (l *layerMng) entry(path string) (*layerEntry, bool) {
+	e, ok := l.entries[filepath.Clean(path)]
+	if ok && e.hdr.Typeflag == tar.TypeLink {
+		e, ok = l.entries[filepath.Join("/", e.hdr.Linkname)]
+	}
+	return e, ok
+}
+
+func (l *layerMng) ContainerExport(ctx context.Context) (io.ReadCloser, error) {
+	return os.Open(l.archive)
+}
+
+func (l *layerMng) GetPathAttrs(ctx context.Context, path string) (types.ContainerPathStat, error) {
+	e, ok := l.entry(path)
+	if !ok {
+		if l.dirs[filepath.Clean(path)] {
+			return types.ContainerPathStat{Name: filepath.Base(path), Mode: os.ModeDir | 0755}, nil
+		}
+		return types.ContainerPathStat{}, fmt.Errorf("%w: %s", ErrorNotFound, path)
+	}
+	return types.ContainerPathStat{
+		Name:       filepath.Base(path),
+		Size:       e.hdr.Size,
+		Mode:       e.hdr.FileInfo().Mode(),
+		Mtime:      e.hdr.ModTime,
+		LinkTarget: e.hdr.Linkname,
+	}, nil
+}
+
+// Layers don't change.
+func (l *layerMng) GetFsChanges(ctx context.Context) ([]container.ContainerChangeResponseItem, error) {
+	return nil, nil
+}
+
+// GetFile returns archive of path, the way docker does.
+func (l *layerMng) GetFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	e, ok := l.entry(path)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorNotFound, path)
+	}
+	f, err := os.Open(l.archive)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer f.Close()
+		hdr := *e.hdr
+		hdr.Name = filepath.Base(path)
+		tw := tar.NewWriter(w)
+		err := tw.WriteHeader(&hdr)
+		if err == nil && hdr.Size > 0 && hdr.Typeflag != tar.TypeDir {
+			_, err = io.Copy(tw, io.NewSectionReader(f, e.offset, hdr.Size))
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+func (l *layerMng) SaveFile(ctx context.Context, path string, data []byte, stat *types.ContainerPathStat, owner *fileOwner) error {
+	return errLayersReadOnly
+}
+
+func (l *layerMng) MakeDir(ctx context.Context, path string, mode os.FileMode) error {
+	return errLayersReadOnly
+}
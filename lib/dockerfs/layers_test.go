@@ -0,0 +1,149 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeLayer writes layer archive of entries, regular files unless their
+// type is set, with content of Linkname.
+func writeLayer(t *testing.T, path string, entries []tar.Header) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, hdr := range entries {
+		hdr := hdr
+		content := ""
+		switch hdr.Typeflag {
+		case 0:
+			hdr.Typeflag, content, hdr.Linkname = tar.TypeReg, hdr.Linkname, ""
+			hdr.Size = int64(len(content))
+			hdr.Mode = 0644
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlattenLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-layers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layers := [][]tar.Header{
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir},
+			{Name: "etc/passwd", Linkname: "root"},
+			{Name: "etc/old", Linkname: "old"},
+			{Name: "var/cache/a", Linkname: "a"},
+			{Name: "var/cache/b", Linkname: "b"},
+			{Name: "bin/sh", Linkname: "sh"},
+			{Name: "bin/ash", Typeflag: tar.TypeLink, Linkname: "bin/sh"},
+			{Name: "opt/tool/bin/tool", Linkname: "tool"},
+		},
+		{
+			{Name: "etc/.wh.old"},
+			{Name: "var/cache/c", Linkname: "c"},
+			{Name: "var/cache/.wh..wh..opq"},
+			{Name: "etc/passwd", Linkname: "root\nuser"},
+			{Name: "opt/tool", Linkname: "replaced directory"},
+		},
+		{
+			{Name: "etc/new", Linkname: "new"},
+		},
+	}
+	var paths []string
+	for i, entries := range layers {
+		path := filepath.Join(dir, "layer"+string(rune('0'+i)))
+		writeLayer(t, path, entries)
+		paths = append(paths, path)
+	}
+
+	archive := filepath.Join(dir, "flat.tar")
+	entries, err := flattenLayers(paths[:2], archive)
+	if err != nil {
+		t.Fatalf("flattenLayers() failed: %v", err)
+	}
+	docker := newLayerMng(newFakeDocker(), archive, entries)
+
+	body, err := docker.ContainerExport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _, err := parseContainterContent(body, nil, nil, newPathFilter("", nil), false)
+	body.Close()
+	if err != nil {
+		t.Fatalf("parseContainterContent() failed: %v", err)
+	}
+	got := make(map[string]bool)
+	for path := range files {
+		got[path] = true
+	}
+	expected := map[string]bool{"/etc/passwd": true, "/var/cache/c": true, "/bin/sh": true, "/bin/ash": true, "/opt/tool": true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("flattened files %v, expected %v", got, expected)
+	}
+
+	for path, content := range map[string]string{
+		"/etc/passwd": "root\nuser",
+		"/bin/ash":    "sh",
+		"/opt/tool":   "replaced directory",
+	} {
+		data, err := getFileContent(context.Background(), docker, path)
+		if err != nil || string(data) != content {
+			t.Errorf("content of %s = %q, %v, expected %q", path, data, err, content)
+		}
+	}
+	if stat, err := docker.GetPathAttrs(context.Background(), "/var"); err != nil || !stat.Mode.IsDir() {
+		t.Errorf("GetPathAttrs(/var) = %v, %v, expected directory", stat, err)
+	}
+	if _, err := docker.GetPathAttrs(context.Background(), "/etc/old"); !errors.Is(err, ErrorNotFound) {
+		t.Errorf("GetPathAttrs(/etc/old) = %v, expected whiteout to remove it", err)
+	}
+}
+
+func TestLayersUpTo(t *testing.T) {
+	layers := []string{"sha256:aa11", "sha256:ab22", "sha256:ab22", "sha256:cc33"}
+	for _, tc := range []struct {
+		digest   string
+		expected int
+	}{
+		{"sha256:aa11", 1},
+		{"ab2", 2},
+		{"sha256:cc", 4},
+		{"a", -1},
+		{"dd", -1},
+		{"", -1},
+	} {
+		got, err := layersUpTo(layers, tc.digest)
+		if tc.expected < 0 {
+			if err == nil {
+				t.Errorf("layersUpTo(%q) = %v, expected error", tc.digest, got)
+			}
+			continue
+		}
+		if err != nil || len(got) != tc.expected {
+			t.Errorf("layersUpTo(%q) = %v, %v, expected %d layers", tc.digest, got, err, tc.expected)
+		}
+	}
+}
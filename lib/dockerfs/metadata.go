@@ -0,0 +1,164 @@
+package dockerfs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/plesk/docker-fs/lib/log"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Directory in the root of mount with container metadata. It's served
+// instead of the container directory of the same name, if there is one.
+const metaDirName = ".dockerfs"
+
+// Content of metadata files by name, taken from container inspect.
+var metaFiles = map[string]func(info *types.ContainerJSON) string{
+	"id": func(info *types.ContainerJSON) string {
+		return info.ID
+	},
+	"name": func(info *types.ContainerJSON) string {
+		return strings.TrimPrefix(info.Name, "/")
+	},
+	"image": func(info *types.ContainerJSON) string {
+		if info.Config == nil {
+			return info.Image
+		}
+		return info.Config.Image
+	},
+	"created": func(info *types.ContainerJSON) string {
+		return info.Created
+	},
+	"state": func(info *types.ContainerJSON) string {
+		if info.State == nil {
+			return ""
+		}
+		return info.State.Status
+	},
+	"hostname": func(info *types.ContainerJSON) string {
+		if info.Config == nil {
+			return ""
+		}
+		return info.Config.Hostname
+	},
+	"env": func(info *types.ContainerJSON) string {
+		if info.Config == nil {
+			return ""
+		}
+		// one KEY=VALUE per line
+		return strings.Join(info.Config.Env, "\n")
+	},
+	"cmd": func(info *types.ContainerJSON) string {
+		if info.Config == nil {
+			return ""
+		}
+		args := append([]string(nil), info.Config.Entrypoint...)
+		return strings.Join(append(args, info.Config.Cmd...), " ")
+	},
+}
+
+var _ = (fs.NodeGetattrer)((*metaDir)(nil))
+var _ = (fs.NodeLookuper)((*metaDir)(nil))
+var _ = (fs.NodeReaddirer)((*metaDir)(nil))
+
+// metaDir lists metadata files, it never touches container FS.
+type metaDir struct {
+	fs.Inode
+	mng *Mng
+}
+
+func (d *metaDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.mng.setDirAttr(&out.Attr, 0555)
+	return 0
+}
+
+func (d *metaDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if _, ok := metaFiles[name]; !ok {
+		return nil, syscall.ENOENT
+	}
+	f := &metaFile{mng: d.mng, name: name}
+	data, errno := f.content(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	f.setAttr(&out.Attr, len(data))
+	ino := d.mng.inodes.Inode("/" + metaDirName + "/" + name)
+	return d.NewInode(ctx, f, fs.StableAttr{Mode: fuse.S_IFREG, Ino: ino}), 0
+}
+
+func (d *metaDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	var list []fuse.DirEntry
+	for name := range metaFiles {
+		list = append(list, fuse.DirEntry{
+			Mode: fuse.S_IFREG,
+			Name: name,
+			Ino:  d.mng.inodes.Inode("/" + metaDirName + "/" + name),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return fs.NewListDirStream(list), 0
+}
+
+var _ = (fs.NodeGetattrer)((*metaFile)(nil))
+var _ = (fs.NodeOpener)((*metaFile)(nil))
+var _ = (fs.NodeReader)((*metaFile)(nil))
+
+// metaFile is a read-only file of metadata. Its content is taken from
+// container inspect on open, so e.g. state is up to date.
+type metaFile struct {
+	fs.Inode
+	mng  *Mng
+	name string
+}
+
+// content returns the metadata line of the file.
+func (f *metaFile) content(ctx context.Context) ([]byte, syscall.Errno) {
+	info, err := f.mng.docker.Inspect(ctx)
+	if err != nil {
+		log.Printf("[error] Failed to inspect container: %v", err)
+		return nil, dockerErrno(err)
+	}
+	if info.ContainerJSONBase == nil {
+		return nil, syscall.EIO
+	}
+	return []byte(metaFiles[f.name](&info) + "\n"), 0
+}
+
+func (f *metaFile) setAttr(out *fuse.Attr, size int) {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Owner.Uid, out.Owner.Gid = f.mng.uid, f.mng.gid
+	out.Size = uint64(size)
+	now := time.Now()
+	out.SetTimes(nil, &now, nil)
+}
+
+func (f *metaFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	data, errno := f.content(ctx)
+	if errno != 0 {
+		return errno
+	}
+	f.setAttr(&out.Attr, len(data))
+	return 0
+}
+
+func (f *metaFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	data, errno := f.content(ctx)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	// size may differ from what Getattr reported
+	return &fs.MemRegularFile{Data: data}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (f *metaFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return fh.(*fs.MemRegularFile).Read(ctx, nil, dest, off)
+}
@@ -0,0 +1,80 @@
+package dockerfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestMetaDir(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/hosts", "localhost")
+	_, root := newTestMng(t, fake, Options{})
+
+	if mode, ok := readdir(t, root)[metaDirName]; !ok || mode != fuse.S_IFDIR {
+		t.Fatalf("%s listed with mode %o (listed: %v), expected directory", metaDirName, mode, ok)
+	}
+	node, errno := root.Lookup(context.Background(), metaDirName, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup(%s) = %v", metaDirName, errno)
+	}
+	meta := node.Operations().(*metaDir)
+	ds, errno := meta.Readdir(context.Background())
+	if errno != 0 {
+		t.Fatalf("Readdir() = %v", errno)
+	}
+	listed := 0
+	for ; ds.HasNext(); listed++ {
+		ds.Next()
+	}
+	if listed != len(metaFiles) {
+		t.Errorf("%d files listed, expected %d", listed, len(metaFiles))
+	}
+
+	read := func(name string) string {
+		t.Helper()
+		node, errno := meta.Lookup(context.Background(), name, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%s) = %v", name, errno)
+		}
+		f := node.Operations().(*metaFile)
+		fh, _, errno := f.Open(context.Background(), syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatalf("Open(%s) = %v", name, errno)
+		}
+		res, errno := f.Read(context.Background(), fh, make([]byte, 256), 0)
+		if errno != 0 {
+			t.Fatalf("Read(%s) = %v", name, errno)
+		}
+		data, _ := res.Bytes(nil)
+		return string(data)
+	}
+	for name, expected := range map[string]string{
+		"id":      "fake\n",
+		"name":    "fake\n",
+		"image":   "fake:latest\n",
+		"created": "2020-09-13T12:26:40Z\n",
+		"state":   "running\n",
+		"cmd":     "sleep infinity\n",
+		"env":     "PATH=/usr/bin:/bin\nLANG=C.UTF-8\n",
+	} {
+		if content := read(name); content != expected {
+			t.Errorf("%s has %q, expected %q", name, content, expected)
+		}
+	}
+
+	// content is taken on open
+	fake.stopped = true
+	if content := read("state"); content != "exited\n" {
+		t.Errorf("state has %q after stop, expected exited", content)
+	}
+
+	node, _ = meta.Lookup(context.Background(), "id", &fuse.EntryOut{})
+	if _, _, errno := node.Operations().(*metaFile).Open(context.Background(), syscall.O_WRONLY); errno != syscall.EROFS {
+		t.Errorf("Open(id, O_WRONLY) = %v, expected EROFS", errno)
+	}
+	if _, errno := meta.Lookup(context.Background(), "missing", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("Lookup(missing) = %v, expected ENOENT", errno)
+	}
+}
@@ -2,119 +2,715 @@ package dockerfs
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/plesk/docker-fs/lib/log"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// Options tune how a container FS is fetched and served.
+type Options struct {
+	// Reject all modifications with EROFS
+	ReadOnly bool
+
+	// Number of attempts to export and parse container content
+	RetryExport int
+
+	// Defer saving of closed files to coalesce bursts of rapid edits
+	WritebackDelay time.Duration
+
+	// Refresh FS changes in background before they get stale
+	BackgroundRefresh bool
+
+	// How long FS changes and file attributes are reused before fetching them
+	// again. Zero means DefaultChangesInterval, negative - fetching them on
+	// every directory listing.
+	ChangesInterval time.Duration
+
+	// How long paths found missing are reported so without asking docker
+	// again, unless FS changes report them added. Zero disables it.
+	NegativeLookupTTL time.Duration
+
+	// Limit of simultaneously open files, 0 means unlimited
+	MaxOpenFiles int
+
+	// What to do if writing to container doesn't work, see RWCheck* constants.
+	// Empty value disables the check.
+	ReadWriteCheck string
+	// Directory in container to write probe file to
+	ProbeDir string
+
+	// Shell used to run helper commands in container, detected if empty
+	ContainerShell string
+
+	// Keep content of files read from container on disk, see cache.go
+	FileCache bool
+	// Keep nothing in the cache directory, FileCache is ignored
+	NoCache bool
+	// Limit of cache directory size in bytes, 0 means none. Least recently
+	// used files are pruned on Init.
+	MaxCacheSize int64
+	// Keep cached files of container on unmount, so the next mount reuses
+	// them. Otherwise RemoveCache removes them.
+	KeepCache bool
+
+	// Which modification time files report and get on save, see Timestamp*
+	// constants. Empty value means TimestampStat.
+	TimestampSource string
+
+	// Owner all files are reported to have, nil means the current user
+	Uid, Gid *uint32
+
+	// Directory in container mounted as the mount root, empty means /
+	Include string
+	// Glob patterns of full paths hidden from the mount, with everything
+	// under them, e.g. /proc or /app/node_modules
+	Exclude []string
+
+	// Called every second while the export is downloaded with the number of
+	// bytes fetched so far. Progress is logged at warning level if it's nil,
+	// see ProgressPrinter.
+	ExportProgress func(fetched int64)
+}
+
+// owner returns uid and gid files are reported to be owned by.
+func (o *Options) owner() (uid, gid uint32) {
+	uid, gid = uint32(os.Getuid()), uint32(os.Getgid())
+	if o.Uid != nil {
+		uid = *o.Uid
+	}
+	if o.Gid != nil {
+		gid = *o.Gid
+	}
+	return uid, gid
+}
+
+const (
+	// Fail Init if writes to container don't work
+	RWCheckAbort = "abort"
+	// Serve FS read-only if writes to container don't work
+	RWCheckDowngrade = "downgrade"
+)
+
+const (
+	// Report live mtime from container, saved files get time of the last write
+	TimestampStat = "stat"
+	// Report mtime from exported archive, saved files keep their mtime
+	TimestampArchive = "archive"
+	// Report live mtime from container, saved files get time of the save
+	TimestampNow = "now"
+)
+
+// Written to probe directory on read-write check, removed right after it.
+const probeFileName = ".dockerfs-probe"
+
+// Default of Options.ChangesInterval.
+const DefaultChangesInterval = 1 * time.Second
+
+// Returned by dockerMng for paths missing in container.
+var ErrorNotFound = errors.New("no such file or directory")
+
+// Delay before the second export attempt, doubled on each next one.
+var exportRetryDelay = 1 * time.Second
+
+// Attempts to fetch FS changes of a running container, e.g. one restarting
+// makes the diff endpoint fail for a moment.
+const changesAttempts = 3
+
+// Delay before the second attempt to fetch FS changes, doubled on each next one.
+var changesRetryDelay = 100 * time.Millisecond
+
+// How long changes fetched before are used once fetching them fails.
+var changesFailureBackoff = 2 * time.Second
+
 type Mng struct {
-	docker dockerMng
+	// number of open file handles, first to be 64-bit aligned for atomic ops
+	openFiles int64
 
-	id string
+	docker  dockerMng
+	clients *ClientFactory
+
+	id   string
+	opts Options
 
 	inodes *Ino
 
-	staticFiles map[string]os.FileMode
+	// content of export by directory, replaced by Refresh under changesMutex
+	staticDirs map[string]map[string]os.FileMode
+	// number of exported files
+	staticCount int
+	// modification times of exported files, kept for TimestampArchive only
+	archiveMtimes map[string]time.Time
+	// targets of exported symlinks, read again once FS changes report them
+	linkTargets map[string]string
+	// total size of exported regular files
+	staticSize int64
+	// destinations of volumes and bind mounts, which aren't exported
+	mounts []string
+	// content of volumes by destination and directory, read from their
+	// archives until Refresh, see volumeChildren
+	volumeDirs   map[string]map[string]map[string]os.FileMode
+	volumesMutex sync.Mutex
+	// container runs Windows, names in its export and changes use backslashes
+	windows bool
+	// file cache and users directory of container removed by RemoveCache,
+	// nil if they are kept
+	cachePaths []string
 
 	changes               []container.ContainerChangeResponseItem
 	changesUpdated        time.Time
 	changesUpdateInterval time.Duration
-	// TODO replace with RWMutex
-	changesMutex sync.Mutex
+	// changes are not fetched again until then after a failure
+	changesBackoff time.Time
+	changesMutex   sync.RWMutex
+	// fetches of FS changes, shared by concurrent callers
+	changesFetches singleflight.Group
+	stopRefresh    chan struct{}
 
-	// current user uid, gid
+	// owner of files, see Options.Uid
 	uid, gid uint32
+
+	// reject modifications with EROFS
+	readOnly bool
+	// problems worked around during Init
+	warnings []string
+
+	// files waiting for deferred write-back
+	pending fileSet
+	// downloads of file content by path, shared by concurrent opens
+	fetches singleflight.Group
+
+	// how helper commands are run, detected on first use
+	execMode  int
+	execMutex sync.Mutex
+
+	pathLocks pathLocks
+	// files created in mount, but not saved to container yet
+	created pathSet
+	// paths Lookup found missing, see Options.NegativeLookupTTL
+	missing missingPaths
+	// paths out of the mount, see Options.Include and Options.Exclude
+	filter pathFilter
 }
 
-func NewMng(containerId string) *Mng {
+// NewMng creates container FS manager. Docker clients are made by clients
+// factory, nil means clients configured from environment.
+func NewMng(containerId string, clients *ClientFactory, opts Options) *Mng {
+	if clients == nil {
+		clients = &ClientFactory{}
+	}
+	uid, gid := opts.owner()
+	if opts.NoCache {
+		opts.FileCache = false
+	}
+	interval := opts.ChangesInterval
+	if interval == 0 {
+		interval = DefaultChangesInterval
+	} else if interval < 0 {
+		interval = 0
+	}
 	return &Mng{
 		id:                    containerId,
-		changesUpdateInterval: 1 * time.Second,
+		clients:               clients,
+		readOnly:              opts.ReadOnly,
+		opts:                  opts,
+		changesUpdateInterval: interval,
 		inodes:                NewIno(),
-		uid:                   uint32(os.Getuid()),
-		gid:                   uint32(os.Getgid()),
+		missing:               missingPaths{ttl: opts.NegativeLookupTTL},
+		filter:                newPathFilter(opts.Include, opts.Exclude),
+		uid:                   uid,
+		gid:                   gid,
 	}
 }
 
 func (m *Mng) Init() (err error) {
-	if m.docker == nil {
-		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-		if err != nil {
+	if err := m.connect(); err != nil {
+		return err
+	}
+	m.detectPlatform(context.Background())
+	if m.opts.MaxCacheSize > 0 && !m.opts.NoCache {
+		pruneCache(m.opts.MaxCacheSize)
+	}
+	m.holdCache()
+	if err := m.checkInclude(context.Background()); err != nil {
+		return err
+	}
+
+	if err := m.retryExport(func() error { return m.loadContainerContent(context.Background()) }); err != nil {
+		return err
+	}
+	if err := m.checkReadWrite(context.Background()); err != nil {
+		return err
+	}
+	if m.opts.BackgroundRefresh && m.changesUpdateInterval > 0 {
+		m.stopRefresh = make(chan struct{})
+		go m.refreshChangesInBackground(m.stopRefresh)
+	}
+	return nil
+}
+
+// retryExport calls fetch, which downloads the export, up to RetryExport
+// times while it fails with retryable errors, e.g. the connection to a remote
+// daemon breaks halfway. Docker can't resume an export, it's fetched anew.
+func (m *Mng) retryExport(fetch func() error) error {
+	attempts := m.opts.RetryExport
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := exportRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fetch()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if attempt >= attempts {
+			if attempts > 1 {
+				return fmt.Errorf("export failed %d times, giving up: %w", attempts, err)
+			}
 			return err
 		}
-		m.docker = NewDockerMng(cli, m.id)
+		log.Printf("[warning] Export attempt %d/%d failed: %v. Retrying in %v...", attempt, attempts, err, delay)
+		m.warnings = append(m.warnings, fmt.Sprintf("export attempt %d/%d failed: %v", attempt, attempts, err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// checkInclude makes sure the directory to mount as root exists.
+func (m *Mng) checkInclude(ctx context.Context) error {
+	if m.filter.include == "/" {
+		return nil
+	}
+	attrs, err := m.docker.GetPathAttrs(ctx, m.filter.include)
+	if err != nil {
+		return fmt.Errorf("cannot mount %s of container: %w", m.filter.include, err)
+	}
+	if !attrs.Mode.IsDir() {
+		return fmt.Errorf("cannot mount %s of container: not a directory", m.filter.include)
+	}
+	return nil
+}
+
+// detectPlatform tells if container runs Windows. Paths in requests are kept
+// as they are, the daemon resolves them against C:\ itself.
+func (m *Mng) detectPlatform(ctx context.Context) {
+	info, err := m.docker.Inspect(ctx)
+	if err != nil {
+		log.Printf("[warning] Cannot inspect container: %v. Assuming Linux paths.", err)
+		return
 	}
+	m.windows = info.ContainerJSONBase != nil && info.Platform == "windows"
+	if m.windows {
+		log.Printf("[info] Container runs Windows, its paths are converted to slashes")
+	}
+}
 
-	log.Printf("[debug] fetching container content...")
-	archPath, err := m.fetchContainerArchive(context.Background())
+func (m *Mng) connect() error {
+	if m.docker != nil {
+		return nil
+	}
+	cli, err := m.clients.Client()
 	if err != nil {
 		return err
 	}
-	defer os.Remove(archPath)
-	log.Printf("[debug] parse container content...")
-	m.staticFiles, err = parseContainterContent(archPath)
+	m.docker = NewDockerMng(cli, m.id, m.clients.Timeout, m.clients.downloadLimiter())
+	return nil
+}
+
+// ReadFile returns content of a regular file in container.
+func (m *Mng) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+	return getFileContent(ctx, m.docker, path)
+}
+
+// WalkArchive calls fn for every raw entry of the container export, as the tar
+// reader sees them. The export is read while it's downloaded, it isn't stored.
+// If it breaks, it's fetched again and entries already walked are skipped.
+func (m *Mng) WalkArchive(ctx context.Context, fn func(hdr *tar.Header) error) error {
+	if err := m.connect(); err != nil {
+		return err
+	}
+	var walked int
+	// failure of fn, which isn't retried
+	var fnErr error
+	err := m.retryExport(func() error {
+		respBody, err := m.docker.ContainerExport(ctx)
+		if err != nil {
+			return err
+		}
+		defer respBody.Close()
+		body, stop := withProgress(respBody, m.opts.ExportProgress)
+		defer stop()
+		tr := tar.NewReader(body)
+		skip := walked
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("broken container archive: %w", err)
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			walked++
+			if fnErr = fn(hdr); fnErr != nil {
+				return nil
+			}
+		}
+	})
+	if fnErr != nil {
+		return fnErr
+	}
 	return err
 }
 
-func (m *Mng) Root() fs.InodeEmbedder {
-	return &Dir{
-		mng:      m,
-		fullpath: "/",
+// Estimate tells how much mounting of a container fetches.
+type Estimate struct {
+	// number of exported files, directories aside
+	Files int `json:"files"`
+	// total size of exported regular files, the most file cache may take
+	Size int64 `json:"size"`
+	// size of files changed in container and of all its files, as docker
+	// reports them
+	SizeRw     int64 `json:"size_rw"`
+	SizeRootFs int64 `json:"size_root_fs"`
+}
+
+// Estimate fetches and parses container export the same way Init does, but
+// keeps nothing of it.
+func (m *Mng) Estimate(ctx context.Context) (est Estimate, err error) {
+	if err := m.connect(); err != nil {
+		return est, err
+	}
+	if est.SizeRw, est.SizeRootFs, err = m.docker.Size(ctx); err != nil {
+		return est, err
 	}
+	m.detectPlatform(ctx)
+	var content *exportContent
+	if err := m.retryExport(func() (err error) {
+		content, err = m.fetchContainerContent(ctx)
+		return err
+	}); err != nil {
+		return est, err
+	}
+	est.Files, est.Size = len(content.files), content.size
+	return est, nil
 }
 
-// Fetch container archive and return path to tar-file.
-func (m *Mng) fetchContainerArchive(ctx context.Context) (path string, err error) {
-	respBody, err := m.docker.ContainerExport(ctx)
-	if err != nil {
-		return "", err
+// ExportedFile is a file of container export, directories aside.
+type ExportedFile struct {
+	Path string
+	Mode os.FileMode
+	// target of symlink
+	Linkname string
+}
+
+// ExportedFiles returns files of container export sorted by path, the way
+// Init finds them, Options.Include and Options.Exclude applied.
+func (m *Mng) ExportedFiles(ctx context.Context) ([]ExportedFile, error) {
+	if err := m.connect(); err != nil {
+		return nil, err
 	}
-	defer respBody.Close()
+	m.detectPlatform(ctx)
+	var content *exportContent
+	if err := m.retryExport(func() (err error) {
+		content, err = m.fetchContainerContent(ctx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	files := make([]ExportedFile, 0, len(content.files))
+	for path, mode := range content.files {
+		files = append(files, ExportedFile{Path: path, Mode: mode, Linkname: content.links[path]})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
 
-	output, err := prepareOutputFile(m.id)
+// FsChanges returns changes of container FS sorted by path, as docker diff
+// reports them, Options.Include and Options.Exclude applied.
+func (m *Mng) FsChanges(ctx context.Context) ([]container.ContainerChangeResponseItem, error) {
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+	m.detectPlatform(ctx)
+	changes, err := m.fetchFsChanges(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer output.Close()
+	var result []container.ContainerChangeResponseItem
+	for _, ch := range changes {
+		if !m.filter.hides(ch.Path) {
+			result = append(result, ch)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
 
-	if _, err := io.Copy(output, respBody); err != nil {
-		return "", err
+// Fetch container export and fill static files.
+func (m *Mng) loadContainerContent(ctx context.Context) error {
+	content, err := m.fetchContainerContent(ctx)
+	if err != nil {
+		return err
 	}
-	return output.Name(), nil
+	m.staticDirs = staticTree(content.files)
+	m.staticCount = len(content.files)
+	m.archiveMtimes = content.mtimes
+	m.linkTargets = content.links
+	m.staticSize = content.size
+	m.mounts = m.fetchMounts(ctx)
+	return nil
+}
+
+// exportContent is what fetchContainerContent finds in container export.
+type exportContent struct {
+	// modes of exported files
+	files map[string]os.FileMode
+	// modification times of exported files, for TimestampArchive only
+	mtimes map[string]time.Time
+	// targets of exported symlinks, as stored in container
+	links map[string]string
+	// total size of exported regular files
+	size int64
 }
 
-func prepareOutputFile(id string) (*os.File, error) {
-	home, err := os.UserHomeDir()
+// fetchContainerContent returns exported files. The export is parsed while
+// it's being downloaded, it isn't stored.
+func (m *Mng) fetchContainerContent(ctx context.Context) (*exportContent, error) {
+	log.Printf("[debug] fetching and parsing container content...")
+	respBody, err := m.docker.ContainerExport(ctx)
 	if err != nil {
 		return nil, err
 	}
-	dir := filepath.Join(home, ".cache/dockerfs")
-	if err := os.MkdirAll(dir, 0750); err != nil {
+	defer respBody.Close()
+	body, stop := withProgress(respBody, m.opts.ExportProgress)
+	defer stop()
+	content := &exportContent{links: make(map[string]string)}
+	if m.opts.TimestampSource == TimestampArchive {
+		content.mtimes = make(map[string]time.Time)
+	}
+	content.files, content.size, err = parseContainterContent(body, content.mtimes, content.links, m.filter, m.windows)
+	if err != nil {
 		return nil, err
 	}
-	file, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("content_%s.tar", id)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
-	return file, err
+	return content, nil
 }
 
-func parseContainterContent(file string) (map[string]os.FileMode, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
+// Refresh fetches container content and FS changes again, so files changed
+// in container since mount are shown without waiting for FS changes to expire.
+func (m *Mng) Refresh(ctx context.Context) error {
+	var content *exportContent
+	if err := m.retryExport(func() (err error) {
+		content, err = m.fetchContainerContent(ctx)
+		return err
+	}); err != nil {
+		return err
 	}
-	defer f.Close()
-	tr := tar.NewReader(f)
+	staticDirs := staticTree(content.files)
+	mounts := m.fetchMounts(ctx)
+	changes, changesErr := m.fetchFsChanges(ctx)
+	m.volumesMutex.Lock()
+	m.volumeDirs = nil
+	m.volumesMutex.Unlock()
+	m.changesMutex.Lock()
+	defer m.changesMutex.Unlock()
+	m.staticDirs = staticDirs
+	m.staticCount = len(content.files)
+	m.archiveMtimes = content.mtimes
+	m.linkTargets = content.links
+	m.staticSize = content.size
+	m.mounts = mounts
+	if changesErr != nil {
+		m.changesBackoff = time.Now().Add(changesFailureBackoff)
+		return changesErr
+	}
+	m.setFsChanges(changes)
+	return nil
+}
+
+// staticChildren returns modes of exported files in dir by name,
+// subdirectories included. The map isn't modified.
+func (m *Mng) staticChildren(dir string) map[string]os.FileMode {
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+	return m.staticDirs[filepath.Clean(dir)]
+}
+
+// usage returns total size and number of exported files.
+func (m *Mng) usage() (size int64, files int) {
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+	return m.staticSize, m.staticCount
+}
+
+// ReadOnly reports if modifications of container FS are rejected.
+func (m *Mng) ReadOnly() bool {
+	return m.readOnly
+}
+
+// Warnings returns problems worked around during Init, e.g. retried export.
+func (m *Mng) Warnings() []string {
+	return m.warnings
+}
+
+// Make sure files saved to container can be read back.
+func (m *Mng) checkReadWrite(ctx context.Context) error {
+	if m.opts.ReadWriteCheck == "" || m.readOnly {
+		return nil
+	}
+	dir := m.opts.ProbeDir
+	if dir == "" {
+		dir = "/tmp"
+	}
+	path := filepath.Join(dir, probeFileName)
+	log.Printf("[debug] Checking that writes to container work with %q...", path)
+
+	data := []byte(fmt.Sprintf("docker-fs write probe %d\n", time.Now().UnixNano()))
+	err := m.docker.SaveFile(ctx, path, data, &types.ContainerPathStat{Mode: 0600}, nil)
+	// failed save may leave it too
+	defer func() {
+		if _, err := m.exec(ctx, "rm", "--", path); err != nil {
+			log.Printf("[debug] Cannot remove %q: %v", path, err)
+		}
+	}()
+	if err == nil {
+		var saved []byte
+		saved, err = getFileContent(ctx, m.docker, path)
+		if err == nil && !bytes.Equal(saved, data) {
+			err = errors.New("saved content doesn't match")
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	if m.opts.ReadWriteCheck == RWCheckDowngrade {
+		log.Printf("[warning] Writing to container doesn't work (%v). Serving it read-only.", err)
+		m.warnings = append(m.warnings, fmt.Sprintf("writing to container doesn't work (%v), downgraded to read-only", err))
+		m.readOnly = true
+		return nil
+	}
+	return fmt.Errorf("writing to container doesn't work: %w", err)
+}
+
+// Only transient errors are retried: broken connections, timeouts and
+// failures of the daemon (5xx). Others, like missing container, won't go
+// away on their own.
+func isRetryable(err error) bool {
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &opErr),
+		errors.As(err, &netErr) && netErr.Timeout(),
+		client.IsErrConnectionFailed(err),
+		errdefs.IsSystem(err),
+		errdefs.IsUnavailable(err),
+		errdefs.IsDeadline(err):
+		return true
+	}
+	return false
+}
+
+// Fill attributes of a file from its stat.
+func (m *Mng) setAttr(out *fuse.Attr, path string, stat *types.ContainerPathStat) {
+	mtime := m.mtime(path, stat)
+	out.Mode = unixMode(stat.Mode)
+	out.Nlink = 1
+	out.Size = uint64(stat.Size)
+	out.SetTimes(nil, &mtime, nil)
+	out.Owner.Uid, out.Owner.Gid = m.uid, m.gid
+}
+
+// mtime returns modification time of path to report according to TimestampSource.
+func (m *Mng) mtime(path string, stat *types.ContainerPathStat) time.Time {
+	m.changesMutex.RLock()
+	mtimes := m.archiveMtimes
+	m.changesMutex.RUnlock()
+	if mtimes != nil {
+		if mtime, ok := mtimes[filepath.Clean(path)]; ok {
+			return mtime
+		}
+	}
+	return stat.Mtime
+}
+
+func (m *Mng) setDirAttr(out *fuse.Attr, mode os.FileMode) {
+	if mode == 0 {
+		mode = 0755
+	}
+	out.Mode = unixMode(mode)
+	out.Owner.Uid, out.Owner.Gid = m.uid, m.gid
+}
+
+// Reserve a file handle, false if the limit of open files is reached.
+func (m *Mng) acquireHandle() bool {
+	n := atomic.AddInt64(&m.openFiles, 1)
+	if m.opts.MaxOpenFiles > 0 && n > int64(m.opts.MaxOpenFiles) {
+		atomic.AddInt64(&m.openFiles, -1)
+		return false
+	}
+	return true
+}
+
+func (m *Mng) releaseHandle() {
+	atomic.AddInt64(&m.openFiles, -1)
+}
+
+// Sync saves all files with deferred write-back. Should be called before exit.
+func (m *Mng) Sync() {
+	for _, f := range m.pending.list() {
+		f.sync()
+	}
+}
+
+func (m *Mng) Root() fs.InodeEmbedder {
+	return &Dir{
+		mng:      m,
+		fullpath: m.filter.include,
+	}
+}
+
+// parseContainterContent returns modes of files in container archive and
+// total size of regular ones. Modification times and targets of symlinks are
+// collected into mtimes and links, unless they are nil.
+func parseContainterContent(r io.Reader, mtimes map[string]time.Time, links map[string]string, filter pathFilter, windows bool) (map[string]os.FileMode, int64, error) {
+	tr := tar.NewReader(r)
 
 	result := make(map[string]os.FileMode)
+	var size int64
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -122,55 +718,284 @@ func parseContainterContent(file string) (map[string]os.FileMode, error) {
 			break
 		}
 		if err != nil {
-			log.Printf("[debug] Add: %v", err)
-			// XXX handle error
-			break
+			return nil, 0, fmt.Errorf("broken container archive: %w", err)
 		}
 
+		name, linkname := hdr.Name, hdr.Linkname
+		if windows {
+			name, linkname = slashPath(name), slashPath(linkname)
+		}
+		path := filepath.Join("/", name)
+		if filter.hides(path) {
+			continue
+		}
 		switch hdr.Typeflag {
-		case tar.TypeReg, tar.TypeRegA, tar.TypeSymlink:
-			result["/"+filepath.Clean(hdr.Name)] = os.FileMode(uint32(hdr.Mode))
+		case tar.TypeReg, tar.TypeRegA:
+			result[path] = os.FileMode(uint32(hdr.Mode)).Perm()
+			size += hdr.Size
+		case tar.TypeSymlink:
+			// tar keeps file type apart from mode bits
+			result[path] = os.ModeSymlink | os.FileMode(uint32(hdr.Mode)).Perm()
+			if links != nil {
+				links[path] = linkname
+			}
+		case tar.TypeLink:
+			// hard link shares mode with its target, which comes earlier in archive
+			mode, ok := result[filepath.Join("/", linkname)]
+			if !ok {
+				mode = os.FileMode(uint32(hdr.Mode)).Perm()
+			}
+			result[path] = mode
+		case tar.TypeChar:
+			result[path] = os.ModeDevice | os.ModeCharDevice | os.FileMode(uint32(hdr.Mode)).Perm()
+		case tar.TypeBlock:
+			result[path] = os.ModeDevice | os.FileMode(uint32(hdr.Mode)).Perm()
+		case tar.TypeFifo:
+			result[path] = os.ModeNamedPipe | os.FileMode(uint32(hdr.Mode)).Perm()
 		case tar.TypeDir:
 			// skip empty dirs
+			continue
 		default:
 			log.Printf("Don't know how to handle file of type %v: %q. Skipping.", hdr.Typeflag, hdr.Name)
+			continue
+		}
+		if mtimes != nil {
+			mtimes[path] = hdr.ModTime
 		}
 	}
-	return result, nil
+	return result, size, nil
+}
+
+// staticTree groups exported files by directory. Directories, which aren't
+// kept in the export content, are added to their parents with os.ModeDir.
+func staticTree(files map[string]os.FileMode) map[string]map[string]os.FileMode {
+	dirs := make(map[string]map[string]os.FileMode)
+	for path, mode := range files {
+		for path != "/" {
+			dir, name := filepath.Dir(path), filepath.Base(path)
+			children, ok := dirs[dir]
+			if !ok {
+				children = make(map[string]os.FileMode)
+				dirs[dir] = children
+			}
+			if _, ok := children[name]; ok && mode.IsDir() {
+				// added with its parents already
+				break
+			}
+			children[name] = mode
+			path, mode = dir, os.ModeDir
+		}
+	}
+	return dirs
 }
 
 func (m *Mng) ChangesInDir(ctx context.Context, dir string) (result []container.ContainerChangeResponseItem, err error) {
+	m.changesMutex.RLock()
+	if m.changesFresh() {
+		defer m.changesMutex.RUnlock()
+		return m.changesInDir(dir), nil
+	}
+	m.changesMutex.RUnlock()
+
+	if err := m.updateFsChanges(); err != nil {
+		// the last changes fetched (none, at worst) are better than failing
+		// listing, they are fetched again after changesFailureBackoff
+		log.Printf("[warning] Cannot fetch FS changes, using outdated ones: %v", err)
+	}
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+	return m.changesInDir(dir), nil
+}
+
+// Must be called with changesMutex held.
+func (m *Mng) changesFresh() bool {
+	now := time.Now()
+	if now.Before(m.changesBackoff) {
+		return true
+	}
+	return m.changes != nil && m.changesUpdateInterval > 0 && !now.After(m.changesUpdated.Add(m.changesUpdateInterval))
+}
+
+// Must be called with changesMutex held.
+func (m *Mng) changesInDir(dir string) (result []container.ContainerChangeResponseItem) {
+	dir = filepath.Clean(dir)
+	for _, change := range m.changes {
+		parent := filepath.Clean(filepath.Dir(change.Path))
+		if parent != dir && (change.Kind != FileAdded || !isUnder(parent, dir)) {
+			// Not a direct child, nor a file added to a new subdirectory
+			continue
+		}
+		result = append(result, change)
+	}
+	return result
+}
+
+// isUnder tells if clean path is inside of dir.
+func isUnder(path, dir string) bool {
+	if dir == "/" {
+		return path != "/"
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+type fileSet struct {
+	files map[*File]struct{}
+	mutex sync.Mutex
+}
+
+func (s *fileSet) add(f *File) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.files == nil {
+		s.files = make(map[*File]struct{})
+	}
+	s.files[f] = struct{}{}
+}
+
+func (s *fileSet) remove(f *File) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.files, f)
+}
+
+func (s *fileSet) list() []*File {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files := make([]*File, 0, len(s.files))
+	for f := range s.files {
+		files = append(files, f)
+	}
+	return files
+}
+
+// markRemoved records removal of path made through the mount, so it's hidden
+// the same way as files removed in container until FS changes are refreshed.
+func (m *Mng) markRemoved(path string) {
 	m.changesMutex.Lock()
 	defer m.changesMutex.Unlock()
-	if m.changes == nil || time.Now().After(m.changesUpdated.Add(m.changesUpdateInterval)) {
-		changes, err := m.docker.GetFsChanges(ctx)
+	changes := m.changes[:0:0]
+	for _, change := range m.changes {
+		if change.Path != path {
+			changes = append(changes, change)
+		}
+	}
+	if _, ok := m.staticDirs[filepath.Dir(path)][filepath.Base(path)]; ok {
+		changes = append(changes, container.ContainerChangeResponseItem{Kind: FileRemoved, Path: path})
+	}
+	m.changes = changes
+}
+
+// markAdded records path created through the mount, so it's listed
+// the same way as files added in container until FS changes are refreshed.
+func (m *Mng) markAdded(path string) {
+	m.missing.remove(path)
+	m.changesMutex.Lock()
+	defer m.changesMutex.Unlock()
+	for _, change := range m.changes {
+		if change.Path == path && change.Kind == FileAdded {
+			return
+		}
+	}
+	m.changes = append(m.changes, container.ContainerChangeResponseItem{Kind: FileAdded, Path: path})
+}
+
+// updateFsChanges fetches FS changes once for all callers at a time, on
+// a context none of them may cancel. Changes fetched before are kept if it
+// fails.
+func (m *Mng) updateFsChanges() error {
+	_, err, _ := m.changesFetches.Do("", func() (interface{}, error) {
+		changes, err := m.fetchFsChanges(context.Background())
+		m.changesMutex.Lock()
+		defer m.changesMutex.Unlock()
 		if err != nil {
+			m.changesBackoff = time.Now().Add(changesFailureBackoff)
+			return nil, err
+		}
+		m.setFsChanges(changes)
+		return nil, nil
+	})
+	return err
+}
+
+// fetchFsChanges returns FS changes, retrying while a running container
+// refuses them. It's called without changesMutex held, the retries wait.
+func (m *Mng) fetchFsChanges(ctx context.Context) ([]container.ContainerChangeResponseItem, error) {
+	changes, err := m.docker.GetFsChanges(ctx)
+	delay := changesRetryDelay
+	for attempt := 1; err != nil; attempt++ {
+		// content of a stopped container is still exported, just without changes
+		if running, inspectErr := m.docker.IsRunning(ctx); inspectErr == nil && !running {
+			log.Printf("[debug] Container is not running, FS changes are skipped: %v", err)
+			return nil, nil
+		}
+		// restarting container is refused with conflict
+		if attempt >= changesAttempts || !(isRetryable(err) || errdefs.IsConflict(err)) {
 			return nil, err
 		}
-		m.changes = changes
-		m.changesUpdated = time.Now()
+		log.Printf("[debug] Fetching FS changes failed: %v. Retrying in %v...", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		changes, err = m.docker.GetFsChanges(ctx)
 	}
+	if m.windows {
+		for i := range changes {
+			changes[i].Path = filepath.Join("/", slashPath(changes[i].Path))
+		}
+	}
+	return changes, nil
+}
 
-	dir = filepath.Clean(dir)
-	for _, change := range m.changes {
-		// let's skip modified files for now
-		if change.Kind == FileModified {
-			continue
+// setFsChanges replaces FS changes with fetched ones.
+// Must be called with changesMutex held.
+func (m *Mng) setFsChanges(changes []container.ContainerChangeResponseItem) {
+	if m.opts.FileCache {
+		// modified since the last fetch, stat may miss it (e.g. same size, mtime kept)
+		known := make(map[string]bool, len(m.changes))
+		for _, change := range m.changes {
+			known[change.Path] = change.Kind == FileModified
 		}
-		if filepath.Clean(filepath.Dir(change.Path)) != dir {
-			// Not a direct child
-			continue
+		for _, change := range changes {
+			if change.Kind == FileModified && !known[change.Path] {
+				m.uncacheFile(change.Path)
+			}
 		}
-		/* 		stat, err := m.docker.GetPathAttrs(ctx, change.Path)
-		   		if err != nil {
-		   			if !errors.As(err, &ErrorNotFound{}) {
-		   				log.Printf("[error] Failed to get raw attrs of %q: %v", change.Path, err)
-		   			}
-		   			continue
-		   		}
-		   		change.mode = uint32(stat.Mode)
-		*/
-		result = append(result, change)
 	}
-	return result, nil
+	for _, change := range changes {
+		if change.Kind != FileRemoved {
+			m.missing.remove(change.Path)
+		}
+	}
+	if changes == nil {
+		// fetched, but nothing changed
+		changes = []container.ContainerChangeResponseItem{}
+	}
+	m.changes = changes
+	m.changesUpdated = time.Now()
+	m.changesBackoff = time.Time{}
+}
+
+// Refresh changes shortly before they expire, so Readdir rarely waits for them.
+func (m *Mng) refreshChangesInBackground(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.changesUpdateInterval * 4 / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := m.updateFsChanges(); err != nil {
+			log.Printf("[warning] Background refresh of FS changes failed: %v", err)
+		}
+	}
+}
+
+// Close stops background activities. Should be called on unmount.
+func (m *Mng) Close() {
+	m.changesMutex.Lock()
+	defer m.changesMutex.Unlock()
+	if m.stopRefresh != nil {
+		close(m.stopRefresh)
+		m.stopRefresh = nil
+	}
 }
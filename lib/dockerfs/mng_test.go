@@ -0,0 +1,594 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestInitRetriesTransientExportErrors(t *testing.T) {
+	exportRetryDelay = 0
+	fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+	fake.exportErrs = []error{
+		syscall.ECONNRESET,
+		errdefs.System(errors.New("500 Internal Server Error")),
+	}
+	// and then one breaks halfway
+	fake.brokenExports = 1
+
+	mng, _ := newTestMng(t, fake, Options{RetryExport: 4})
+	if n := fake.count("ContainerExport"); n != 4 {
+		t.Errorf("ContainerExport called %d times, expected 4", n)
+	}
+	if _, ok := mng.staticChildren("/etc")["hostname"]; !ok {
+		t.Errorf("/etc/hostname is missing in static files: %v", mng.staticDirs)
+	}
+	if w := mng.Warnings(); len(w) != 3 {
+		t.Errorf("Warnings() = %q, expected one per failed attempt", w)
+	}
+
+	fake.brokenExports = 1
+	if err := mng.Refresh(context.Background()); err != nil {
+		t.Errorf("Refresh() failed: %v", err)
+	}
+	walk := func() []string {
+		t.Helper()
+		var names []string
+		if err := mng.WalkArchive(context.Background(), func(hdr *tar.Header) error {
+			names = append(names, hdr.Name)
+			return nil
+		}); err != nil {
+			t.Errorf("WalkArchive() failed: %v", err)
+		}
+		return names
+	}
+	expected := walk()
+	fake.brokenExports = 1
+	// entries walked before the export broke aren't repeated
+	if names := walk(); len(expected) == 0 || strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("WalkArchive() walked %q, expected %q", names, expected)
+	}
+}
+
+func TestInitGivesUp(t *testing.T) {
+	exportRetryDelay = 0
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		expected int
+	}{
+		{"not found", []error{errdefs.NotFound(errors.New("No such container: fake"))}, 1},
+		{"unknown", []error{errors.New("unexpected content type")}, 1},
+		{"exhausted", []error{syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET}, 3},
+	} {
+		fake := newFakeDocker()
+		fake.exportErrs = tc.errs
+		mng := NewMng("fake", nil, Options{RetryExport: 3})
+		mng.docker = fake
+		err := mng.Init()
+		if err == nil {
+			t.Errorf("%s: Init() succeeded, expected error", tc.name)
+		} else if exhausted := strings.Contains(err.Error(), "giving up"); exhausted != (tc.expected > 1) {
+			t.Errorf("%s: Init() = %v, expected to tell if attempts are exhausted", tc.name, err)
+		}
+		if n := fake.count("ContainerExport"); n != tc.expected {
+			t.Errorf("%s: ContainerExport called %d times, expected %d", tc.name, n, tc.expected)
+		}
+	}
+}
+
+func TestReadWriteCheck(t *testing.T) {
+	fake := newFakeDocker().addDir("/tmp")
+	mng, _ := newTestMng(t, fake, Options{ReadWriteCheck: RWCheckAbort})
+	if mng.ReadOnly() {
+		t.Errorf("ReadOnly() = true after successful check")
+	}
+	if n := fake.count("SaveFile"); n != 1 {
+		t.Errorf("SaveFile called %d times, expected 1", n)
+	}
+	if _, ok := fake.entries["/tmp/"+probeFileName]; ok {
+		t.Errorf("probe file is left in container")
+	}
+
+	readOnly := errors.New("Error response from daemon: container rootfs is marked read-only")
+	fake = newFakeDocker().addDir("/tmp")
+	fake.saveErrs = []error{readOnly}
+	mng, _ = newTestMng(t, fake, Options{ReadWriteCheck: RWCheckDowngrade})
+	if !mng.ReadOnly() {
+		t.Errorf("ReadOnly() = false, expected downgrade after failed check")
+	}
+	if w := mng.Warnings(); len(w) != 1 {
+		t.Errorf("Warnings() = %q, expected downgrade to be reported", w)
+	}
+
+	fake = newFakeDocker().addDir("/tmp")
+	fake.saveErrs = []error{readOnly}
+	mng = NewMng("fake", nil, Options{ReadWriteCheck: RWCheckAbort})
+	mng.docker = fake
+	if err := mng.Init(); err == nil {
+		t.Errorf("Init() succeeded, expected failed check to abort it")
+	}
+}
+
+func TestExecFallsBackToDirectRun(t *testing.T) {
+	fake := newFakeDocker()
+	mng, _ := newTestMng(t, fake, Options{ContainerShell: "/bin/missing"})
+	if _, err := mng.exec(context.Background(), "true"); err != nil {
+		t.Fatalf("exec(true) failed: %v", err)
+	}
+	if mng.execMode != execDirect {
+		t.Errorf("exec mode = %d, expected direct run", mng.execMode)
+	}
+	var execErr *ExecError
+	if _, err := mng.exec(context.Background(), "false"); !errors.As(err, &execErr) {
+		t.Errorf("exec(false) = %v, expected ExecError", err)
+	}
+}
+
+func TestParseHardLinks(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+		{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/missing", Mode: 0700},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	files, _, err := parseContainterContent(&archive, nil, nil, newPathFilter("", nil), false)
+	if err != nil {
+		t.Fatalf("parseContainterContent() failed: %v", err)
+	}
+	for path, mode := range map[string]os.FileMode{
+		"/bin/busybox": 0755,
+		"/bin/ls":      0755,
+		"/bin/sh":      0700,
+	} {
+		if got, ok := files[path]; !ok || got != mode {
+			t.Errorf("%s mode = %v (listed: %v), expected %v", path, got, ok, mode)
+		}
+	}
+}
+
+func TestParseWindowsContent(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hdr := range []*tar.Header{
+		{Name: `C:\app\run.exe`, Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: `app\data\x.txt`, Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: `app\run2.exe`, Typeflag: tar.TypeLink, Linkname: `app\run.exe`},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	files, _, err := parseContainterContent(&archive, nil, nil, newPathFilter("", nil), true)
+	if err != nil {
+		t.Fatalf("parseContainterContent() failed: %v", err)
+	}
+	expected := map[string]os.FileMode{
+		"/app/run.exe":    0755,
+		"/app/data/x.txt": 0644,
+		"/app/run2.exe":   0755,
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("parseContainterContent() = %v, expected %v", files, expected)
+	}
+}
+
+func TestStaticTree(t *testing.T) {
+	dirs := staticTree(map[string]os.FileMode{
+		"/bin/sh":          0755,
+		"/etc/hosts":       0644,
+		"/etc/ssl/openssl": 0644,
+		"/lib":             os.ModeSymlink | 0777,
+	})
+	for dir, expected := range map[string]map[string]os.FileMode{
+		"/":    {"bin": os.ModeDir, "etc": os.ModeDir, "lib": os.ModeSymlink | 0777},
+		"/bin": {"sh": 0755},
+		"/etc": {"hosts": 0644, "ssl": os.ModeDir},
+	} {
+		if !reflect.DeepEqual(dirs[dir], expected) {
+			t.Errorf("children of %s = %v, expected %v", dir, dirs[dir], expected)
+		}
+	}
+}
+
+func TestChangesFetchedOnce(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+	mng, _ := newTestMng(t, fake, Options{})
+	before := fake.count("GetFsChanges")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := mng.ChangesInDir(context.Background(), "/etc"); err != nil {
+				t.Errorf("ChangesInDir() failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fake.count("GetFsChanges") - before; n != 1 {
+		t.Errorf("GetFsChanges called %d times by concurrent listings, expected 1", n)
+	}
+}
+
+func TestChangesRetried(t *testing.T) {
+	changesRetryDelay = 0
+	fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+	mng, root := newTestMng(t, fake, Options{ChangesInterval: -1})
+	fake.addFile("/etc/added", "x")
+	fake.change(FileAdded, "/etc/added")
+	restarting := errdefs.Conflict(errors.New("Container fake is restarting, wait until the container is running"))
+
+	fake.changesErrs = []error{restarting, restarting}
+	before := fake.count("GetFsChanges")
+	etc := lookupDir(t, root, "etc")
+	if _, ok := readdir(t, etc)["added"]; !ok {
+		t.Errorf("added file is not listed after transient errors")
+	}
+	if n := fake.count("GetFsChanges") - before; n != changesAttempts {
+		t.Errorf("GetFsChanges called %d times, expected %d", n, changesAttempts)
+	}
+
+	// outdated changes are listed while fetching fails
+	fake.changesErrs = []error{restarting, restarting, restarting}
+	entries := readdir(t, etc)
+	if _, ok := entries["hostname"]; !ok {
+		t.Errorf("static file is not listed while changes fail")
+	}
+	if _, ok := entries["added"]; !ok {
+		t.Errorf("added file is not listed while changes fail")
+	}
+	if changes, err := mng.ChangesInDir(context.Background(), "/etc"); err != nil || len(changes) != 1 {
+		t.Errorf("ChangesInDir() = %v, %v after errors are gone", changes, err)
+	}
+}
+
+func TestChangesFailureBackoff(t *testing.T) {
+	defer func(delay, backoff time.Duration) {
+		changesRetryDelay, changesFailureBackoff = delay, backoff
+	}(changesRetryDelay, changesFailureBackoff)
+	changesRetryDelay, changesFailureBackoff = 100*time.Millisecond, time.Hour
+	fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+	mng, root := newTestMng(t, fake, Options{ChangesInterval: -1})
+	etc := lookupDir(t, root, "etc")
+	restarting := errdefs.Conflict(errors.New("Container fake is restarting, wait until the container is running"))
+
+	fake.mu.Lock()
+	fake.changesErrs = []error{restarting, restarting, restarting}
+	fake.mu.Unlock()
+	before := fake.count("GetFsChanges")
+	listed := make(chan struct{})
+	go func() {
+		readdir(t, etc)
+		close(listed)
+	}()
+	// retries wait without the lock held
+	time.Sleep(changesRetryDelay / 2)
+	locked := make(chan struct{})
+	go func() {
+		mng.usage()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(changesRetryDelay):
+		t.Errorf("changes lock is held while fetching changes is retried")
+	}
+	<-listed
+	if n := fake.count("GetFsChanges") - before; n != changesAttempts {
+		t.Errorf("GetFsChanges called %d times, expected %d", n, changesAttempts)
+	}
+
+	// not fetched again for a while after the failure
+	if _, ok := readdir(t, etc)["hostname"]; !ok {
+		t.Errorf("static file is not listed after changes failed")
+	}
+	if n := fake.count("GetFsChanges") - before; n != changesAttempts {
+		t.Errorf("GetFsChanges called %d times during backoff, expected %d", n, changesAttempts)
+	}
+	mng.changesMutex.Lock()
+	mng.changesBackoff = time.Time{}
+	mng.changesMutex.Unlock()
+	readdir(t, etc)
+	if n := fake.count("GetFsChanges") - before; n != changesAttempts+1 {
+		t.Errorf("GetFsChanges called %d times after backoff, expected %d", n, changesAttempts+1)
+	}
+}
+
+func TestBackgroundRefresh(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+	mng, root := newTestMng(t, fake, Options{BackgroundRefresh: true, ChangesInterval: interval})
+	defer mng.Close()
+	etc := lookupDir(t, root, "etc")
+	readdir(t, etc)
+
+	fake.mu.Lock()
+	fake.addFile("/etc/added", "x")
+	fake.change(FileAdded, "/etc/added")
+	fake.mu.Unlock()
+
+	// nothing asks for changes meanwhile
+	deadline := time.Now().Add(20 * interval)
+	for {
+		mng.changesMutex.RLock()
+		fetched := len(mng.changes) == 1
+		mng.changesMutex.RUnlock()
+		if fetched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("FS changes aren't refreshed in background, GetFsChanges called %d times", fake.count("GetFsChanges"))
+		}
+		time.Sleep(interval / 5)
+	}
+	if _, ok := readdir(t, etc)["added"]; !ok {
+		t.Errorf("added file is not listed after background refresh")
+	}
+}
+
+// Startup of a container with 100k files.
+func BenchmarkLoadContainerContent(b *testing.B) {
+	fake := newFakeDocker()
+	for i := 0; i < 100000; i++ {
+		fake.addFile(fmt.Sprintf("/usr/share/%03d/file%d", i%1000, i), "content\n")
+	}
+	mng := NewMng("fake", nil, Options{})
+	mng.docker = fake
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mng.loadContainerContent(ctx); err != nil {
+			b.Fatalf("loadContainerContent() failed: %v", err)
+		}
+	}
+}
+
+func TestChangesInterval(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		fetches  int
+	}{
+		{0, 1},
+		{time.Hour, 1},
+		{-1, 3},
+	} {
+		fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+		mng, _ := newTestMng(t, fake, Options{ChangesInterval: tc.interval})
+		before := fake.count("GetFsChanges")
+		for i := 0; i < 3; i++ {
+			if _, err := mng.ChangesInDir(context.Background(), "/etc"); err != nil {
+				t.Fatalf("ChangesInDir() failed: %v", err)
+			}
+		}
+		if n := fake.count("GetFsChanges") - before; n != tc.fetches {
+			t.Errorf("interval %v: GetFsChanges called %d times, expected %d", tc.interval, n, tc.fetches)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+	mng, root := newTestMng(t, fake, Options{ChangesInterval: time.Hour})
+	etc := lookupDir(t, root, "etc")
+	readdir(t, etc)
+
+	// e.g. changed in an image layer, docker diff doesn't tell
+	fake.addFile("/etc/motd", "hello\n")
+	if _, ok := readdir(t, etc)["motd"]; ok {
+		t.Fatalf("motd is listed before refresh")
+	}
+	if err := mng.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+	if _, ok := readdir(t, etc)["motd"]; !ok {
+		t.Errorf("motd is not listed after refresh")
+	}
+}
+
+func TestStoppedContainer(t *testing.T) {
+	fake := newFakeDocker().addFile("/etc/hostname", "fake\n")
+	fake.stopped = true
+	_, root := newTestMng(t, fake, Options{ChangesInterval: -1})
+	ctx := context.Background()
+	etc := lookupDir(t, root, "etc")
+
+	if _, ok := readdir(t, etc)["hostname"]; !ok {
+		t.Fatalf("hostname is not listed in a stopped container")
+	}
+	node, errno := etc.Lookup(ctx, "hostname", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Lookup() = %v", errno)
+	}
+	f := node.Operations().(*File)
+	if _, _, errno := f.Open(ctx, syscall.O_RDONLY); errno != 0 {
+		t.Fatalf("Open() = %v", errno)
+	}
+	defer f.Release(ctx, nil)
+	res, _ := f.Read(ctx, nil, make([]byte, 100), 0)
+	if data, _ := res.Bytes(nil); string(data) != "fake\n" {
+		t.Errorf("read %q, expected %q", data, "fake\n")
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/etc/hosts", "localhost").
+		addFile("/etc/motd", "hi").
+		addSymlink("/bin", "/usr/bin")
+	mng := NewMng("fake", nil, Options{})
+	mng.docker = fake
+
+	est, err := mng.Estimate(context.Background())
+	if err != nil {
+		t.Fatalf("Estimate() failed: %v", err)
+	}
+	if expected := (Estimate{Files: 3, Size: 11, SizeRootFs: 11}); est != expected {
+		t.Errorf("Estimate() = %+v, expected %+v", est, expected)
+	}
+	if mng.staticDirs != nil {
+		t.Errorf("Estimate() kept exported files")
+	}
+}
+
+func TestEstimateWithMountOptions(t *testing.T) {
+	exportRetryDelay = 0
+	fake := newFakeDocker().
+		addFile("/etc/hosts", "localhost").
+		addFile("/app/node_modules/left-pad/index.js", "pad()")
+	fake.exportErrs = []error{syscall.ECONNRESET}
+	mng := NewMng("fake", nil, Options{RetryExport: 2, Exclude: []string{"/*/node_modules"}})
+	mng.docker = fake
+
+	est, err := mng.Estimate(context.Background())
+	if err != nil {
+		t.Fatalf("Estimate() failed: %v", err)
+	}
+	if est.Files != 1 || est.Size != 9 {
+		t.Errorf("Estimate() = %+v, expected /etc/hosts only", est)
+	}
+	if n := fake.count("ContainerExport"); n != 2 {
+		t.Errorf("export fetched %d times, expected a retry", n)
+	}
+}
+
+func TestExportedFiles(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/app/main.js", "main()").
+		addSymlink("/app/current", "/app/releases/1").
+		addFile("/app/node_modules/left-pad/index.js", "pad()").
+		addFile("/etc/hosts", "localhost").
+		change(FileAdded, "/app/main.js").
+		change(FileModified, "/app/node_modules").
+		change(FileModified, "/app")
+	mng := NewMng("fake", nil, Options{Exclude: []string{"/*/node_modules"}})
+	mng.docker = fake
+	ctx := context.Background()
+
+	files, err := mng.ExportedFiles(ctx)
+	if err != nil {
+		t.Fatalf("ExportedFiles() failed: %v", err)
+	}
+	expected := []ExportedFile{
+		{Path: "/app/current", Mode: os.ModeSymlink | 0777, Linkname: "/app/releases/1"},
+		{Path: "/app/main.js", Mode: 0644},
+		{Path: "/etc/hosts", Mode: 0644},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("ExportedFiles() = %+v, expected %+v", files, expected)
+	}
+
+	changes, err := mng.FsChanges(ctx)
+	if err != nil {
+		t.Fatalf("FsChanges() failed: %v", err)
+	}
+	var paths []string
+	for _, ch := range changes {
+		paths = append(paths, ch.Path)
+	}
+	if strings.Join(paths, ",") != "/app,/app/main.js" {
+		t.Errorf("FsChanges() = %+v, expected /app and /app/main.js", changes)
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir, err := cacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// from the least recently used
+	names := []string{"files/old/a", "files/old/b", "files/new/c", "files/new/d", "files/new/e"}
+	old := time.Now().Add(-time.Hour)
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, mtime, mtime)
+	}
+	// a live mount holding cache of the container, older than any cached file
+	hold := filepath.Join(dir, "users", "fake", strconv.Itoa(os.Getpid()))
+	if err := os.MkdirAll(filepath.Dir(hold), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(hold, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(hold, old.Add(-time.Hour), old.Add(-time.Hour))
+
+	pruneCache(250)
+	// the oldest files are pruned
+	for name, kept := range map[string]bool{
+		"files/old/a": false,
+		"files/old/b": false,
+		"files/new/c": false,
+		"files/new/d": true,
+		"files/new/e": true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if kept != (err == nil) {
+			t.Errorf("%s is kept: %v, expected %v", name, err == nil, kept)
+		}
+	}
+	if _, err := os.Stat(hold); err != nil {
+		t.Errorf("cache hold of a live mount is pruned: %v", err)
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	dir, err := cacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFakeDocker().addFile("/etc/motd", "hello\n")
+	mng := NewMng("fake", nil, Options{NoCache: true, FileCache: true})
+	mng.docker = fake
+	if mng.opts.FileCache {
+		t.Errorf("FileCache is kept with NoCache")
+	}
+	var files int
+	if err := mng.WalkArchive(context.Background(), func(hdr *tar.Header) error {
+		files++
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkArchive() failed: %v", err)
+	}
+	if files == 0 {
+		t.Errorf("no files walked")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("cache directory is created with NoCache: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package dockerfs
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pathLocks serializes operations on the same path.
+type pathLocks struct {
+	locks map[string]*pathLock
+	mutex sync.Mutex
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks path and returns function unlocking it.
+func (p *pathLocks) Lock(path string) (unlock func()) {
+	p.mutex.Lock()
+	if p.locks == nil {
+		p.locks = make(map[string]*pathLock)
+	}
+	l, ok := p.locks[path]
+	if !ok {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.refs++
+	p.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(p.locks, path)
+		}
+	}
+}
+
+// LockPair locks two paths in a stable order, so concurrent operations on
+// the same pair don't deadlock.
+func (p *pathLocks) LockPair(a, b string) (unlock func()) {
+	if a == b {
+		return p.Lock(a)
+	}
+	if b < a {
+		a, b = b, a
+	}
+	unlockA := p.Lock(a)
+	unlockB := p.Lock(b)
+	return func() {
+		unlockB()
+		unlockA()
+	}
+}
+
+type pathSet struct {
+	paths map[string]struct{}
+	mutex sync.Mutex
+}
+
+func (s *pathSet) add(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.paths == nil {
+		s.paths = make(map[string]struct{})
+	}
+	s.paths[path] = struct{}{}
+}
+
+func (s *pathSet) remove(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.paths, path)
+}
+
+func (s *pathSet) has(path string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.paths[path]
+	return ok
+}
+
+// Limit of remembered missing paths, all are forgotten once it's reached.
+const maxMissingPaths = 10000
+
+// missingPaths remembers paths found missing, so repeated lookups of them
+// don't reach docker until ttl expires.
+type missingPaths struct {
+	ttl     time.Duration
+	expires map[string]time.Time
+	mutex   sync.Mutex
+}
+
+func (s *missingPaths) add(path string) {
+	if s.ttl <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.expires == nil || len(s.expires) >= maxMissingPaths {
+		s.expires = make(map[string]time.Time)
+	}
+	s.expires[path] = time.Now().Add(s.ttl)
+}
+
+func (s *missingPaths) remove(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.expires, path)
+}
+
+func (s *missingPaths) has(path string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expires, ok := s.expires[path]
+	if ok && time.Now().After(expires) {
+		delete(s.expires, path)
+		return false
+	}
+	return ok
+}
+
+// pathFilter tells which paths of container are a part of the mount, see
+// Options.Include and Options.Exclude. Exclude patterns apply inside of the
+// included subtree.
+type pathFilter struct {
+	// clean path of the mount root in container
+	include string
+	exclude []string
+}
+
+func newPathFilter(include string, exclude []string) pathFilter {
+	return pathFilter{include: filepath.Clean("/" + include), exclude: exclude}
+}
+
+// hides tells if clean path is out of the included subtree or if it or one of
+// its parents matches an exclude pattern.
+func (f pathFilter) hides(path string) bool {
+	if path != f.include && !isUnder(path, f.include) {
+		return true
+	}
+	for ; path != "/"; path = filepath.Dir(path) {
+		for _, pattern := range f.exclude {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// slashPath turns path of Windows container, with backslashes and maybe a
+// drive letter, into a path with slashes like paths of Linux containers.
+func slashPath(path string) string {
+	if len(path) >= 2 && path[1] == ':' && ('a' <= path[0] && path[0] <= 'z' || 'A' <= path[0] && path[0] <= 'Z') {
+		path = path[2:]
+	}
+	return strings.ReplaceAll(path, `\`, "/")
+}
@@ -0,0 +1,90 @@
+package dockerfs
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/plesk/docker-fs/lib/log"
+)
+
+// How often progress of export download is reported.
+var progressInterval = time.Second
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	// first, to be aligned for atomic access
+	n int64
+	r io.Reader
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// withProgress returns reader of r reporting number of bytes read every
+// progressInterval to report, or logging it if report is nil, until the
+// returned function is called. Size of the export isn't known beforehand,
+// docker streams it without Content-Length.
+func withProgress(r io.Reader, report func(fetched int64)) (io.Reader, func()) {
+	counter := &countingReader{r: r}
+	if report == nil {
+		report = progressLogger()
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report(atomic.LoadInt64(&counter.n))
+			}
+		}
+	}()
+	return counter, func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// progressLogger returns report function of withProgress logging progress
+// at warning level, so it's shown at the default log level.
+func progressLogger() func(fetched int64) {
+	return progressReporter(func(msg string) { log.Printf("[warning] %s", msg) })
+}
+
+// ProgressPrinter returns Options.ExportProgress function printing progress
+// of export download to w, e.g. to the terminal mount is run from.
+func ProgressPrinter(w io.Writer) func(fetched int64) {
+	return progressReporter(func(msg string) { fmt.Fprintln(w, msg) })
+}
+
+// progressReporter returns report function of withProgress passing fetched
+// size and rate, or for how long nothing came, to print, so a slow export can
+// be told from a stuck one.
+func progressReporter(print func(msg string)) func(fetched int64) {
+	var last int64
+	lastTime, stalledSince := time.Now(), time.Now()
+	return func(fetched int64) {
+		now := time.Now()
+		if fetched == last {
+			print(fmt.Sprintf("No data of container export for %v, %s fetched so far...",
+				now.Sub(stalledSince).Round(time.Second), units.HumanSize(float64(fetched))))
+		} else {
+			rate := float64(fetched-last) / now.Sub(lastTime).Seconds()
+			print(fmt.Sprintf("Fetched %s of container export (%s/s)...",
+				units.HumanSize(float64(fetched)), units.HumanSize(rate)))
+			stalledSince = now
+		}
+		last, lastTime = fetched, now
+	}
+}
@@ -0,0 +1,57 @@
+package dockerfs
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithProgress(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	var reports []int64
+	pr, pw := io.Pipe()
+	r, stop := withProgress(pr, func(fetched int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, fetched)
+	})
+	go func() {
+		for i := 0; i < 3; i++ {
+			pw.Write(make([]byte, 100))
+			time.Sleep(5 * progressInterval)
+		}
+		pw.Close()
+	}()
+	data, err := ioutil.ReadAll(r)
+	stop()
+	if err != nil || len(data) != 300 {
+		t.Fatalf("read %d bytes, error %v", len(data), err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) < 3 {
+		t.Fatalf("%d reports made, expected one per interval: %v", len(reports), reports)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i] < reports[i-1] || reports[i] > 300 {
+			t.Fatalf("reports %v don't follow read data", reports)
+		}
+	}
+	if reports[0] == 0 || reports[len(reports)-1] != 300 {
+		t.Errorf("reports %v, expected to go from the first chunk up to all data", reports)
+	}
+	// none after stop
+	n := len(reports)
+	mu.Unlock()
+	time.Sleep(3 * progressInterval)
+	mu.Lock()
+	if len(reports) != n {
+		t.Errorf("%d reports made after stop", len(reports)-n)
+	}
+}
@@ -0,0 +1,44 @@
+package dockerfs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/plesk/docker-fs/lib/log"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var _ = (fs.NodeGetattrer)((*Special)(nil))
+var _ = (fs.NodeOpener)((*Special)(nil))
+
+// Special is a device, FIFO or socket node. Only its attributes are served,
+// there is no way to reach the node itself through docker API.
+type Special struct {
+	fs.Inode
+	mng *Mng
+
+	fullpath string
+}
+
+func (s *Special) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) (syserr syscall.Errno) {
+	defer log.Printf("[debug] Special (%s) Getattr(): %v", s.fullpath, syserr)
+	attrs, err := s.mng.docker.GetPathAttrs(ctx, s.fullpath)
+	if err != nil {
+		errno := dockerErrno(err)
+		if errno != syscall.ENOENT {
+			log.Printf("[error] Special (%s) Getting raw attrs failed: %v (%T)", s.fullpath, err, err)
+		}
+		return errno
+	}
+	s.mng.setAttr(&out.Attr, s.fullpath, &attrs)
+	out.Size = 0
+	return 0
+}
+
+// Open is reached only if kernel doesn't handle the node itself, e.g. for
+// devices on mounts allowing them.
+func (s *Special) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, mode uint32, syserr syscall.Errno) {
+	return nil, 0, syscall.ENODEV
+}
@@ -0,0 +1,177 @@
+package dockerfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Command run to reach docker daemon of ssh:// hosts, replaced in tests.
+var sshCommand = "ssh"
+
+// sshDialer connects to docker daemon of ssh://[user@]host[:port] host the
+// same way docker CLI does: `docker system dial-stdio` is run on the host
+// and the API is talked over its stdin and stdout.
+func sshDialer(host string) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("bad ssh host %q, expected ssh://[user@]host[:port]", host)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("bad ssh host %q, path is not supported", host)
+	}
+	var args []string
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return newCommandConn(sshCommand, args...)
+	}, nil
+}
+
+// commandConn is a connection to stdin and stdout of a command. Pipes of
+// a command have no deadlines, the command is killed once its read deadline
+// passes instead, so the connection can't be used after that.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	once   sync.Once
+
+	deadlineMutex sync.Mutex
+	// incremented by every SetReadDeadline, so that timers of previous
+	// deadlines don't fire
+	deadlineGen int
+	deadline    *time.Timer
+	expired     bool
+}
+
+func newCommandConn(name string, args ...string) (net.Conn, error) {
+	cmd := exec.Command(name, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot run %s: %w", name, err)
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err != nil && c.isExpired() {
+		return n, deadlineError{}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	if err != nil && c.isExpired() {
+		return n, deadlineError{}
+	}
+	return n, err
+}
+
+// CloseWrite lets the command know the request is over.
+func (c *commandConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *commandConn) Close() error {
+	c.once.Do(func() {
+		c.deadlineMutex.Lock()
+		if c.deadline != nil {
+			c.deadline.Stop()
+		}
+		c.deadlineMutex.Unlock()
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return commandAddr{}
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return commandAddr{}
+}
+
+func (c *commandConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline arms killing of the command at t, zero t disarms it.
+// Reads of hijacked connections are limited by it, see idleDeadlineReader.
+func (c *commandConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	if c.expired {
+		return deadlineError{}
+	}
+	if c.deadline != nil {
+		c.deadline.Stop()
+		c.deadline = nil
+	}
+	c.deadlineGen++
+	if t.IsZero() {
+		return nil
+	}
+	gen := c.deadlineGen
+	c.deadline = time.AfterFunc(time.Until(t), func() { c.expire(gen) })
+	return nil
+}
+
+// Write deadlines are not supported, writes are limited by contexts of
+// requests.
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// expire kills the command, unless the deadline of gen was changed since.
+func (c *commandConn) expire(gen int) {
+	c.deadlineMutex.Lock()
+	if gen != c.deadlineGen {
+		c.deadlineMutex.Unlock()
+		return
+	}
+	c.expired = true
+	c.deadlineMutex.Unlock()
+	c.Close()
+}
+
+func (c *commandConn) isExpired() bool {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	return c.expired
+}
+
+// deadlineError is returned by I/O of commandConn past its deadline.
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "i/o timeout" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "cmd" }
+func (commandAddr) String() string  { return "cmd" }
@@ -0,0 +1,73 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Files of this size and bigger are streamed from container when open for
+// reading only, instead of being loaded in memory as a whole.
+var streamMinSize int64 = 64 << 20
+
+// Size of content a stream keeps, so slightly reordered reads, e.g. of
+// parallel kernel readahead, are served without loading the whole file.
+const streamWindow = 1 << 20
+
+// fileStream reads content of a file sequentially from its archive.
+type fileStream struct {
+	body io.ReadCloser
+	tr   *tar.Reader
+	// recently read content, starting at offset off
+	buf []byte
+	off int64
+	eof bool
+}
+
+func openFileStream(ctx context.Context, docker dockerMng, path string) (*fileStream, error) {
+	body, err := docker.GetFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(body)
+	if _, err := tr.Next(); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("broken archive of %q: %w", path, err)
+	}
+	return &fileStream{body: body, tr: tr}, nil
+}
+
+// readAt reads content at off into dest. False is returned if off is too far
+// behind or ahead of the stream position to be reached by reading on.
+func (s *fileStream) readAt(dest []byte, off int64) (int, bool, error) {
+	end := s.off + int64(len(s.buf))
+	if off < s.off || off > end+streamWindow {
+		return 0, false, nil
+	}
+	if want := off + int64(len(dest)); want > end && !s.eof {
+		chunk := make([]byte, want-end)
+		n, err := io.ReadFull(s.tr, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.eof, err = true, nil
+		}
+		if err != nil {
+			return 0, true, err
+		}
+		s.buf = append(s.buf, chunk[:n]...)
+	}
+	n := 0
+	if start := off - s.off; start < int64(len(s.buf)) {
+		n = copy(dest, s.buf[start:])
+	}
+	// keep the window only, reallocations of append drop the rest
+	if drop := len(s.buf) - streamWindow; drop > 0 {
+		s.buf = s.buf[drop:]
+		s.off += int64(drop)
+	}
+	return n, true, nil
+}
+
+func (s *fileStream) Close() error {
+	return s.body.Close()
+}
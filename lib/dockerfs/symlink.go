@@ -0,0 +1,111 @@
+package dockerfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/plesk/docker-fs/lib/log"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var _ = (fs.NodeGetattrer)((*Symlink)(nil))
+var _ = (fs.NodeReadlinker)((*Symlink)(nil))
+
+// Symlink is a symbolic link. Its target is read from container again once
+// it's older than FS changes, so a link changed in container is followed to
+// the new target without waiting for the kernel to forget the node.
+type Symlink struct {
+	fs.Inode
+	mng *Mng
+
+	mu       sync.Mutex
+	fullpath string
+	// target as stored in container and stat of the link
+	target  string
+	stat    types.ContainerPathStat
+	updated time.Time
+}
+
+func newSymlink(mng *Mng, path, target string, stat *types.ContainerPathStat) *Symlink {
+	return &Symlink{mng: mng, fullpath: path, target: target, stat: *stat, updated: time.Now()}
+}
+
+// refresh fetches target and stat of the link if they are outdated.
+// Must be called with mu held.
+func (l *Symlink) refresh(ctx context.Context) syscall.Errno {
+	if time.Since(l.updated) < l.mng.changesUpdateInterval {
+		return 0
+	}
+	stat, err := l.mng.docker.GetPathAttrs(ctx, l.fullpath)
+	if err != nil {
+		errno := dockerErrno(err)
+		if errno != syscall.ENOENT {
+			log.Printf("[error] Symlink (%s) Getting raw attrs failed: %v", l.fullpath, err)
+		}
+		return errno
+	}
+	if stat.Mode&os.ModeSymlink == 0 {
+		// replaced, the kernel looks the name up again
+		return syscall.ENOENT
+	}
+	l.target, l.stat, l.updated = l.mng.linkTarget(ctx, l.fullpath, stat.LinkTarget), stat, time.Now()
+	return 0
+}
+
+// linkTarget returns target of symlink at path as stored in container.
+// Targets of links FS changes don't report are known from the export, others
+// are read from the link's archive, or taken from stat if that fails.
+func (m *Mng) linkTarget(ctx context.Context, path, statTarget string) string {
+	changes, _ := m.ChangesInDir(ctx, filepath.Dir(path))
+	changed := false
+	for _, change := range changes {
+		if change.Path == path {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		m.changesMutex.RLock()
+		target, ok := m.linkTargets[path]
+		m.changesMutex.RUnlock()
+		if ok {
+			return target
+		}
+	}
+	target, err := getLinkTarget(ctx, m.docker, path)
+	if err != nil {
+		log.Printf("[error] Failed to read symlink %q, using target from stat: %v", path, err)
+		return statTarget
+	}
+	return target
+}
+
+func (l *Symlink) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) (syserr syscall.Errno) {
+	defer log.Printf("[debug] Symlink (%s) Getattr(): %v", l.fullpath, syserr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if errno := l.refresh(ctx); errno != 0 {
+		return errno
+	}
+	stat := l.stat
+	stat.Size = int64(len(l.target))
+	l.mng.setAttr(&out.Attr, l.fullpath, &stat)
+	return 0
+}
+
+func (l *Symlink) Readlink(ctx context.Context) (target []byte, syserr syscall.Errno) {
+	defer log.Printf("[debug] Symlink (%s) Readlink(): %v", l.fullpath, syserr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if errno := l.refresh(ctx); errno != 0 {
+		return nil, errno
+	}
+	return []byte(l.target), 0
+}
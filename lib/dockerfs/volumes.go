@@ -0,0 +1,151 @@
+package dockerfs
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/plesk/docker-fs/lib/log"
+)
+
+// Content of volumes and bind mounts is not a part of container export, so
+// directories on them are listed from archives of the directories themselves.
+
+// fetchMounts returns destinations of volumes and bind mounts of container.
+// Failure is not fatal, volumes are just listed as they are in the export.
+func (m *Mng) fetchMounts(ctx context.Context) []string {
+	mounts, err := m.docker.Mounts(ctx)
+	if err != nil {
+		log.Printf("[warning] Cannot get mounts of container: %v. Content of volumes won't be listed.", err)
+		return nil
+	}
+	dests := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		dests = append(dests, filepath.Clean(mount.Destination))
+	}
+	return dests
+}
+
+// onVolume tells if clean path dir is a volume or is inside of one.
+func (m *Mng) onVolume(dir string) bool {
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+	for _, dest := range m.mounts {
+		if dir == dest || isUnder(dir, dest) {
+			return true
+		}
+	}
+	return false
+}
+
+// volumesIn returns names of children of clean path dir which are volumes or
+// lead to them, they may be missing in the export as empty directories.
+func (m *Mng) volumesIn(dir string) []string {
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+	var names []string
+	for _, dest := range m.mounts {
+		if isUnder(dest, dir) {
+			names = append(names, strings.SplitN(dest[len(prefix):], "/", 2)[0])
+		}
+	}
+	return names
+}
+
+// volumeChildren returns modes of files in dir by name. A running container
+// lists dir with find, otherwise the archive of the volume dir is on is read
+// once and kept until Refresh, it has the whole subtree of the volume.
+func (m *Mng) volumeChildren(ctx context.Context, dir string) (map[string]os.FileMode, error) {
+	children, err := m.findChildren(ctx, dir)
+	if err == nil {
+		return children, nil
+	}
+	log.Printf("[debug] Cannot list %q in container, reading its archive: %v", dir, err)
+	dest := m.volumeOf(dir)
+	m.volumesMutex.Lock()
+	defer m.volumesMutex.Unlock()
+	dirs, ok := m.volumeDirs[dest]
+	if !ok {
+		if dirs, err = m.fetchVolume(ctx, dest); err != nil {
+			return nil, err
+		}
+		if m.volumeDirs == nil {
+			m.volumeDirs = make(map[string]map[string]map[string]os.FileMode)
+		}
+		m.volumeDirs[dest] = dirs
+	}
+	return dirs[dir], nil
+}
+
+// findChildren lists dir in container, which must be running.
+func (m *Mng) findChildren(ctx context.Context, dir string) (map[string]os.FileMode, error) {
+	out, err := m.exec(ctx, "find", dir, "-maxdepth", "1", "-exec", "stat", "-c", "%f %n", "{}", "+")
+	if err != nil {
+		return nil, err
+	}
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+	children := make(map[string]os.FileMode)
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		// raw mode in hex, which has the type too, and path
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], prefix) {
+			continue
+		}
+		raw, err := strconv.ParseUint(fields[0], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected listing of %q: %q", dir, line)
+		}
+		children[fields[1][len(prefix):]] = (&tar.Header{Mode: int64(raw)}).FileInfo().Mode()
+	}
+	return children, nil
+}
+
+// volumeOf returns destination of the innermost volume clean path dir is on.
+func (m *Mng) volumeOf(dir string) string {
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+	volume := ""
+	for _, dest := range m.mounts {
+		if (dir == dest || isUnder(dir, dest)) && len(dest) > len(volume) {
+			volume = dest
+		}
+	}
+	return volume
+}
+
+// fetchVolume returns content of volume dest by directory, as staticTree does.
+func (m *Mng) fetchVolume(ctx context.Context, dest string) (map[string]map[string]os.FileMode, error) {
+	body, err := m.docker.GetFile(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	files := make(map[string]os.FileMode)
+	tr := tar.NewReader(body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return staticTree(files), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("broken archive of %q: %w", dest, err)
+		}
+		// names start with the base name of dest
+		parts := strings.SplitN(strings.Trim(hdr.Name, "/"), "/", 2)
+		if len(parts) == 2 {
+			files[filepath.Join(dest, parts[1])] = hdr.FileInfo().Mode()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package dockerfs
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+
+	"github.com/plesk/docker-fs/lib/log"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var _ = (fs.NodeGetxattrer)((*File)(nil))
+var _ = (fs.NodeListxattrer)((*File)(nil))
+var _ = (fs.NodeGetxattrer)((*Dir)(nil))
+var _ = (fs.NodeListxattrer)((*Dir)(nil))
+
+// Read-only extended attributes with container metadata, so changed files
+// can be found with e.g. `getfattr -R -n user.dockerfs.change`.
+const (
+	// How path is changed in container, see changeNames. Missing if it isn't.
+	xattrChange = "user.dockerfs.change"
+	// Path in container
+	xattrPath = "user.dockerfs.path"
+)
+
+var changeNames = map[uint8]string{
+	FileModified: "modified",
+	FileAdded:    "added",
+	FileRemoved:  "removed",
+}
+
+func (f *File) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	path := f.fullpath
+	f.mu.Unlock()
+	return getxattr(ctx, f.mng, path, attr, dest)
+}
+
+func (f *File) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	path := f.fullpath
+	f.mu.Unlock()
+	return listxattr(ctx, f.mng, path, dest)
+}
+
+func (d *Dir) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(ctx, d.mng, d.fullpath, attr, dest)
+}
+
+func (d *Dir) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(ctx, d.mng, d.fullpath, dest)
+}
+
+func getxattr(ctx context.Context, m *Mng, path, attr string, dest []byte) (uint32, syscall.Errno) {
+	attrs, errno := xattrs(ctx, m, path)
+	if errno != 0 {
+		return 0, errno
+	}
+	for _, a := range attrs {
+		if a[0] == attr {
+			return copyXattr(dest, []byte(a[1]))
+		}
+	}
+	return 0, syscall.Errno(fuse.ENOATTR)
+}
+
+func listxattr(ctx context.Context, m *Mng, path string, dest []byte) (uint32, syscall.Errno) {
+	attrs, errno := xattrs(ctx, m, path)
+	if errno != 0 {
+		return 0, errno
+	}
+	var names []byte
+	for _, a := range attrs {
+		names = append(append(names, a[0]...), 0)
+	}
+	return copyXattr(dest, names)
+}
+
+// xattrs returns names and values of extended attributes of path.
+func xattrs(ctx context.Context, m *Mng, path string) ([][2]string, syscall.Errno) {
+	path = filepath.Clean(path)
+	attrs := [][2]string{{xattrPath, path}}
+	if path == "/" {
+		return attrs, 0
+	}
+	changes, err := m.ChangesInDir(ctx, filepath.Dir(path))
+	if err != nil {
+		log.Printf("[error] Cannot retrieve FS changes: %v", err)
+		return nil, syscall.EIO
+	}
+	for _, ch := range changes {
+		if filepath.Clean(ch.Path) == path {
+			attrs = append(attrs, [2]string{xattrChange, changeNames[ch.Kind]})
+			break
+		}
+	}
+	return attrs, 0
+}
+
+// copyXattr copies value to dest, ERANGE with size of value is returned if
+// it doesn't fit.
+func copyXattr(dest, value []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
@@ -0,0 +1,58 @@
+package dockerfs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestXattrs(t *testing.T) {
+	fake := newFakeDocker().
+		addFile("/etc/hosts", "localhost").
+		addFile("/etc/passwd", "root")
+	_, root := newTestMng(t, fake, Options{ChangesInterval: -1})
+	fake.addFile("/etc/motd", "hi")
+	fake.change(FileModified, "/etc")
+	fake.change(FileModified, "/etc/passwd")
+	fake.change(FileAdded, "/etc/motd")
+	etc := lookupDir(t, root, "etc")
+
+	for name, expected := range map[string]string{
+		"hosts":  "",
+		"passwd": "modified",
+		"motd":   "added",
+	} {
+		node, errno := etc.Lookup(context.Background(), name, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatalf("Lookup(%s) = %v", name, errno)
+		}
+		f := node.Operations().(*File)
+
+		dest := make([]byte, 64)
+		n, errno := f.Getxattr(context.Background(), xattrChange, dest)
+		if expected == "" {
+			if errno != syscall.Errno(fuse.ENOATTR) {
+				t.Errorf("%s: Getxattr(%s) = %q, %v, expected ENOATTR", name, xattrChange, dest[:n], errno)
+			}
+		} else if errno != 0 || string(dest[:n]) != expected {
+			t.Errorf("%s: Getxattr(%s) = %q, %v, expected %q", name, xattrChange, dest[:n], errno, expected)
+		}
+
+		n, errno = f.Getxattr(context.Background(), xattrPath, dest)
+		if errno != 0 || string(dest[:n]) != "/etc/"+name {
+			t.Errorf("%s: Getxattr(%s) = %q, %v", name, xattrPath, dest[:n], errno)
+		}
+	}
+
+	// size of the list is reported if it doesn't fit
+	size, errno := etc.Listxattr(context.Background(), nil)
+	if errno != syscall.ERANGE {
+		t.Fatalf("Listxattr() = %v, expected ERANGE", errno)
+	}
+	dest := make([]byte, size)
+	if n, errno := etc.Listxattr(context.Background(), dest); errno != 0 || string(dest[:n]) != xattrPath+"\x00"+xattrChange+"\x00" {
+		t.Errorf("Listxattr() = %q, %v", dest[:n], errno)
+	}
+}
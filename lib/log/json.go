@@ -0,0 +1,70 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	golog "log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of log records, see SetFormat.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	jsonFormat bool
+	// added to every JSON record, see SetField
+	fields = make(map[string]string)
+	// guards fields and writing of JSON records
+	jsonMutex sync.Mutex
+)
+
+// Records of FS nodes start with node type and path, e.g. "Dir (%s) Lookup(%s)".
+var nodeRecord = regexp.MustCompile(`^(File|Dir|Special) ?\(%[sqv]\)`)
+
+// SetFormat makes records plain text (the default) or JSON objects, one per
+// line, with time, level, msg and path fields.
+func SetFormat(format string) error {
+	switch strings.ToLower(format) {
+	case FormatText:
+		jsonFormat = false
+	case FormatJSON:
+		jsonFormat = true
+	default:
+		return fmt.Errorf("Unknown log format: %v", format)
+	}
+	return nil
+}
+
+// SetField adds field to every JSON record, e.g. id of served container.
+func SetField(key, value string) {
+	jsonMutex.Lock()
+	defer jsonMutex.Unlock()
+	fields[key] = value
+}
+
+func printJSON(level LogLevel, format string, v []interface{}) {
+	format = strings.TrimPrefix(format, "["+level.String()+"] ")
+	record := map[string]string{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"),
+	}
+	if nodeRecord.MatchString(format) && len(v) > 0 {
+		record["path"] = fmt.Sprint(v[0])
+	}
+
+	jsonMutex.Lock()
+	defer jsonMutex.Unlock()
+	for key, value := range fields {
+		record[key] = value
+	}
+	// map of strings is always encoded
+	data, _ := json.Marshal(record)
+	golog.Writer().Write(append(data, '\n'))
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"fmt"
 	golog "log"
+	"os"
 	"strings"
 )
 
@@ -53,25 +54,37 @@ func SetLevel(level string) error {
 }
 
 func Printf(format string, v ...interface{}) {
+	// Warning level by default
+	level := Warning
 	for _, lvl := range allLevels {
 		if strings.HasPrefix(format, "["+lvl.String()+"] ") {
-			if Level >= lvl {
-				golog.Printf(format, v...)
-			}
-			return
+			level = lvl
+			break
 		}
 	}
-	// Warning level by default
-	if Level >= Warning {
-		golog.Printf(format, v...)
+	if Level < level {
+		return
+	}
+	if jsonFormat {
+		printJSON(level, format, v)
+		return
 	}
+	golog.Printf(format, v...)
 }
 
 //pass through
 func Fatal(v ...interface{}) {
+	if jsonFormat {
+		printJSON(Critical, "%s", []interface{}{fmt.Sprint(v...)})
+		os.Exit(1)
+	}
 	golog.Fatal(v...)
 }
 
 func Fatalf(format string, v ...interface{}) {
+	if jsonFormat {
+		printJSON(Critical, format, v)
+		os.Exit(1)
+	}
 	golog.Fatalf(format, v...)
 }
@@ -1,9 +1,14 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	golog "log"
+	"os"
+	"reflect"
 	"strings"
+	"testing"
+	"time"
 )
 
 func ExamplePrintf() {
@@ -28,3 +33,41 @@ func ExamplePrintf() {
 	// [warning] something that may require some attention
 	// [info] message about what the program is doing
 }
+
+func TestJSONFormat(t *testing.T) {
+	buffer := strings.Builder{}
+	golog.SetOutput(&buffer)
+	defer golog.SetOutput(os.Stderr)
+	if err := SetFormat("json"); err != nil {
+		t.Fatalf("SetFormat() failed: %v", err)
+	}
+	defer SetFormat(FormatText)
+	SetField("container", "web")
+	defer delete(fields, "container")
+
+	SetLevel("debug")
+	Printf("[debug] Dir (%s) Lookup(%s): %v", "/etc", "hosts", "no such file")
+	Printf("regular message")
+	Printf("[trace] filtered out")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d records logged, expected 2: %q", len(lines), lines)
+	}
+	for i, expected := range []map[string]string{
+		{"level": "debug", "msg": "Dir (/etc) Lookup(hosts): no such file", "path": "/etc", "container": "web"},
+		{"level": "warning", "msg": "regular message", "container": "web"},
+	} {
+		var record map[string]string
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("record %q is not JSON: %v", lines[i], err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record["time"]); err != nil {
+			t.Errorf("record %q has bad time: %v", lines[i], err)
+		}
+		delete(record, "time")
+		if !reflect.DeepEqual(record, expected) {
+			t.Errorf("record = %v, expected %v", record, expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/docker/docker/api/types/versions"
+)
+
+// Check is a result of one of the self-test checks.
+type Check struct {
+	Name string
+	// What was found, e.g. API version, if the check passed
+	Detail string
+	Err    error
+}
+
+// Doctor checks what mounting needs: the docker daemon, export of container
+// (if containerId is given) and FUSE. Checks of docker are skipped once
+// the daemon is unreachable.
+func (m *Manager) Doctor(containerId string) []Check {
+	checks := m.checkDocker(containerId)
+	if runtime.GOOS == "linux" {
+		checks = append(checks, checkFuseDevice(), checkFusermount())
+	}
+	return checks
+}
+
+func (m *Manager) checkDocker(containerId string) []Check {
+	ctx := context.Background()
+	reach := Check{Name: "docker daemon is reachable"}
+	cli, err := m.Clients.Client()
+	if err == nil {
+		_, err = cli.Ping(ctx)
+	}
+	if err != nil {
+		reach.Err = err
+		return []Check{reach}
+	}
+	reach.Detail = cli.DaemonHost()
+
+	api := Check{Name: "docker API version is supported"}
+	version, err := cli.ServerVersion(ctx)
+	switch {
+	case err != nil:
+		api.Err = err
+	case versions.LessThan(cli.ClientVersion(), version.MinAPIVersion):
+		api.Err = fmt.Errorf("API %s is older than %s the daemon supports", cli.ClientVersion(), version.MinAPIVersion)
+	case versions.GreaterThan(cli.ClientVersion(), version.APIVersion):
+		api.Err = fmt.Errorf("API %s is newer than %s the daemon supports", cli.ClientVersion(), version.APIVersion)
+	default:
+		api.Detail = "API " + cli.ClientVersion()
+	}
+	checks := []Check{reach, api}
+	if containerId == "" {
+		return checks
+	}
+
+	export := Check{Name: "container export is readable"}
+	export.Detail, export.Err = m.checkExport(ctx, containerId)
+	return append(checks, export)
+}
+
+// checkExport reads the first entry of container export, the whole of it
+// may be huge.
+func (m *Manager) checkExport(ctx context.Context, containerId string) (string, error) {
+	id, err := m.ResolveContainer(containerId)
+	if err != nil {
+		return "", err
+	}
+	cli, err := m.Clients.Client()
+	if err != nil {
+		return "", err
+	}
+	body, err := cli.ContainerExport(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if _, err := tar.NewReader(body).Next(); err != nil {
+		return "", fmt.Errorf("broken container archive: %w", err)
+	}
+	return fmt.Sprintf("%.12s", id), nil
+}
+
+func checkFuseDevice() Check {
+	check := Check{Name: "/dev/fuse is accessible"}
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	f.Close()
+	return check
+}
+
+func checkFusermount() Check {
+	check := Check{Name: "fusermount is on PATH"}
+	for _, name := range []string{"fusermount", "fusermount3"} {
+		if path, err := exec.LookPath(name); err == nil {
+			check.Detail = path
+			return check
+		}
+	}
+	check.Err = errors.New("neither fusermount nor fusermount3 is found")
+	return check
+}
@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/client"
+)
+
+type hint struct {
+	match func(err error) bool
+	text  string
+}
+
+var hints = []hint{
+	{
+		match: containsAny("permission denied while trying to connect to the docker daemon"),
+		text:  "add your user to the 'docker' group (sudo usermod -aG docker $USER) and re-login, or run docker-fs with sudo",
+	},
+	{
+		match: containsAny("cannot connect to the docker daemon", "is the docker daemon running"),
+		text:  "make sure the docker daemon is running and DOCKER_HOST points to it",
+	},
+	{
+		match: func(err error) bool {
+			return anyInChain(err, client.IsErrNotFound) || containsAny("no such container")(err)
+		},
+		text: "check the container id or name with 'docker ps -a'",
+	},
+	{
+		match: containsAny("/dev/fuse", "fusermount", "fuse: device not found"),
+		text:  "install FUSE (e.g. 'apt install fuse' or macFUSE on macOS) and check that /dev/fuse is accessible",
+	},
+	{
+		match: containsAny("'user_allow_other' is not enabled"),
+		text:  "add a 'user_allow_other' line to /etc/fuse.conf (as root), or mount without -allow-other and -allow-root",
+	},
+	{
+		match: containsAny("transport endpoint is not connected"),
+		text:  "the mount point is left over from a crashed mount, mount with -force or release it with 'fusermount -u <mount point>'",
+	},
+	{
+		match: func(err error) bool {
+			return errors.Is(err, syscall.EBUSY) || containsAny("device or resource busy")(err)
+		},
+		text: "the mount point is busy, unmount it first or choose another directory",
+	},
+}
+
+// Hint returns an actionable suggestion for a well-known failure or an
+// empty string if the error is not recognized.
+func Hint(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, h := range hints {
+		if h.match(err) {
+			return h.text
+		}
+	}
+	return ""
+}
+
+func containsAny(substrs ...string) func(err error) bool {
+	return func(err error) bool {
+		msg := strings.ToLower(err.Error())
+		for _, s := range substrs {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// docker client predicates don't unwrap errors wrapped with %w.
+func anyInChain(err error, pred func(error) bool) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if pred(err) {
+			return true
+		}
+	}
+	return false
+}
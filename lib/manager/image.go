@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/plesk/docker-fs/lib/log"
+
+	"github.com/plesk/docker-fs/lib/dockerfs"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Label of containers created to mount images, e.g. to find ones left by
+// a killed docker-fs.
+const imageMountLabel = "docker-fs.image-mount"
+
+// ImageKey is the status key of a mount made by MountImage.
+func ImageKey(image string) string {
+	return "image:" + image
+}
+
+// MountImage serves FS of image at mountPoint until it's unmounted. The FS
+// is read from a container created from the image, which is never started
+// and is removed on unmount. The mount is read-only. With opts.Layer, files
+// are read from image layers up to that one instead.
+func (m *Manager) MountImage(image, mountPoint string, opts MountOptions) error {
+	opts.ReadOnly = true
+	// cache of the container is of no use once it's removed
+	opts.KeepCache = false
+	return m.mount(ImageKey(image), mountPoint, opts, func(opts MountOptions) (fs.InodeEmbedder, served, func() MountResult, error) {
+		log.Printf("[info] Creating container of image %v...", image)
+		id, err := m.createImageContainer(image)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot create container of image %s: %w", image, err)
+		}
+		remove := func() { m.removeImageContainer(id) }
+		dockerMng := dockerfs.NewMng(id, m.Clients, opts.Options)
+		if opts.Layer != "" {
+			log.Printf("[info] Applying layers of image %v up to %v...", image, opts.Layer)
+			removeLayers, err := dockerMng.ServeLayer(context.Background(), image, opts.Layer)
+			if err != nil {
+				remove()
+				return nil, nil, nil, fmt.Errorf("cannot read layers of image %s: %w", image, err)
+			}
+			remove = func() {
+				removeLayers()
+				m.removeImageContainer(id)
+			}
+		}
+		log.Printf("[info] Fetching content of container %v...", id)
+		if err := dockerMng.Init(); err != nil {
+			remove()
+			return nil, nil, nil, fmt.Errorf("dockerMng.Init() failed: %w", err)
+		}
+		result := func() MountResult {
+			result := m.mountResult(id, mountPoint, dockerMng)
+			result.ContainerId = ImageKey(image)
+			return result
+		}
+		return dockerMng.Root(), &imageServed{Mng: dockerMng, remove: remove}, result, nil
+	})
+}
+
+// imageServed is FS of image, served from a container removed with its cache.
+type imageServed struct {
+	*dockerfs.Mng
+	remove func()
+}
+
+func (s *imageServed) RemoveCache() {
+	s.Mng.RemoveCache()
+	s.remove()
+}
+
+// createImageContainer creates a container of image, without starting it.
+func (m *Manager) createImageContainer(image string) (string, error) {
+	cli, err := m.Clients.Client()
+	if err != nil {
+		return "", err
+	}
+	config := &container.Config{
+		Image: image,
+		// images without a command can't be created otherwise, it's never run
+		Cmd:    []string{"true"},
+		Labels: map[string]string{imageMountLabel: image},
+	}
+	created, err := cli.ContainerCreate(context.Background(), config, nil, nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (m *Manager) removeImageContainer(id string) {
+	cli, err := m.Clients.Client()
+	if err == nil {
+		err = cli.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+	}
+	if err != nil {
+		log.Printf("[error] Cannot remove container %.12s: %v", id, err)
+		return
+	}
+	log.Printf("[info] Container %.12s removed.", id)
+}
@@ -1,17 +1,22 @@
 package manager
 
 import (
+	"archive/tar"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/plesk/docker-fs/lib/log"
 
@@ -23,8 +28,16 @@ import (
 	daemon "github.com/sevlyar/go-daemon"
 )
 
+const fuseConfPath = "/etc/fuse.conf"
+
 type Manager struct {
 	statusPath string
+
+	// Docker connection settings, shared by all docker clients
+	Clients *dockerfs.ClientFactory
+
+	// Log hints on how to fix well-known errors
+	PrettyErrors bool
 }
 
 func New() *Manager {
@@ -35,26 +48,214 @@ func New() *Manager {
 	}
 	return &Manager{
 		statusPath: filepath.Join(home, ".dockerfs.status.json"),
+		Clients:    &dockerfs.ClientFactory{},
 	}
 }
 
 func (m *Manager) ListContainers() (container_list []types.Container, err error) {
 	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := m.Clients.Client()
 	if err != nil {
 		return nil, err
 	}
 
-	container_list, err = cli.ContainerList(ctx, types.ContainerListOptions{})
+	container_list, err = cli.ContainerList(ctx, types.ContainerListOptions{All: true})
 	return
 }
 
-func (m *Manager) MountContainer(containerId, mountPoint string, daemonize bool) error {
-	if err := m.writeStatus(containerId, mountPoint); err != nil {
+// ResolveContainer returns the full ID of container id if docker knows such
+// container. Otherwise it's looked up as a prefix of container names and IDs,
+// the ID of the only matching container is returned.
+func (m *Manager) ResolveContainer(id string) (string, error) {
+	ctx := context.Background()
+	cli, err := m.Clients.Client()
+	if err != nil {
+		return "", err
+	}
+	info, err := cli.ContainerInspect(ctx, id)
+	if err == nil {
+		return info.ID, nil
+	}
+	if !client.IsErrNotFound(err) {
+		return "", err
+	}
+	list, listErr := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if listErr != nil {
+		return "", listErr
+	}
+	var matches []types.Container
+	for _, ct := range list {
+		if containerMatches(ct, id) {
+			matches = append(matches, ct)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", err
+	case 1:
+		return matches[0].ID, nil
+	}
+	var names []string
+	for _, ct := range matches {
+		name := fmt.Sprintf("%.12s", ct.ID)
+		if len(ct.Names) > 0 {
+			name = fmt.Sprintf("%s (%s)", strings.TrimPrefix(ct.Names[0], "/"), name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("container %q is ambiguous, it matches %s", id, strings.Join(names, ", "))
+}
+
+// containerMatches tells if prefix starts ID or any name of container.
+func containerMatches(ct types.Container, prefix string) bool {
+	if strings.HasPrefix(ct.ID, prefix) {
+		return true
+	}
+	for _, name := range ct.Names {
+		if strings.HasPrefix(strings.TrimPrefix(name, "/"), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MountOptions configure a single container mount.
+type MountOptions struct {
+	// Detach from terminal and keep serving in background
+	Daemonize bool
+	// Report unmounting on signal to terminal
+	Foreground bool
+
+	// Release stale mounts of the container and at the mount point
+	Force bool
+
+	// Let root access the mount (FUSE allow_root option)
+	AllowRoot bool
+	// Let all users access the mount (FUSE allow_other option)
+	AllowOther bool
+
+	// Digest of image layer to mount the image as of, see MountImage
+	Layer string
+
+	// Called with the result once the container FS is mounted. When
+	// daemonizing, it's called by the parent process with PID of the daemon only.
+	Report func(MountResult)
+
+	dockerfs.Options
+}
+
+// MountResult describes how a container got mounted.
+type MountResult struct {
+	ContainerId   string   `json:"container_id"`
+	ContainerName string   `json:"container_name,omitempty"`
+	MountPoint    string   `json:"mountpoint"`
+	Pid           int      `json:"pid"`
+	ReadOnly      bool     `json:"read_only"`
+	State         string   `json:"state,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// AllContainers is the status key of a mount made by MountContainers.
+const AllContainers = "*"
+
+// served is a container FS served by a mount.
+type served interface {
+	// stop background work
+	Close()
+	// save deferred changes
+	Sync()
+	// fetch content of container again
+	Refresh(ctx context.Context) error
+	// remove cached content of container, unless it's kept
+	RemoveCache()
+}
+
+// MountContainer serves FS of container at mountPoint until it's unmounted.
+// Container may be given by a unique prefix of its name, see ResolveContainer.
+func (m *Manager) MountContainer(containerId, mountPoint string, opts MountOptions) error {
+	containerId, err := m.ResolveContainer(containerId)
+	if err != nil {
+		return err
+	}
+	return m.mount(containerId, mountPoint, opts, func(opts MountOptions) (fs.InodeEmbedder, served, func() MountResult, error) {
+		log.Printf("[info] Fetching content of container %v...", containerId)
+		dockerMng := dockerfs.NewMng(containerId, m.Clients, opts.Options)
+		if err := dockerMng.Init(); err != nil {
+			return nil, nil, nil, fmt.Errorf("dockerMng.Init() failed: %w", err)
+		}
+		result := func() MountResult {
+			return m.mountResult(containerId, mountPoint, dockerMng)
+		}
+		return dockerMng.Root(), dockerMng, result, nil
+	})
+}
+
+// MountContainers mounts a directory listing all containers, stopped ones
+// included. Content of a container is fetched when its directory is looked up
+// first.
+func (m *Manager) MountContainers(mountPoint string, opts MountOptions) error {
+	return m.mount(AllContainers, mountPoint, opts, func(opts MountOptions) (fs.InodeEmbedder, served, func() MountResult, error) {
+		root := dockerfs.NewContainers(m.Clients, opts.Options)
+		result := func() MountResult {
+			return MountResult{ContainerId: AllContainers, MountPoint: mountPoint, Pid: os.Getpid(), ReadOnly: opts.ReadOnly}
+		}
+		return root, root, result, nil
+	})
+}
+
+// mount serves root made by load at mountPoint until it's unmounted. Load is
+// given opts as they are in the process serving the mount.
+func (m *Manager) mount(id, mountPoint string, opts MountOptions, load func(opts MountOptions) (fs.InodeEmbedder, served, func() MountResult, error)) (err error) {
+	absPath, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return err
+	}
+	log.SetField("container", id)
+	if err := m.releaseStaleMounts(id, absPath, opts.Force); err != nil {
 		return err
 	}
 
-	if daemonize {
+	mountOpts := fuse.MountOptions{}
+	if opts.ReadOnly {
+		mountOpts.Options = append(mountOpts.Options, "ro")
+	}
+	if opts.AllowRoot {
+		if err := checkUserAllowOther(); err != nil {
+			return fmt.Errorf("cannot mount with allow_root: %w", err)
+		}
+		mountOpts.Options = append(mountOpts.Options, "allow_root")
+	}
+	if opts.AllowOther {
+		if err := checkUserAllowOther(); err != nil {
+			return fmt.Errorf("cannot mount with allow_other: %w", err)
+		}
+		mountOpts.AllowOther = true
+	}
+
+	// daemon records itself once it's started
+	mountStatus := MountStatus{
+		MountPoint: mountPoint,
+		ReadOnly:   opts.ReadOnly,
+		Pid:        os.Getpid(),
+		MountedAt:  time.Now(),
+		Loading:    true,
+	}
+	if cli, err := m.Clients.Client(); err == nil {
+		mountStatus.DockerHost = cli.DaemonHost()
+	}
+	if err := m.writeStatus(id, mountStatus); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// nothing is mounted
+			m.writeStatus(id, MountStatus{})
+		}
+	}()
+
+	if opts.Daemonize {
 		ctx := daemon.Context{}
 		child, err := ctx.Reborn()
 		if err != nil {
@@ -62,60 +263,215 @@ func (m *Manager) MountContainer(containerId, mountPoint string, daemonize bool)
 		}
 		if child != nil {
 			// parent process
+			if opts.ExportProgress != nil {
+				if err := m.waitLoaded(id, child, opts.ExportProgress); err != nil {
+					return err
+				}
+			}
+			if opts.Report != nil {
+				opts.Report(MountResult{ContainerId: id, MountPoint: mountPoint, Pid: child.Pid})
+			}
 			return nil
 		}
+		// the parent reports progress, if it waits for the mount
+		opts.ExportProgress = m.recordProgress(id)
 	}
 
 	log.Printf("[info] Check if mount directory exists (%v)...", mountPoint)
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
 		return err
 	}
-	log.Printf("[info] Fetching content of container %v...", containerId)
-	dockerMng := dockerfs.NewMng(containerId)
-	if err := dockerMng.Init(); err != nil {
-		return fmt.Errorf("dockerMng.Init() failed: %w", err)
+	root, srv, result, err := load(opts)
+	if err != nil {
+		return err
 	}
 
-	root := dockerMng.Root()
-
 	log.Printf("[info] Mounting FS to %v...", mountPoint)
-	server, err := fs.Mount(mountPoint, root, &fs.Options{})
+	server, err := fs.Mount(mountPoint, root, &fs.Options{MountOptions: mountOpts})
 	if err != nil {
+		srv.Close()
+		srv.RemoveCache()
 		return fmt.Errorf("mount failed: %w", err)
 	}
 
 	log.Printf("[info] Setting up signal handler...")
 	osSignalChannel := make(chan os.Signal, 1)
 	signal.Notify(osSignalChannel, syscall.SIGTERM, syscall.SIGINT)
-	go shutdown(server, osSignalChannel)
+	go m.shutdown(server, srv, mountPoint, opts.Foreground, osSignalChannel)
+	refreshSignals := make(chan os.Signal, 1)
+	signal.Notify(refreshSignals, syscall.SIGHUP)
+	go m.refresh(srv, refreshSignals)
 
+	mountStatus.Loading = false
+	if err := m.writeStatus(id, mountStatus); err != nil {
+		log.Printf("[warning] Cannot record mount as served: %v", err)
+	}
 	log.Printf("[info] OK!")
+	if opts.Report != nil {
+		opts.Report(result())
+	}
 	server.Wait()
+	srv.Close()
+	srv.Sync()
+	srv.RemoveCache()
 	log.Printf("[info] Server finished.")
 
-	return m.writeStatus(containerId, "")
+	return m.writeStatus(id, MountStatus{})
+}
+
+// Estimate tells how much mounting of a container with opts fetches, without
+// mounting it.
+func (m *Manager) Estimate(containerId string, opts dockerfs.Options) (dockerfs.Estimate, error) {
+	containerId, err := m.ResolveContainer(containerId)
+	if err != nil {
+		return dockerfs.Estimate{}, err
+	}
+	dockerMng := dockerfs.NewMng(containerId, m.Clients, opts)
+	return dockerMng.Estimate(context.Background())
 }
 
+// DumpArchive calls fn for every raw entry of the container export.
+func (m *Manager) DumpArchive(containerId string, fn func(hdr *tar.Header) error) error {
+	containerId, err := m.ResolveContainer(containerId)
+	if err != nil {
+		return err
+	}
+	dockerMng := dockerfs.NewMng(containerId, m.Clients, dockerfs.Options{})
+	return dockerMng.WalkArchive(context.Background(), fn)
+}
+
+// ExportedFiles returns files of the container export sorted by path.
+func (m *Manager) ExportedFiles(containerId string) ([]dockerfs.ExportedFile, error) {
+	containerId, err := m.ResolveContainer(containerId)
+	if err != nil {
+		return nil, err
+	}
+	dockerMng := dockerfs.NewMng(containerId, m.Clients, dockerfs.Options{})
+	return dockerMng.ExportedFiles(context.Background())
+}
+
+// FsChanges returns changes of the container FS sorted by path.
+func (m *Manager) FsChanges(containerId string) ([]container.ContainerChangeResponseItem, error) {
+	containerId, err := m.ResolveContainer(containerId)
+	if err != nil {
+		return nil, err
+	}
+	dockerMng := dockerfs.NewMng(containerId, m.Clients, dockerfs.Options{})
+	return dockerMng.FsChanges(context.Background())
+}
+
+// ReadFile returns content of a regular file in container.
+func (m *Manager) ReadFile(containerId, path string) ([]byte, error) {
+	containerId, err := m.ResolveContainer(containerId)
+	if err != nil {
+		return nil, err
+	}
+	dockerMng := dockerfs.NewMng(containerId, m.Clients, dockerfs.Options{})
+	return dockerMng.ReadFile(context.Background(), path)
+}
+
+// Unprivileged users may share their mounts only if fuse.conf permits it.
+func checkUserAllowOther() error {
+	if os.Geteuid() == 0 || runtime.GOOS != "linux" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fuseConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return nil
+		}
+	}
+	return fmt.Errorf("'user_allow_other' is not enabled in %s", fuseConfPath)
+}
+
+// UnmountContainer unmounts container id mounted at path. It's removed from
+// status file once unmounted, or if path turns out not to be mounted.
 func (m *Manager) UnmountContainer(id, path string) error {
-	cmd := exec.Command("umount", path)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	_ = cmd.Run()
-	return m.writeStatus(id, "")
+	if mounted, err := isMounted(path); err == nil && !mounted && !isStale(path) {
+		log.Printf("[warning] %s is not mounted", path)
+		return m.writeStatus(id, MountStatus{})
+	}
+	if err := unmountPath(path); err != nil {
+		return fmt.Errorf("cannot unmount %s: %w", path, err)
+	}
+	return m.writeStatus(id, MountStatus{})
 }
 
-func (m *Manager) writeStatus(id, path string) error {
-	fmt.Printf("write status: %q = %q\n", id, path)
+// UnmountResult is an outcome of unmounting a single container.
+type UnmountResult struct {
+	Id         string
+	MountPoint string
+	Err        error
+}
+
+// UnmountAll unmounts every container recorded in status file. It doesn't stop
+// on failures, check Err of results.
+func (m *Manager) UnmountAll() ([]UnmountResult, error) {
+	status, err := m.ReadStatus()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(status))
+	for id := range status {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var results []UnmountResult
+	for _, id := range ids {
+		results = append(results, UnmountResult{
+			Id:         id,
+			MountPoint: status[id].MountPoint,
+			Err:        m.UnmountContainer(id, status[id].MountPoint),
+		})
+	}
+	return results, nil
+}
+
+// MountStatus describes a mount recorded in status file.
+type MountStatus struct {
+	MountPoint string `json:"mountpoint"`
+	ReadOnly   bool   `json:"read_only,omitempty"`
+	// Process serving the mount, 0 if unknown
+	Pid int `json:"pid,omitempty"`
+	// Docker daemon the container is served from, empty if unknown
+	DockerHost string `json:"docker_host,omitempty"`
+	// Zero if unknown
+	MountedAt time.Time `json:"mounted_at"`
+	// Mount is not served yet, content of container is being fetched
+	Loading bool `json:"loading,omitempty"`
+	// Bytes of container export fetched so far while loading
+	Fetched int64 `json:"fetched,omitempty"`
+}
+
+// UnmarshalJSON accepts a plain mount point too, as status files
+// of older versions have it.
+func (s *MountStatus) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*s = MountStatus{}
+		return json.Unmarshal(data, &s.MountPoint)
+	}
+	type plain MountStatus
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// writeStatus records mount of container id, empty mount point removes it.
+func (m *Manager) writeStatus(id string, mount MountStatus) error {
+	log.Printf("[debug] write status: %q = %+v", id, mount)
 	status, err := m.ReadStatus()
 	if err != nil {
 		return err
 	}
-	if path != "" {
-		absPath, err := filepath.Abs(path)
+	if mount.MountPoint != "" {
+		absPath, err := filepath.Abs(mount.MountPoint)
 		if err != nil {
 			return err
 		}
-		status[id] = absPath
+		mount.MountPoint = absPath
+		status[id] = mount
 	} else {
 		delete(status, id)
 	}
@@ -123,32 +479,144 @@ func (m *Manager) writeStatus(id, path string) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("status => %s\n", data)
+	log.Printf("[debug] status => %s", data)
 	return ioutil.WriteFile(m.statusPath, data, 0644)
 }
 
-func (m *Manager) ReadStatus() (map[string]string, error) {
+// How often the parent of a daemon checks if it has loaded the mount.
+var loadPollInterval = time.Second
+
+// recordProgress returns dockerfs.Options.ExportProgress function recording
+// bytes fetched in status of mount id while it's loading, for waitLoaded.
+func (m *Manager) recordProgress(id string) func(fetched int64) {
+	return func(fetched int64) {
+		status, err := m.ReadStatus()
+		if err != nil {
+			return
+		}
+		if mount, ok := status[id]; ok && mount.Loading && mount.Pid == os.Getpid() {
+			mount.Fetched = fetched
+			m.writeStatus(id, mount)
+		}
+	}
+}
+
+// waitLoaded passes progress of daemon loading mount id, recorded in status
+// file, to progress until the mount is served.
+func (m *Manager) waitLoaded(id string, proc *os.Process, progress func(fetched int64)) error {
+	exited := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(exited)
+	}()
+	ticker := time.NewTicker(loadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("mount process %d exited before serving the mount", proc.Pid)
+		case <-ticker.C:
+		}
+		status, err := m.ReadStatus()
+		if err != nil {
+			// being written by the daemon
+			continue
+		}
+		mount, ok := status[id]
+		switch {
+		case !ok || mount.Pid != proc.Pid:
+			// not recorded by the daemon yet
+		case !mount.Loading:
+			return nil
+		case mount.Fetched > 0:
+			progress(mount.Fetched)
+		}
+	}
+}
+
+func (m *Manager) ReadStatus() (map[string]MountStatus, error) {
 	data, err := ioutil.ReadFile(m.statusPath)
 	if os.IsNotExist(err) {
-		return map[string]string{}, nil
+		return map[string]MountStatus{}, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	status := map[string]string{}
+	status := map[string]MountStatus{}
 	if err := json.Unmarshal(data, &status); err != nil {
 		return nil, err
 	}
 	return status, nil
 }
 
-func shutdown(server *fuse.Server, signals <-chan os.Signal) {
-	<-signals
+func (m *Manager) mountResult(containerId, mountPoint string, dockerMng *dockerfs.Mng) MountResult {
+	result := MountResult{
+		ContainerId: containerId,
+		MountPoint:  mountPoint,
+		Pid:         os.Getpid(),
+		ReadOnly:    dockerMng.ReadOnly(),
+		Warnings:    dockerMng.Warnings(),
+	}
+	cli, err := m.Clients.Client()
+	if err == nil {
+		var info types.ContainerJSON
+		info, err = cli.ContainerInspect(context.Background(), containerId)
+		if err == nil {
+			result.ContainerId = info.ID
+			result.ContainerName = strings.TrimPrefix(info.Name, "/")
+			if info.State != nil {
+				result.State = info.State.Status
+			}
+		}
+	}
+	if err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("cannot inspect container: %v", err))
+	}
+	return result
+}
+
+func (m *Manager) shutdown(server *fuse.Server, srv served, mountPoint string, foreground bool, signals <-chan os.Signal) {
+	sig := <-signals
+	if foreground {
+		fmt.Fprintf(os.Stderr, "\nGot %v, unmounting %s...\n", sig, mountPoint)
+	}
 	if err := server.Unmount(); err != nil {
 		log.Printf("[warning] server unmount failed: %v", err)
+		m.logHint(err)
+		if foreground {
+			fmt.Fprintf(os.Stderr, "Unmount failed: %v\n", err)
+		}
 		os.Exit(1)
 	}
+	srv.Close()
+	srv.Sync()
+	srv.RemoveCache()
 
 	log.Printf("[info] Unmount successful.")
+	if foreground {
+		fmt.Fprintf(os.Stderr, "Unmounted %s.\n", mountPoint)
+	}
 	os.Exit(0)
 }
+
+// refresh fetches content of container again on every signal, so the mount
+// catches up with changes docker diff doesn't show.
+func (m *Manager) refresh(srv served, signals <-chan os.Signal) {
+	for range signals {
+		log.Printf("[info] Refreshing container content...")
+		if err := srv.Refresh(context.Background()); err != nil {
+			log.Printf("[error] Refresh failed: %v", err)
+			continue
+		}
+		log.Printf("[info] Refresh done.")
+	}
+}
+
+func (m *Manager) logHint(err error) {
+	if !m.PrettyErrors {
+		return
+	}
+	if hint := Hint(err); hint != "" {
+		log.Printf("[error] Try: %s", hint)
+	}
+}
@@ -0,0 +1,435 @@
+package manager
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/plesk/docker-fs/lib/dockerfs"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+func TestStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{statusPath: filepath.Join(dir, "status.json")}
+
+	// written by older versions
+	if err := ioutil.WriteFile(m.statusPath, []byte(`{"old":"/mnt/old","ro":{"mountpoint":"/mnt/ro","read_only":true}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mountedAt := time.Unix(1600000000, 0).UTC()
+	newMount := MountStatus{MountPoint: "/mnt/new", Pid: 42, DockerHost: "unix:///var/run/docker.sock", MountedAt: mountedAt}
+	if err := m.writeStatus("new", newMount); err != nil {
+		t.Fatalf("writeStatus() failed: %v", err)
+	}
+	status, err := m.ReadStatus()
+	if err != nil {
+		t.Fatalf("ReadStatus() failed: %v", err)
+	}
+	expected := map[string]MountStatus{
+		"old": {MountPoint: "/mnt/old"},
+		"ro":  {MountPoint: "/mnt/ro", ReadOnly: true},
+		"new": newMount,
+	}
+	if len(status) != len(expected) {
+		t.Errorf("ReadStatus() = %+v, expected %+v", status, expected)
+	}
+	for id, mount := range expected {
+		if status[id] != mount {
+			t.Errorf("status of %q = %+v, expected %+v", id, status[id], mount)
+		}
+	}
+}
+
+func TestMountFailureClearsStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{statusPath: filepath.Join(dir, "status.json"), Clients: &dockerfs.ClientFactory{}}
+	loadErr := errors.New("cannot fetch container content")
+	load := func(MountOptions) (fs.InodeEmbedder, served, func() MountResult, error) {
+		return nil, nil, nil, loadErr
+	}
+
+	if err := m.mount("web", filepath.Join(dir, "mnt"), MountOptions{}, load); !errors.Is(err, loadErr) {
+		t.Errorf("mount() = %v, expected %v", err, loadErr)
+	}
+	if status, _ := m.ReadStatus(); len(status) != 0 {
+		t.Errorf("failed mount is left in status: %+v", status)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.mount("web", filepath.Join(file, "mnt"), MountOptions{}, load); err == nil {
+		t.Errorf("mount() under a file succeeded")
+	}
+	if status, _ := m.ReadStatus(); len(status) != 0 {
+		t.Errorf("failed mount is left in status: %+v", status)
+	}
+}
+
+func TestListMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{statusPath: filepath.Join(dir, "status.json"), Clients: &dockerfs.ClientFactory{Host: "tcp://127.0.0.1:1"}}
+	defer func(f func(string) (bool, error)) { isMounted = f }(isMounted)
+	isMounted = func(path string) (bool, error) {
+		return path == "/mnt/live", nil
+	}
+	m.writeStatus(AllContainers, MountStatus{MountPoint: "/mnt/live"})
+	m.writeStatus("dead", MountStatus{MountPoint: "/mnt/dead"})
+
+	mounts, err := m.ListMounts(true)
+	if err != nil {
+		t.Fatalf("ListMounts() failed: %v", err)
+	}
+	if len(mounts) != 2 || mounts[0].ContainerId != "dead" || mounts[0].Mounted || !mounts[1].Mounted {
+		t.Errorf("ListMounts() = %+v", mounts)
+	}
+	status, _ := m.ReadStatus()
+	if _, ok := status["dead"]; ok || len(status) != 1 {
+		t.Errorf("stale mount is not pruned: %+v", status)
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	if got := unescapeMountPath(`/mnt/my\040dir\134x`); got != `/mnt/my dir\x` {
+		t.Errorf("unescapeMountPath() = %q", got)
+	}
+}
+
+func TestReleaseStaleMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{statusPath: filepath.Join(dir, "status.json")}
+	defer func(f func(string) bool) { isStale = f }(isStale)
+	defer func(f func(string) error) { unmountLazily = f }(unmountLazily)
+	isStale = func(path string) bool {
+		return path == "/mnt/crashed"
+	}
+	var unmounted []string
+	unmountLazily = func(path string) error {
+		unmounted = append(unmounted, path)
+		return nil
+	}
+	m.writeStatus("web", MountStatus{MountPoint: "/mnt/crashed"})
+
+	err = m.releaseStaleMounts("web", "/mnt/new", false)
+	if !errors.Is(err, syscall.ENOTCONN) || Hint(err) == "" {
+		t.Errorf("releaseStaleMounts() = %v, expected ENOTCONN with a hint", err)
+	}
+	if len(unmounted) != 0 {
+		t.Errorf("unmounted %v without force", unmounted)
+	}
+
+	if err := m.releaseStaleMounts("web", "/mnt/new", true); err != nil {
+		t.Fatalf("releaseStaleMounts() failed: %v", err)
+	}
+	if len(unmounted) != 1 || unmounted[0] != "/mnt/crashed" {
+		t.Errorf("unmounted %v, expected [/mnt/crashed]", unmounted)
+	}
+	if status, _ := m.ReadStatus(); len(status) != 0 {
+		t.Errorf("stale mount is left in status: %+v", status)
+	}
+}
+
+func TestResolveContainer(t *testing.T) {
+	containers := []types.Container{
+		{ID: "a80d96fa4c91aa", Names: []string{"/web-frontend"}},
+		{ID: "b0c1d2e3f4a5bb", Names: []string{"/web-backend"}},
+		{ID: "c3d4e5f6a7b8cc", Names: []string{"/db"}},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1.40/containers/json" {
+			json.NewEncoder(w).Encode(containers)
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1.40/containers/"), "/json")
+		for _, ct := range containers {
+			if ct.ID == id || ct.Names[0] == "/"+id {
+				json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: ct.ID}})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + id})
+	}))
+	defer srv.Close()
+	m := &Manager{Clients: &dockerfs.ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}}
+
+	for id, expected := range map[string]string{
+		"db":       "c3d4e5f6a7b8cc",
+		"web-back": "b0c1d2e3f4a5bb",
+		"c3d4":     "c3d4e5f6a7b8cc",
+	} {
+		if got, err := m.ResolveContainer(id); err != nil || got != expected {
+			t.Errorf("ResolveContainer(%q) = %q, %v, expected %q", id, got, err, expected)
+		}
+	}
+	if _, err := m.ResolveContainer("web"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("ResolveContainer(web) = %v, expected ambiguity error", err)
+	}
+	if _, err := m.ResolveContainer("cache"); !client.IsErrNotFound(err) {
+		t.Errorf("ResolveContainer(cache) = %v, expected not found error", err)
+	}
+}
+
+func TestUnmountContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{statusPath: filepath.Join(dir, "status.json")}
+	defer func(f func(string) (bool, error)) { isMounted = f }(isMounted)
+	defer func(f func(string) bool) { isStale = f }(isStale)
+	defer func(f func(string) error) { unmountPath = f }(unmountPath)
+	isMounted = func(path string) (bool, error) {
+		return path != "/mnt/gone", nil
+	}
+	isStale = func(path string) bool { return false }
+	unmountErr := errors.New("fusermount: exit status 1: Device or resource busy")
+	unmountPath = func(path string) error { return unmountErr }
+	m.writeStatus("web", MountStatus{MountPoint: "/mnt/web"})
+	m.writeStatus("db", MountStatus{MountPoint: "/mnt/gone"})
+
+	if err := m.UnmountContainer("web", "/mnt/web"); !errors.Is(err, unmountErr) {
+		t.Errorf("UnmountContainer() = %v, expected the unmount error", err)
+	}
+	if status, _ := m.ReadStatus(); status["web"].MountPoint != "/mnt/web" {
+		t.Errorf("mount is removed from status though unmount failed: %+v", status)
+	}
+
+	unmountErr = nil
+	if err := m.UnmountContainer("web", "/mnt/web"); err != nil {
+		t.Errorf("UnmountContainer() failed: %v", err)
+	}
+	// not mounted anymore, nothing to unmount
+	unmountPath = func(path string) error { t.Errorf("%s is unmounted", path); return nil }
+	if err := m.UnmountContainer("db", "/mnt/gone"); err != nil {
+		t.Errorf("UnmountContainer() of a gone mount failed: %v", err)
+	}
+	if status, _ := m.ReadStatus(); len(status) != 0 {
+		t.Errorf("unmounted containers are left in status: %+v", status)
+	}
+}
+
+func TestStopContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{statusPath: filepath.Join(dir, "status.json")}
+	defer func(f func(string) (bool, error)) { isMounted = f }(isMounted)
+	isMounted = func(path string) (bool, error) { return true, nil }
+
+	// stands for a mount process, exits on SIGTERM
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	m.writeStatus("web", MountStatus{MountPoint: "/mnt/web", Pid: cmd.Process.Pid})
+	m.writeStatus("old", MountStatus{MountPoint: "/mnt/old"})
+
+	if err := m.StopContainer("web"); err != nil {
+		t.Errorf("StopContainer() failed: %v", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Errorf("mount process is still running")
+		cmd.Process.Kill()
+	}
+	if err := m.StopContainer("old"); err == nil {
+		t.Errorf("StopContainer() of a mount without PID succeeded")
+	}
+	if err := m.StopContainer("db"); err == nil {
+		t.Errorf("StopContainer() of a container not mounted succeeded")
+	}
+}
+
+func TestWaitLoaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfs-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manager{statusPath: filepath.Join(dir, "status.json")}
+	defer func(interval time.Duration) { loadPollInterval = interval }(loadPollInterval)
+	loadPollInterval = 10 * time.Millisecond
+
+	// progress is recorded by the daemon only while it's loading
+	m.writeStatus("web", MountStatus{MountPoint: "/mnt/web", Pid: os.Getpid(), Loading: true})
+	m.recordProgress("web")(100)
+	if status, _ := m.ReadStatus(); status["web"].Fetched != 100 {
+		t.Errorf("recorded progress %d, expected 100", status["web"].Fetched)
+	}
+	m.writeStatus("web", MountStatus{MountPoint: "/mnt/web", Pid: os.Getpid()})
+	m.recordProgress("web")(200)
+	if status, _ := m.ReadStatus(); status["web"].Fetched != 0 {
+		t.Errorf("progress %d recorded for a served mount", status["web"].Fetched)
+	}
+
+	// stands for the daemon
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	m.writeStatus("db", MountStatus{MountPoint: "/mnt/db", Pid: cmd.Process.Pid, Loading: true, Fetched: 300})
+	go func() {
+		time.Sleep(10 * loadPollInterval)
+		m.writeStatus("db", MountStatus{MountPoint: "/mnt/db", Pid: cmd.Process.Pid})
+	}()
+	var reports []int64
+	if err := m.waitLoaded("db", cmd.Process, func(fetched int64) { reports = append(reports, fetched) }); err != nil {
+		t.Errorf("waitLoaded() failed: %v", err)
+	}
+	if len(reports) == 0 || reports[0] != 300 {
+		t.Errorf("progress reported as %v, expected the recorded one", reports)
+	}
+
+	cmd = exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.writeStatus("db", MountStatus{MountPoint: "/mnt/db", Pid: cmd.Process.Pid, Loading: true})
+	if err := m.waitLoaded("db", cmd.Process, func(int64) {}); err == nil {
+		t.Errorf("waitLoaded() of an exited daemon succeeded")
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_ping":
+			w.Header().Set("API-Version", "1.41")
+		case "/v1.40/version":
+			json.NewEncoder(w).Encode(types.Version{APIVersion: "1.41", MinAPIVersion: "1.12"})
+		case "/v1.40/containers/web/json":
+			json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: "a80d96fa4c91aa"}})
+		case "/v1.40/containers/a80d96fa4c91aa/export":
+			tw := tar.NewWriter(w)
+			tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755})
+			tw.Close()
+		case "/v1.40/containers/broken/json":
+			json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: "broken"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "page not found"})
+		}
+	}))
+	defer srv.Close()
+	m := &Manager{Clients: &dockerfs.ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}}
+
+	results := func(id string) map[string]Check {
+		t.Helper()
+		checks := make(map[string]Check)
+		for _, c := range m.Doctor(id) {
+			checks[c.Name] = c
+		}
+		return checks
+	}
+	checks := results("web")
+	for name, detail := range map[string]string{
+		"docker daemon is reachable":      "tcp://" + srv.Listener.Addr().String(),
+		"docker API version is supported": "API 1.40",
+		"container export is readable":    "a80d96fa4c91",
+	} {
+		if c, ok := checks[name]; !ok || c.Err != nil || c.Detail != detail {
+			t.Errorf("check %q = %+v (done: %v), expected pass with %q", name, c, ok, detail)
+		}
+	}
+	if _, ok := results("")["container export is readable"]; ok {
+		t.Errorf("export checked without container")
+	}
+	if c := results("broken")["container export is readable"]; c.Err == nil {
+		t.Errorf("export of missing container passed")
+	}
+
+	m = &Manager{Clients: &dockerfs.ClientFactory{Host: "tcp://127.0.0.1:1"}}
+	checks = results("web")
+	if c := checks["docker daemon is reachable"]; c.Err == nil {
+		t.Errorf("unreachable daemon passed")
+	}
+	if _, ok := checks["docker API version is supported"]; ok {
+		t.Errorf("API version checked with unreachable daemon")
+	}
+}
+
+func TestImageContainer(t *testing.T) {
+	var created container.Config
+	removed := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1.40/containers/create":
+			json.NewDecoder(r.Body).Decode(&created)
+			if created.Image != "nginx:latest" {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"message": "No such image: " + created.Image})
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(container.ContainerCreateCreatedBody{ID: "f00dfeedf00d"})
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1.40/containers/f00dfeedf00d":
+			if r.URL.Query().Get("force") != "1" {
+				t.Errorf("container removed without force: %s", r.URL)
+			}
+			removed = "f00dfeedf00d"
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	m := &Manager{Clients: &dockerfs.ClientFactory{Host: "tcp://" + srv.Listener.Addr().String(), APIVersion: "1.40"}}
+
+	id, err := m.createImageContainer("nginx:latest")
+	if err != nil || id != "f00dfeedf00d" {
+		t.Fatalf("createImageContainer() = %q, %v", id, err)
+	}
+	if created.Labels[imageMountLabel] != "nginx:latest" || len(created.Cmd) == 0 {
+		t.Errorf("container created with %+v, expected a label and a command", created)
+	}
+	if _, err := m.createImageContainer("missing"); !client.IsErrNotFound(err) {
+		t.Errorf("createImageContainer(missing) = %v, expected not found error", err)
+	}
+
+	img := &imageServed{Mng: dockerfs.NewMng(id, m.Clients, dockerfs.Options{}), remove: func() { m.removeImageContainer(id) }}
+	img.RemoveCache()
+	if removed != id {
+		t.Errorf("container is not removed with the cache")
+	}
+}
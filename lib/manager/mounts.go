@@ -0,0 +1,248 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/plesk/docker-fs/lib/log"
+)
+
+const procMounts = "/proc/self/mounts"
+
+// Mount is a mount recorded in status file.
+type Mount struct {
+	ContainerId   string
+	ContainerName string
+	MountStatus
+	// Mount point is served by a live FUSE mount
+	Mounted bool
+}
+
+// Mount checks, replaced in tests.
+var (
+	isMounted     = isFuseMount
+	isStale       = isStaleMount
+	unmountLazily = lazyUnmount
+	unmountPath   = unmount
+)
+
+// ListMounts returns mounts recorded in status file, sorted by mount point.
+// Stale entries, which mount point isn't mounted anymore, are removed from
+// status file if prune is set.
+func (m *Manager) ListMounts(prune bool) ([]Mount, error) {
+	status, err := m.ReadStatus()
+	if err != nil {
+		return nil, err
+	}
+	var mounts []Mount
+	for id, st := range status {
+		mount := Mount{ContainerId: id, MountStatus: st}
+		mount.Mounted, err = isMounted(st.MountPoint)
+		if err != nil {
+			log.Printf("[warning] Cannot check mount point %s: %v", st.MountPoint, err)
+			// keep it, it may be still mounted
+			mount.Mounted = true
+		}
+		mount.ContainerName = m.containerName(id)
+		mounts = append(mounts, mount)
+		if !mount.Mounted && prune {
+			if err := m.writeStatus(id, MountStatus{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].MountPoint < mounts[j].MountPoint
+	})
+	return mounts, nil
+}
+
+// containerName returns name of container, empty if it's unknown.
+func (m *Manager) containerName(id string) string {
+	if id == AllContainers {
+		return ""
+	}
+	cli, err := m.Clients.Client()
+	if err != nil {
+		return ""
+	}
+	info, err := cli.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(info.Name, "/")
+}
+
+// isFuseMount tells if path is a FUSE mount point which responds.
+func isFuseMount(path string) (bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		// missing mount point or dead FUSE server
+		return false, nil
+	}
+	f, err := os.Open(procMounts)
+	if os.IsNotExist(err) {
+		// no procfs, e.g. macOS: a mount point is on another device than its parent
+		var parent syscall.Stat_t
+		if err := syscall.Stat(filepath.Dir(path), &parent); err != nil {
+			return false, err
+		}
+		return st.Dev != parent.Dev, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], "fuse") {
+			continue
+		}
+		if unescapeMountPath(fields[1]) == path {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// unescapeMountPath decodes octal escapes of spaces and such in /proc/mounts.
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// releaseStaleMounts checks mountPoint and the mount point of container id
+// recorded in status file. Stale mounts, left by a crashed server, are
+// unmounted if force is set, otherwise an error is returned.
+func (m *Manager) releaseStaleMounts(id, mountPoint string, force bool) error {
+	status, err := m.ReadStatus()
+	if err != nil {
+		return err
+	}
+	paths := []string{mountPoint}
+	recorded, ok := status[id]
+	if ok && recorded.MountPoint != mountPoint {
+		paths = append(paths, recorded.MountPoint)
+	}
+	for _, path := range paths {
+		if !isStale(path) {
+			continue
+		}
+		if !force {
+			return fmt.Errorf("stale mount at %s: %w", path, syscall.ENOTCONN)
+		}
+		log.Printf("[warning] Releasing stale mount at %s...", path)
+		if err := unmountLazily(path); err != nil {
+			return fmt.Errorf("cannot release stale mount at %s: %w", path, err)
+		}
+		if path == recorded.MountPoint {
+			if err := m.writeStatus(id, MountStatus{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// How long StopContainer waits for the mount process to exit.
+var stopTimeout = 10 * time.Second
+
+// StopContainer asks the process serving mount of container id to unmount
+// and exit, the same way CTRL+C does, and waits for it.
+func (m *Manager) StopContainer(id string) error {
+	status, err := m.ReadStatus()
+	if err != nil {
+		return err
+	}
+	mount, ok := status[id]
+	if !ok {
+		return fmt.Errorf("container %v is not mounted", id)
+	}
+	if mounted, err := isMounted(mount.MountPoint); err == nil && !mounted {
+		// the recorded process may be gone and its PID reused
+		log.Printf("[warning] %s is not mounted", mount.MountPoint)
+		return m.writeStatus(id, MountStatus{})
+	}
+	if mount.Pid == 0 {
+		return fmt.Errorf("process serving %s is unknown, unmount it instead", mount.MountPoint)
+	}
+	proc, err := os.FindProcess(mount.Pid)
+	if err != nil {
+		return err
+	}
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		return fmt.Errorf("cannot stop process %d serving %s: %w", mount.Pid, mount.MountPoint, err)
+	}
+	for deadline := time.Now().Add(stopTimeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if err := proc.Signal(syscall.Signal(0)); err != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("process %d serving %s didn't exit in %v", mount.Pid, mount.MountPoint, stopTimeout)
+}
+
+// isStaleMount tells if path is a FUSE mount which server is gone.
+func isStaleMount(path string) bool {
+	_, err := os.Stat(path)
+	return errors.Is(err, syscall.ENOTCONN)
+}
+
+// unmount detaches mount at path with fusermount, which unprivileged users
+// may run, falling back to umount, e.g. on macOS.
+func unmount(path string) error {
+	var errs []string
+	for _, cmd := range [][]string{
+		{"fusermount", "-u", path},
+		{"fusermount3", "-u", path},
+		{"umount", path},
+	} {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v: %s", cmd[0], err, strings.TrimSpace(string(out))))
+	}
+	if len(errs) == 0 {
+		return errors.New("neither fusermount nor umount is found")
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// lazyUnmount detaches mount at path, even if it's busy.
+func lazyUnmount(path string) error {
+	cmd := exec.Command("fusermount", "-u", "-z", path)
+	if runtime.GOOS != "linux" {
+		cmd = exec.Command("umount", "-f", path)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
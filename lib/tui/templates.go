@@ -5,20 +5,21 @@ import (
 )
 
 var listTemplates = &promptui.SelectTemplates{
-	Label:    "Select container to mount/unmount. {{ \"(use ^C to exit)\" | faint }}",
-	Active:   "\U0000261E {{ if .Mounted }}{{ .ShortId | blue | bold }} {{ .Name | blue | bold }} (mounted){{ else }}{{ .ShortId | bold }} {{ .Name | bold }}{{ end }}",
-	Inactive: "  {{ if .Mounted }}{{ .ShortId | blue }} {{ .Name | blue }} (mounted){{else}}{{ .ShortId }} {{ .Name }}{{ end }}",
+	Label:    "Select container to mount/unmount. {{ \"(type to filter, use ^C to exit)\" | faint }}",
+	Active:   "\U0000261E {{ if .Mounted }}{{ \"\u25b2\" | blue | bold }} {{ .ShortId | blue | bold }} {{ .Name | blue | bold }} {{ .State | faint }} {{ .MountPoint | blue }}{{ else }}\u25bd {{ .ShortId | bold }} {{ .Name | bold }} {{ .State | faint }}{{ end }}",
+	Inactive: "  {{ if .Mounted }}{{ \"\u25b2\" | blue }} {{ .ShortId | blue }} {{ .Name | blue }} {{ .State | faint }} {{ .MountPoint | blue }}{{ else }}\u25bd {{ .ShortId }} {{ .Name }} {{ .State | faint }}{{ end }}",
 	Details: `
 ------ Container ------
 Id: {{ .Id }}
 Name:  {{ .Names }}
 Image: {{ .Image }}
 Command: {{ .Command }}
+State: {{ .Status }}
 {{ if .Mounted }}MountPoint: {{ .MountPoint }}{{ end }}`,
 }
 
 var confirmUnmountTemplates = &promptui.SelectTemplates{
-	Label:    "{{ \"Unmount\" | red }} container {{ .Id | bold}} from {{ .Mp | bold }}",
+	Label:    "{{ \"Unmount\" | red }} container {{ .Id | bold}} from {{ .Mp | bold }}{{ if .ReadOnly }} (read-only){{ end }}{{ if .Pid }}, served by PID {{ .Pid }}{{ end }}{{ if not .MountedAt.IsZero }} since {{ .MountedAt.Format \"2006-01-02 15:04\" }}{{ end }}",
 	Active:   "\U0000261E {{ . | bold }}",
 	Inactive: "  {{ . }}",
 }
@@ -2,10 +2,15 @@ package tui
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/docker/docker/api/types"
 	"github.com/manifoldco/promptui"
 	"github.com/plesk/docker-fs/lib/manager"
 )
@@ -37,6 +42,73 @@ func (t *Tui) Run(state State) error {
 	}
 }
 
+// listItem is a container in the list, as listTemplates render it.
+type listItem struct {
+	types.Container
+	Id      string
+	ShortId string
+	// the first name, without leading slash
+	Name       string
+	Mounted    bool
+	MountPoint string
+}
+
+func newListItem(ct types.Container, status map[string]manager.MountStatus) *listItem {
+	item := &listItem{Container: ct, Id: ct.ID, ShortId: ct.ID, Name: "-"}
+	if len(ct.ID) > 12 {
+		item.ShortId = ct.ID[:12]
+	}
+	if len(ct.Names) > 0 {
+		item.Name = strings.TrimPrefix(ct.Names[0], "/")
+	}
+	if mount, ok := status[ct.ID]; ok {
+		item.Mounted, item.MountPoint = true, mount.MountPoint
+	}
+	return item
+}
+
+// matches tells if input is a part of container name or id, case aside.
+func (i *listItem) matches(input string) bool {
+	input = strings.ToLower(strings.TrimSpace(input))
+	return strings.Contains(strings.ToLower(i.Name), input) || strings.Contains(strings.ToLower(i.Id), input)
+}
+
+// defaultMountPoint returns directory to mount container to, under
+// $XDG_DATA_HOME (~/.local/share by default).
+func defaultMountPoint(name string) string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "./mount-" + name
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "dockerfs", "mounts", name)
+}
+
+// checkMountPoint accepts a missing path, to be created, or an empty directory.
+func checkMountPoint(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", path)
+	}
+	return nil
+}
+
 func (t *Tui) list() error {
 	cts, err := t.mng.ListContainers()
 	if err != nil {
@@ -48,25 +120,36 @@ func (t *Tui) list() error {
 		return err
 	}
 
+	// pointers, promptui compares items to find the selected one
+	items := make([]*listItem, len(cts))
+	for i, ct := range cts {
+		items[i] = newListItem(ct, status)
+	}
 	sel := promptui.Select{
 		Label:     "Label",
-		Items:     cts,
+		Items:     items,
 		Templates: listTemplates,
+		Searcher: func(input string, index int) bool {
+			return items[index].matches(input)
+		},
+		StartInSearchMode: true,
 	}
 	i, _, err := sel.Run()
 	if err != nil {
 		return err
 	}
 	ct := cts[i]
-	if mp, ok := status[ct.ID]; ok {
+	if mount, ok := status[ct.ID]; ok {
 		// ask to unmount
 		sel := promptui.Select{
 			Label: struct {
 				Id string
 				Mp string
+				manager.MountStatus
 			}{
-				Id: ct.ID,
-				Mp: mp,
+				Id:          ct.ID,
+				Mp:          mount.MountPoint,
+				MountStatus: mount,
 			},
 			Items: []string{
 				"Yes",
@@ -83,28 +166,66 @@ func (t *Tui) list() error {
 			return nil
 		}
 		// unmounting
-		if err := t.mng.UnmountContainer(ct.ID, mp); err != nil {
+		if err := t.mng.UnmountContainer(ct.ID, mount.MountPoint); err != nil {
 			return err
 		}
 	} else {
 		// Mounting
+		name := items[i].Name
+		if len(ct.Names) == 0 {
+			name = items[i].ShortId
+		}
 		promptPath := promptui.Prompt{
 			Label:     "Choose path to mount docker container",
-			Default:   fmt.Sprintf("./mount-%v", cts[i].Names[0]),
+			Default:   defaultMountPoint(name),
 			AllowEdit: true,
+			Validate:  checkMountPoint,
 		}
 
 		mountPoint, err := promptPath.Run()
 		if err != nil {
 			log.Fatal(err)
 		}
+		if err := os.MkdirAll(mountPoint, 0755); err != nil {
+			return fmt.Errorf("Cannot create mount point: %w", err)
+		}
 
 		executable, err := os.Executable()
 		if err != nil {
 			return fmt.Errorf("Cannot detect executable path: %w", err)
 		}
 
-		cmd := exec.Command(executable, "-id", cts[i].ID, "-mount", mountPoint, "-daemonize")
+		args := []string{"-id", cts[i].ID, "-mount", mountPoint, "-daemonize"}
+		if t.mng.Clients.Host != "" {
+			args = append(args, "-docker-host", t.mng.Clients.Host)
+		}
+		if t.mng.Clients.Socket != "" {
+			args = append(args, "-docker-socket", t.mng.Clients.Socket)
+		}
+		if t.mng.Clients.APIVersion != "" {
+			args = append(args, "-docker-api-version", t.mng.Clients.APIVersion)
+		}
+		if t.mng.Clients.Timeout != 0 {
+			args = append(args, "-docker-timeout", t.mng.Clients.Timeout.String())
+		}
+		if t.mng.Clients.MaxDownloadRate != 0 {
+			args = append(args, "-max-download-rate", strconv.FormatInt(t.mng.Clients.MaxDownloadRate, 10))
+		}
+		if t.mng.Clients.TLSVerify {
+			args = append(args, "-tlsverify")
+		}
+		for flag, value := range map[string]string{
+			"-tlscacert": t.mng.Clients.TLSCACert,
+			"-tlscert":   t.mng.Clients.TLSCert,
+			"-tlskey":    t.mng.Clients.TLSKey,
+		} {
+			if value != "" {
+				args = append(args, flag, value)
+			}
+		}
+		cmd := exec.Command(executable, args...)
+		// progress of fetching container content is printed until it's mounted
+		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("Mount command failed: %w", err)
 		}
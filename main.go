@@ -1,15 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/plesk/docker-fs/lib/dockerfs"
 	"github.com/plesk/docker-fs/lib/log"
 	"github.com/plesk/docker-fs/lib/tui"
 
 	"github.com/plesk/docker-fs/lib/manager"
 
+	"github.com/docker/go-units"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -20,13 +26,73 @@ var (
 	// Directory to mount container FS
 	mountPoint string
 
-	//
+	// Mount all containers, one subdirectory each
+	allContainers bool
+
+	// Docker image to mount instead of a container
+	image string
+	// Digest of image layer to mount the image as of
+	layer string
+
+	// Path to docker unix socket, alternative to dockerHost
 	dockerSocketAddr string
 
+	// Docker daemon address (unix:///path, tcp://host:port or socket path)
+	dockerHost string
+	// Docker API version, negotiated with daemon if empty
+	dockerAPIVersion string
+	// Limit of a docker API request
+	dockerTimeout time.Duration
+	// Limit of download rate, e.g. 2M, bytes per second
+	maxDownloadRate string
+
+	// TLS settings for tcp:// docker hosts
+	tlsVerify                  bool
+	tlsCACert, tlsCert, tlsKey string
+
 	daemonize bool
+	// Keep mount in foreground, logging to terminal
+	foreground bool
+	// Release stale mounts before mounting
+	force bool
+	// Only report how much mounting would fetch
+	dryRun bool
+
+	// Let root or all users access the mount
+	allowRoot, allowOther bool
+
+	// Owner of files in the mount, -1 means the current user
+	uid, gid int
+
+	// Reject modifications of container FS
+	readOnly bool
 
 	logLevel       string
+	logFormat      string
 	verbose, quiet bool
+
+	// Print hints on how to fix well-known errors
+	prettyErrors bool
+
+	retryExport       int
+	writebackDelay    time.Duration
+	backgroundRefresh bool
+	changesInterval   time.Duration
+	negativeLookups   time.Duration
+	maxOpenFiles      int
+	readWriteCheck    string
+	probeDir          string
+	containerShell    string
+	timestampSource   string
+	fileCache         bool
+	noCache           bool
+	keepCache         bool
+	maxCacheSize      string
+	include           string
+	exclude           stringList
+
+	// Print mount result as JSON
+	jsonOutput bool
 )
 
 func init() {
@@ -36,35 +102,70 @@ func init() {
 	flag.StringVar(&mountPoint, "mount", "", "Mount point for containter FS")
 	flag.StringVar(&mountPoint, "m", "", "Mount point for containter FS")
 
+	flag.BoolVar(&allContainers, "all", false, "Mount all containers, stopped ones included, each one in a subdirectory of mount point")
+	flag.StringVar(&image, "image", "", "Docker image to mount read-only, from a container created for the mount and removed on unmount")
+	flag.StringVar(&layer, "layer", "", "Mount -image as of its layer with this digest (as 'docker image inspect' lists them), applying layers up to it")
+
 	flag.BoolVar(&daemonize, "daemonize", false, "Daemonize fuse process")
 	flag.BoolVar(&daemonize, "d", false, "Daemonize fuse process")
+	flag.BoolVar(&force, "force", false, "Release stale mount of the container or at mount point, left by a crashed docker-fs")
+	flag.BoolVar(&dryRun, "dry-run", false, "Fetch and parse container content, print its number of files and size, and exit without mounting")
+	flag.BoolVar(&foreground, "foreground", false, "Serve mount in foreground, log to terminal (at 'info' level by default) and unmount on CTRL+C")
 
-	// TODO make http support
-	flag.StringVar(&dockerSocketAddr, "docker-socket", "/var/run/docker.sock", "Docker socket")
+	flag.BoolVar(&allowRoot, "allow-root", false, "Let root access the mount (requires 'user_allow_other' in /etc/fuse.conf)")
+	flag.BoolVar(&allowOther, "allow-other", false, "Let all users access the mount (requires 'user_allow_other' in /etc/fuse.conf)")
+	flag.IntVar(&uid, "uid", -1, "Owner uid of files in the mount (default: current user)")
+	flag.IntVar(&gid, "gid", -1, "Owner gid of files in the mount (default: current user)")
+
+	flag.IntVar(&retryExport, "retry-export", 3, "Number of attempts to fetch container content, the delay between them doubles from 1s")
+	flag.BoolVar(&backgroundRefresh, "background-refresh", false, "Refresh container FS changes in background before they get stale")
+	flag.DurationVar(&changesInterval, "changes-interval", dockerfs.DefaultChangesInterval, "How long container FS changes are reused before fetching them again (0 - fetch on every directory listing)")
+	flag.DurationVar(&negativeLookups, "negative-lookup-ttl", time.Second, "How long missing files are reported so without asking docker again (0 - disabled)")
+	flag.IntVar(&maxOpenFiles, "max-open-files", 0, "Limit of simultaneously open files in the mount (0 - unlimited)")
+	flag.StringVar(&readWriteCheck, "mount-readwrite-check", "", "Check that writes to container work before mounting: 'abort' or 'downgrade' to read-only on failure")
+	flag.StringVar(&probeDir, "readwrite-probe-dir", "/tmp", "Directory in container for the read-write check probe file")
+	flag.StringVar(&containerShell, "container-shell", "", "Shell to run helper commands in container (default: /bin/sh if present, otherwise commands are run directly)")
+	flag.StringVar(&timestampSource, "timestamp-source", dockerfs.TimestampStat, "Modification time of files: 'stat' (live, edits get time of write), 'archive' (as exported, edits keep it) or 'now' (live, edits get time of save)")
+	flag.BoolVar(&fileCache, "file-cache", true, "Cache content of files read from container in ~/.cache/dockerfs/files")
+	flag.BoolVar(&keepCache, "keep-cache", false, "Keep cached file content of container in ~/.cache/dockerfs on unmount, so the next mount doesn't copy unchanged files again")
+	flag.BoolVar(&noCache, "no-cache", false, "Keep nothing in ~/.cache/dockerfs, implies -file-cache=false")
+	flag.StringVar(&maxCacheSize, "max-cache-size", "", "Limit of ~/.cache/dockerfs size, e.g. 500M or 2G, least recently used files are pruned (default: unlimited)")
+	flag.StringVar(&include, "include", "", "Directory in container to mount instead of its root, e.g. /app (-exclude patterns apply inside of it)")
+	flag.Var(&exclude, "exclude", "Hide paths in container matching a glob pattern, e.g. /proc or '/*/node_modules', with everything under them (may be repeated)")
+	flag.BoolVar(&readOnly, "readonly", false, "Mount container FS read-only")
+	flag.BoolVar(&jsonOutput, "json", false, "Print result of mounting as a JSON object to stdout")
+	flag.DurationVar(&writebackDelay, "writeback-delay", 0, "Delay saving of closed files to batch rapid edits (fsync saves immediately)")
+
+	flag.StringVar(&dockerSocketAddr, "docker-socket", "", "Docker socket path, e.g. $XDG_RUNTIME_DIR/docker.sock of rootless docker (default /var/run/docker.sock)")
+	flag.StringVar(&dockerHost, "docker-host", "", "Docker daemon address, e.g. tcp://dind:2375, ssh://user@host or unix:///path/to/docker.sock (default $DOCKER_HOST)")
+	flag.BoolVar(&tlsVerify, "tlsverify", false, "Use TLS and verify the docker daemon (default certificates are taken from $DOCKER_CERT_PATH or ~/.docker)")
+	flag.StringVar(&tlsCACert, "tlscacert", "", "Trust certs signed only by this CA, implies -tlsverify")
+	flag.StringVar(&tlsCert, "tlscert", "", "Path to TLS certificate file")
+	flag.StringVar(&tlsKey, "tlskey", "", "Path to TLS key file")
+	flag.DurationVar(&dockerTimeout, "docker-timeout", 30*time.Second, "Limit of a docker API request made by mounted FS, reading of files fails once no data comes for this long (0 - no limit)")
+	flag.StringVar(&maxDownloadRate, "max-download-rate", "", "Limit of bytes per second read from docker by mounted FS, e.g. 512K or 2M (default: unlimited)")
+	flag.StringVar(&dockerAPIVersion, "docker-api-version", "", "Docker API version, e.g. 1.40 (default $DOCKER_API_VERSION or negotiated with daemon)")
 
 	flag.StringVar(&logLevel, "log-level", "warning", "Logging level")
+	flag.StringVar(&logFormat, "log-format", log.FormatText, "Format of log records: 'text' or 'json' (one object per line with time, level, msg, container and path fields)")
 	flag.BoolVar(&verbose, "verbose", false, "Increase loggin level to 'debug'")
 	flag.BoolVar(&verbose, "v", false, "Increase loggin level to 'debug'")
 	flag.BoolVar(&quiet, "quiet", false, "Decrease loggin level to 'error'")
 	flag.BoolVar(&quiet, "q", false, "Decrease loggin level to 'error'")
+
+	flag.BoolVar(&prettyErrors, "pretty-errors", false, "Suggest fixes for well-known errors")
+
+	flag.Usage = usage
 }
 
 func main() {
 	flag.Parse()
 
-	if containerId != "" {
-		if mountPoint == "" {
-			fmt.Fprintf(os.Stderr, "Mount point is not specified.\n")
-			flag.Usage()
-			os.Exit(2)
-		}
-		mng := manager.New()
-		if err := mng.MountContainer(containerId, mountPoint, daemonize); err != nil {
-			log.Fatal(err)
-		}
-		return
+	if foreground && daemonize {
+		fmt.Fprintf(os.Stderr, "Only one of -foreground and -daemonize can be used.\n")
+		flag.Usage()
+		os.Exit(2)
 	}
-
 	if verbose && quiet {
 		fmt.Fprintf(os.Stderr, "Cannot make it quite and verbose simultaneously\n")
 		flag.Usage()
@@ -76,16 +177,257 @@ func main() {
 	if quiet {
 		logLevel = log.Error.String()
 	}
+	if foreground && !verbose && !quiet && !flagIsSet("log-level") {
+		// show progress of mounting
+		logLevel = log.Info.String()
+	}
 	if err := log.SetLevel(logLevel); err != nil {
 		log.Printf("[warning] cannot set log level: %q (%v)", logLevel, err)
 	}
+	if err := log.SetFormat(logFormat); err != nil {
+		log.Printf("[warning] cannot set log format: %q (%v)", logFormat, err)
+	}
+
+	if containerId != "" || allContainers || image != "" {
+		if (containerId != "" && allContainers) || (image != "" && (containerId != "" || allContainers)) {
+			fmt.Fprintf(os.Stderr, "Only one of -id, -all and -image can be used.\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		if layer != "" && image == "" {
+			fmt.Fprintf(os.Stderr, "-layer can be used with -image only.\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		if dryRun && (allContainers || image != "") {
+			fmt.Fprintf(os.Stderr, "-dry-run can be used with -id only.\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		if mountPoint == "" && !dryRun {
+			fmt.Fprintf(os.Stderr, "Mount point is not specified.\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		if readWriteCheck != "" && readWriteCheck != dockerfs.RWCheckAbort && readWriteCheck != dockerfs.RWCheckDowngrade {
+			fmt.Fprintf(os.Stderr, "Unknown -mount-readwrite-check value %q.\n", readWriteCheck)
+			flag.Usage()
+			os.Exit(2)
+		}
+		switch timestampSource {
+		case dockerfs.TimestampStat, dockerfs.TimestampArchive, dockerfs.TimestampNow:
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown -timestamp-source value %q.\n", timestampSource)
+			flag.Usage()
+			os.Exit(2)
+		}
+		if include != "" && !strings.HasPrefix(include, "/") {
+			fmt.Fprintf(os.Stderr, "Bad -include path %q, it should be absolute.\n", include)
+			flag.Usage()
+			os.Exit(2)
+		}
+		for _, pattern := range exclude {
+			if _, err := filepath.Match(pattern, "/"); err != nil || !strings.HasPrefix(pattern, "/") {
+				fmt.Fprintf(os.Stderr, "Bad -exclude pattern %q, it should be a glob of absolute paths.\n", pattern)
+				flag.Usage()
+				os.Exit(2)
+			}
+		}
+		if allowRoot && allowOther {
+			fmt.Fprintf(os.Stderr, "Only one of -allow-root and -allow-other can be used.\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		mng := manager.New()
+		mng.PrettyErrors = prettyErrors
+		setClientOptions(mng.Clients)
+		opts := manager.MountOptions{
+			Daemonize:  daemonize,
+			Foreground: foreground,
+			Force:      force,
+			AllowRoot:  allowRoot,
+			AllowOther: allowOther,
+			Layer:      layer,
+			Options: dockerfs.Options{
+				ReadOnly:          readOnly,
+				RetryExport:       retryExport,
+				WritebackDelay:    writebackDelay,
+				BackgroundRefresh: backgroundRefresh,
+				NegativeLookupTTL: negativeLookups,
+				MaxOpenFiles:      maxOpenFiles,
+				ReadWriteCheck:    readWriteCheck,
+				ProbeDir:          probeDir,
+				ContainerShell:    containerShell,
+				TimestampSource:   timestampSource,
+				FileCache:         fileCache,
+				NoCache:           noCache,
+				KeepCache:         keepCache,
+				Include:           include,
+				Exclude:           exclude,
+			},
+		}
+		if maxCacheSize != "" {
+			size, err := units.RAMInBytes(maxCacheSize)
+			if err != nil || size <= 0 {
+				fmt.Fprintf(os.Stderr, "Bad -max-cache-size %q, expected a size like 500M or 2G.\n", maxCacheSize)
+				flag.Usage()
+				os.Exit(2)
+			}
+			opts.MaxCacheSize = size
+		}
+		if changesInterval == 0 {
+			opts.ChangesInterval = -1
+		} else {
+			opts.ChangesInterval = changesInterval
+		}
+		if uid >= 0 {
+			opts.Uid = ownerId(uid)
+		}
+		if gid >= 0 {
+			opts.Gid = ownerId(gid)
+		}
+		if jsonOutput {
+			opts.Report = printMountResult
+		}
+		if isTerminal(os.Stderr) && !quiet {
+			// a daemon reports it through its parent, which waits for the mount
+			opts.ExportProgress = dockerfs.ProgressPrinter(os.Stderr)
+		}
+		if dryRun {
+			if err := estimate(mng, containerId, opts.Options); err != nil {
+				fatal(err)
+			}
+			return
+		}
+		mount := func() error {
+			return mng.MountContainer(containerId, mountPoint, opts)
+		}
+		if allContainers {
+			containerId = manager.AllContainers
+			mount = func() error {
+				return mng.MountContainers(mountPoint, opts)
+			}
+		}
+		if image != "" {
+			containerId = manager.ImageKey(image)
+			mount = func() error {
+				return mng.MountImage(image, mountPoint, opts)
+			}
+		}
+		if err := mount(); err != nil {
+			if jsonOutput {
+				printMountResult(manager.MountResult{
+					ContainerId: containerId,
+					MountPoint:  mountPoint,
+					Pid:         os.Getpid(),
+					Error:       err.Error(),
+				})
+			}
+			fatal(err)
+		}
+		return
+	}
 
 	mng := manager.New()
+	mng.PrettyErrors = prettyErrors
+	setClientOptions(mng.Clients)
+
+	if flag.NArg() > 0 {
+		if err := runCommand(mng, flag.Arg(0), flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
 	ui := tui.NewTui(mng)
 
 	if err := ui.Run(tui.List); err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+}
+
+// stringList is a flag which may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func setClientOptions(clients *dockerfs.ClientFactory) {
+	if dockerHost != "" && dockerSocketAddr != "" {
+		fmt.Fprintf(os.Stderr, "Only one of -docker-host and -docker-socket can be used.\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+	clients.Host = dockerHost
+	clients.Socket = dockerSocketAddr
+	clients.APIVersion = dockerAPIVersion
+	clients.Timeout = dockerTimeout
+	if maxDownloadRate != "" {
+		rate, err := units.RAMInBytes(maxDownloadRate)
+		if err != nil || rate <= 0 {
+			fmt.Fprintf(os.Stderr, "Bad -max-download-rate %q, expected a size like 512K or 2M.\n", maxDownloadRate)
+			flag.Usage()
+			os.Exit(2)
+		}
+		clients.MaxDownloadRate = rate
+	}
+	clients.TLSVerify = tlsVerify
+	clients.TLSCACert, clients.TLSCert, clients.TLSKey = tlsCACert, tlsCert, tlsKey
+}
+
+func flagIsSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// isTerminal tells if f is a terminal, e.g. to print progress to.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func ownerId(id int) *uint32 {
+	v := uint32(id)
+	return &v
+}
+
+func fatal(err error) {
+	if prettyErrors {
+		if hint := manager.Hint(err); hint != "" {
+			log.Fatalf("%v\nTry: %s", err, hint)
+		}
+	}
+	log.Fatal(err)
+}
+
+func printMountResult(result manager.MountResult) {
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		log.Printf("[error] Cannot print mount result: %v", err)
+	}
+}
+
+// estimate prints how much mounting of container with opts fetches.
+func estimate(mng *manager.Manager, containerId string, opts dockerfs.Options) error {
+	est, err := mng.Estimate(containerId, opts)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(est)
 	}
+	fmt.Printf("%d files, %d bytes of content (up to as much in file cache)\n", est.Files, est.Size)
+	fmt.Printf("Docker reports %d bytes in container, %d bytes changed since it was created\n", est.SizeRootFs, est.SizeRw)
+	return nil
 }
 
 func shutdown(server *fuse.Server, signals <-chan os.Signal) {